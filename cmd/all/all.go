@@ -5,7 +5,11 @@ import (
 	// Active commands
 	_ "github.com/brandur/rhttpserve/cmd"
 	_ "github.com/brandur/rhttpserve/cmd/generate"
+	_ "github.com/brandur/rhttpserve/cmd/get"
+	_ "github.com/brandur/rhttpserve/cmd/inspect"
+	_ "github.com/brandur/rhttpserve/cmd/revoke"
 	_ "github.com/brandur/rhttpserve/cmd/serve"
 	_ "github.com/brandur/rhttpserve/cmd/sign"
+	_ "github.com/brandur/rhttpserve/cmd/verify"
 	_ "github.com/brandur/rhttpserve/cmd/version"
 )
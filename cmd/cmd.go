@@ -2,9 +2,7 @@ package cmd
 
 import (
 	"fmt"
-	"log"
 	"os"
-	"path"
 
 	"github.com/ncw/rclone/fs"
 	"github.com/spf13/cobra"
@@ -49,13 +47,6 @@ func init() {
 	cobra.OnInitialize(initConfig)
 }
 
-// NewFsSrc creates a new src fs from the arguments
-func NewFsSrc(args []string) fs.Fs {
-	fsrc := newFsSrc(args[0])
-	fs.CalculateModifyWindow(fsrc)
-	return fsrc
-}
-
 // CheckArgs checks there are enough arguments and prints a message if not
 func CheckArgs(MinArgs, MaxArgs int, cmd *cobra.Command, args []string) {
 	if len(args) < MinArgs {
@@ -79,30 +70,3 @@ func initConfig() {
 	// Load the rest of the config now we have started the logger
 	fs.LoadConfig()
 }
-
-// newFsSrc creates a src Fs from a name
-//
-// This can point to a file
-func newFsSrc(remote string) fs.Fs {
-	fsInfo, configName, fsPath, err := fs.ParseRemote(remote)
-	if err != nil {
-		fs.Stats.Error()
-		log.Fatalf("Failed to create file system for %q: %v", remote, err)
-	}
-	f, err := fsInfo.NewFs(configName, fsPath)
-	if err == fs.ErrorIsFile {
-		if !fs.Config.Filter.InActive() {
-			fs.Stats.Error()
-			log.Fatalf("Can't limit to single files when using filters: %v", remote)
-		}
-		// Limit transfers to this file
-		err = fs.Config.Filter.AddFile(path.Base(fsPath))
-		// Set --no-traverse as only one file
-		fs.Config.NoTraverse = true
-	}
-	if err != nil {
-		fs.Stats.Error()
-		log.Fatalf("Failed to create file system for %q: %v", remote, err)
-	}
-	return f
-}
@@ -11,28 +11,70 @@ import (
 	"golang.org/x/crypto/ed25519"
 )
 
+var (
+	keyID    string
+	tokenKey bool
+)
+
 var serveCmd = &cobra.Command{
 	Use:   "generate",
 	Short: `Generates a public/private key pair.`,
 	Long: `
 Generates a public/private key pair that can be used to sign and verify
 requests to and from the program.
+
+Give the pair a key ID to rotate keys without invalidating outstanding links.
+The server can trust several named public keys at once:
+
+	rhttpserve generate --key-id 2017-02
+
+With --token-key, generates a key for opaque links instead, which is shared by
+the server and the clients that sign them:
+
+	rhttpserve generate --token-key
 `,
 	Run: func(command *cobra.Command, args []string) {
 		cmd.CheckArgs(0, 0, command, args)
 
+		if tokenKey {
+			key := make([]byte, 32)
+			_, err := rand.Read(key)
+			if err != nil {
+				common.ExitWithError(err)
+			}
+
+			fmt.Printf("RHTTPSERVE_TOKEN_KEY=%s\n", base64.URLEncoding.EncodeToString(key))
+			return
+		}
+
+		if keyID != "" {
+			err := common.ValidateKeyID(keyID)
+			if err != nil {
+				common.ExitWithError(err)
+			}
+		}
+
 		public, private, err := generate()
 		if err != nil {
 			common.ExitWithError(err)
 		}
 
-		fmt.Printf("RHTTPSERVE_PUBLIC_KEY=%s\n", public)
+		if keyID == "" {
+			fmt.Printf("RHTTPSERVE_PUBLIC_KEY=%s\n", public)
+		} else {
+			// Add to the server's RHTTPSERVE_PUBLIC_KEYS (semicolon-separated)
+			// alongside any keys that are still in use.
+			fmt.Printf("RHTTPSERVE_PUBLIC_KEYS=%s:%s\n", keyID, public)
+			fmt.Printf("RHTTPSERVE_KEY_ID=%s\n", keyID)
+		}
 		fmt.Printf("RHTTPSERVE_PRIVATE_KEY=%s\n", private)
 	},
 }
 
 func init() {
 	cmd.Root.AddCommand(serveCmd)
+	serveCmd.Flags().StringVar(&keyID, "key-id", "", "Name the key pair for rotation")
+	serveCmd.Flags().BoolVar(&tokenKey, "token-key", false, "Generate a key for opaque links instead")
 }
 
 func generate() (string, string, error) {
@@ -0,0 +1,109 @@
+package get
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// digestAlgorithms are the algorithms that a download can be verified with,
+// strongest first. They're named as in the registry shared by the Digest and
+// Repr-Digest headers, where "sha" is SHA-1.
+var digestAlgorithms = []struct {
+	name    string
+	newHash func() hash.Hash
+}{
+	{"sha-512", sha512.New},
+	{"sha-256", sha256.New},
+	{"sha", sha1.New},
+	{"md5", md5.New},
+}
+
+// digest is a checksum of a whole file that a server has sent.
+type digest struct {
+	algorithm string
+	sum       []byte
+	newHash   func() hash.Hash
+}
+
+// Verify checks that the contents of r match the digest.
+func (d *digest) Verify(r io.Reader) error {
+	h := d.newHash()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(h.Sum(nil), d.sum) {
+		return fmt.Errorf("%s digest doesn't match: got %s, expected %s", d.algorithm,
+			base64.StdEncoding.EncodeToString(h.Sum(nil)),
+			base64.StdEncoding.EncodeToString(d.sum))
+	}
+	return nil
+}
+
+// parseDigest returns the strongest digest of the whole file that headers
+// (or trailers) of a response carry, or nil if there's none that can be
+// used. Repr-Digest (RFC 9530) values look like "sha-256=:<base64>:", Digest
+// (RFC 3230) values like "SHA-256=<base64>", and Content-MD5 is plain base64.
+//
+// Content-MD5 covers only the body of the response that it's on, so it
+// mustn't be taken from a response to a range request.
+func parseDigest(header http.Header) *digest {
+	sums := make(map[string][]byte)
+
+	// Digest goes first so that Repr-Digest wins if they disagree.
+	for _, name := range []string{"Digest", "Repr-Digest"} {
+		for _, value := range header[name] {
+			for _, member := range strings.Split(value, ",") {
+				parts := strings.SplitN(strings.TrimSpace(member), "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+
+				encoded := parts[1]
+				if name == "Repr-Digest" {
+					if len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+						continue
+					}
+					encoded = encoded[1 : len(encoded)-1]
+				}
+
+				sum, err := base64.StdEncoding.DecodeString(encoded)
+				if err != nil {
+					continue
+				}
+				sums[strings.ToLower(parts[0])] = sum
+			}
+		}
+	}
+
+	if _, ok := sums["md5"]; !ok {
+		if encoded := header.Get("Content-MD5"); encoded != "" {
+			sum, err := base64.StdEncoding.DecodeString(encoded)
+			if err == nil {
+				sums["md5"] = sum
+			}
+		}
+	}
+
+	for _, algorithm := range digestAlgorithms {
+		sum, ok := sums[algorithm.name]
+		if ok && len(sum) == algorithm.newHash().Size() {
+			return &digest{
+				algorithm: algorithm.name,
+				sum:       sum,
+				newHash:   algorithm.newHash,
+			}
+		}
+	}
+	return nil
+}
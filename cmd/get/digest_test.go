@@ -0,0 +1,46 @@
+package get
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Digests of "hello".
+const (
+	testMD5    = "XUFAKrxLKna5cZ2REBfFkg=="
+	testSHA256 = "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="
+)
+
+func TestParseDigest(t *testing.T) {
+	for _, header := range []http.Header{
+		{"Repr-Digest": {"sha-256=:" + testSHA256 + ":"}},
+		{"Repr-Digest": {"unixsum=:AAA=:, sha-256=:" + testSHA256 + ":"}},
+		{"Digest": {"SHA-256=" + testSHA256}},
+		{"Digest": {"MD5=" + testMD5}, "Repr-Digest": {"sha-256=:" + testSHA256 + ":"}},
+		{"Content-Md5": {testMD5}},
+	} {
+		d := parseDigest(header)
+		if assert.NotNil(t, d, "%v", header) {
+			assert.NoError(t, d.Verify(bytes.NewReader([]byte("hello"))), "%v", header)
+			assert.Error(t, d.Verify(bytes.NewReader([]byte("hullo"))), "%v", header)
+		}
+	}
+
+	assert.Equal(t, "sha-256", parseDigest(http.Header{
+		"Digest":      {"md5=" + testMD5},
+		"Repr-Digest": {"sha-256=:" + testSHA256 + ":"},
+	}).algorithm)
+
+	for _, header := range []http.Header{
+		{},
+		{"Repr-Digest": {"sha-256=" + testSHA256}},
+		{"Repr-Digest": {"sha-256=:" + testMD5 + ":"}},
+		{"Digest": {"crc32c=AAAAAA=="}},
+		{"Content-Md5": {"not base64"}},
+	} {
+		assert.Nil(t, parseDigest(header), "%v", header)
+	}
+}
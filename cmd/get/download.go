@@ -0,0 +1,694 @@
+package get
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/signer"
+)
+
+// errFileChanged is returned when the file that a link points to changes
+// while it's being downloaded, so the parts already fetched can't be used.
+var errFileChanged = errors.New("file changed on the server during the download, run again to start over")
+
+// retryableError is an error that fetching again may get past, like a
+// dropped connection or a server that's briefly unavailable.
+type retryableError struct {
+	err error
+
+	// after is how long the server asked us to wait before retrying, if it
+	// did.
+	after time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// fileInfo is what the server says about a link's file in response to a HEAD
+// request.
+type fileInfo struct {
+	// size is -1 if the server didn't say.
+	size int64
+
+	etag string
+
+	// ranges is whether the server accepts range requests, which are needed
+	// to fetch the file in parallel segments and to resume it.
+	ranges bool
+
+	// filename is suggested by the response's Content-Disposition. It's
+	// empty if there wasn't one, or if it wasn't safe to use.
+	filename string
+
+	// digest is nil if the server didn't send one.
+	digest *digest
+}
+
+// downloader fetches the file of a signed link.
+type downloader struct {
+	client *http.Client
+	url    string
+
+	// parallel is the number of segments that a file is split into and
+	// fetched at once.
+	parallel int
+
+	// minSegmentSize keeps small files from being split into segments that
+	// are too small to be worth their own requests.
+	minSegmentSize int64
+
+	// retries is how many times in a row a request may fail before the
+	// download is abandoned. Any progress resets the count.
+	retries int
+
+	// Retries back off exponentially from minBackoff to maxBackoff.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	logf func(format string, v ...interface{})
+}
+
+// head finds out about the link's file.
+func (d *downloader) head(ctx context.Context) (*fileInfo, error) {
+	var resp *http.Response
+	err := d.retry(ctx, "HEAD", func() (bool, error) {
+		var err error
+		resp, err = d.do(ctx, "HEAD", nil)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+
+		if retryableStatus(resp.StatusCode) {
+			return false, statusError(resp)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("link needs a password, which can only be entered in a browser")
+	default:
+		// Let the check fetch the server's explanation.
+		err := signer.Check(ctx, d.client, d.url)
+		if err == nil {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+		return nil, err
+	}
+
+	info := &fileInfo{
+		size:   resp.ContentLength,
+		etag:   resp.Header.Get("ETag"),
+		ranges: resp.Header.Get("Accept-Ranges") == "bytes",
+		digest: parseDigest(resp.Header),
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err == nil && common.ValidateFilename(params["filename"]) == nil {
+		info.filename = params["filename"]
+	}
+
+	return info, nil
+}
+
+// defaultFilename is the name that a link's file is saved under if none is
+// given: the one suggested by the server, or otherwise the last segment of
+// the link's path.
+func (d *downloader) defaultFilename(info *fileInfo) (string, error) {
+	if info.filename != "" {
+		return info.filename, nil
+	}
+
+	u, err := url.Parse(d.url)
+	if err != nil {
+		return "", err
+	}
+
+	filename := path.Base(u.Path)
+	if strings.HasPrefix(u.Path, "/"+common.TokenRemote+"/") || common.ValidateFilename(filename) != nil {
+		return "", fmt.Errorf("couldn't work out what to name the file, use --output")
+	}
+	return filename, nil
+}
+
+// download fetches the link's file into output. The file is written to a
+// partial file next to it first, along with a record of which parts of it
+// have been fetched, so that an interrupted download can be resumed by
+// downloading to the same place again. Once it's complete, it's verified
+// against the server's digest if there is one, and then moved into place.
+// The digest's algorithm is returned, or "" if there was none.
+func (d *downloader) download(ctx context.Context, info *fileInfo, output string) (string, error) {
+	partPath := output + ".part"
+	statePath := output + ".part.state"
+
+	f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var trailerDigest *digest
+	if info.ranges && info.size > 0 {
+		err = d.fetchSegments(ctx, info, f, statePath)
+	} else {
+		trailerDigest, err = d.fetchWhole(ctx, f)
+	}
+	if err == errFileChanged {
+		os.Remove(partPath)
+		os.Remove(statePath)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	dg := info.digest
+	if dg == nil {
+		dg = trailerDigest
+	}
+
+	var algorithm string
+	if dg != nil {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", err
+		}
+
+		err = dg.Verify(f)
+		if err != nil {
+			// It's no use resuming a download that came out wrong.
+			os.Remove(partPath)
+			os.Remove(statePath)
+			return "", err
+		}
+		algorithm = dg.algorithm
+	}
+
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(partPath, output)
+	if err != nil {
+		return "", err
+	}
+
+	os.Remove(statePath)
+	return algorithm, nil
+}
+
+// fetchSegments fetches a file in segments at once, picking up where an
+// earlier attempt left off if it was for the same version of the file.
+func (d *downloader) fetchSegments(ctx context.Context, info *fileInfo, f *os.File, statePath string) error {
+	st, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if st == nil || !st.matches(info) || stat.Size() != info.size {
+		st = newDownloadState(info, d.segmentCount(info.size))
+
+		err = f.Truncate(info.size)
+		if err != nil {
+			return err
+		}
+	} else {
+		d.logf("Resuming with %d of %d bytes left", st.remaining(), info.size)
+	}
+
+	err = st.save(statePath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Save progress every so often so that not much has to be fetched
+	// again if we're killed.
+	stopSaving := make(chan struct{})
+	savingDone := make(chan struct{})
+	go func() {
+		defer close(savingDone)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := st.save(statePath)
+				if err != nil {
+					d.logf("Error saving progress: %v", err)
+				}
+			case <-stopSaving:
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, len(st.Segments))
+	var wg sync.WaitGroup
+	for i, seg := range st.Segments {
+		if seg.Start >= seg.End {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, seg *segment) {
+			defer wg.Done()
+
+			err := d.retry(ctx, fmt.Sprintf("Segment %d", i+1), func() (bool, error) {
+				return d.fetchSegment(ctx, st, seg, f)
+			})
+			if err != nil {
+				// Stop the other segments too.
+				cancel()
+				errs <- err
+			}
+		}(i, seg)
+	}
+	wg.Wait()
+
+	close(stopSaving)
+	<-savingDone
+
+	close(errs)
+	err = nil
+	for segErr := range errs {
+		// The segments that were stopped because another one failed
+		// aren't interesting.
+		if err == nil || err == context.Canceled {
+			err = segErr
+		}
+	}
+
+	if err != nil {
+		if err != errFileChanged {
+			saveErr := st.save(statePath)
+			if saveErr != nil {
+				d.logf("Error saving progress: %v", saveErr)
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// fetchSegment fetches what's left of a segment of the file. It returns
+// whether any of the segment was fetched, even if it then failed.
+func (d *downloader) fetchSegment(ctx context.Context, st *downloadState, seg *segment, f *os.File) (bool, error) {
+	start, end := st.bounds(seg)
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if st.ETag != "" {
+		// Makes the server send the whole file instead of the range if
+		// it's changed, which we'll notice.
+		header.Set("If-Range", st.ETag)
+	}
+
+	resp, err := d.do(ctx, "GET", header)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if resp.Header.Get("ETag") != st.ETag {
+			return false, errFileChanged
+		}
+		return false, fmt.Errorf("server ignored a range request")
+	case http.StatusRequestedRangeNotSatisfiable:
+		return false, errFileChanged
+	default:
+		return false, statusError(resp)
+	}
+
+	rangeStart, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return false, err
+	}
+	if size != st.Size {
+		return false, errFileChanged
+	}
+	if rangeStart != start {
+		return false, fmt.Errorf("server sent a range starting at %d instead of %d", rangeStart, start)
+	}
+
+	progressed := false
+	buf := make([]byte, 32*1024)
+	for start < end {
+		n, readErr := resp.Body.Read(buf)
+		if int64(n) > end-start {
+			n = int(end - start)
+		}
+
+		if n > 0 {
+			_, err := f.WriteAt(buf[:n], start)
+			if err != nil {
+				return progressed, err
+			}
+
+			start += int64(n)
+			st.advance(seg, start)
+			progressed = true
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			if ctx.Err() != nil {
+				return progressed, ctx.Err()
+			}
+			return progressed, &retryableError{err: readErr}
+		}
+	}
+
+	if start < end {
+		return progressed, &retryableError{err: io.ErrUnexpectedEOF}
+	}
+	return progressed, nil
+}
+
+// fetchWhole fetches a file in a single request, for servers that don't
+// accept range requests or files of unknown size. It can't be resumed, so
+// every retry starts over. If the response has a digest in its trailers, it's
+// returned.
+func (d *downloader) fetchWhole(ctx context.Context, f *os.File) (*digest, error) {
+	var trailerDigest *digest
+
+	err := d.retry(ctx, "Download", func() (bool, error) {
+		resp, err := d.do(ctx, "GET", nil)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return false, statusError(resp)
+		}
+
+		err = f.Truncate(0)
+		if err != nil {
+			return false, err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return false, err
+		}
+
+		n, err := io.Copy(f, resp.Body)
+		if err != nil {
+			if ctx.Err() != nil {
+				return n > 0, ctx.Err()
+			}
+			return n > 0, &retryableError{err: err}
+		}
+
+		if resp.ContentLength >= 0 && n != resp.ContentLength {
+			return true, &retryableError{err: io.ErrUnexpectedEOF}
+		}
+
+		// Trailers are only available once the body has been read.
+		trailerDigest = parseDigest(http.Header{
+			"Digest":      resp.Trailer["Digest"],
+			"Repr-Digest": resp.Trailer["Repr-Digest"],
+		})
+		return true, nil
+	})
+
+	return trailerDigest, err
+}
+
+// retry calls fetch until it succeeds, fails with an error that isn't a
+// retryableError, or fails more times in a row than allowed. fetch returns
+// whether it made progress, which resets the count of failures.
+func (d *downloader) retry(ctx context.Context, what string, fetch func() (bool, error)) error {
+	failures := 0
+	for {
+		progressed, err := fetch()
+		if err == nil {
+			return nil
+		}
+
+		retryable, ok := err.(*retryableError)
+		if !ok {
+			return err
+		}
+
+		if progressed {
+			failures = 0
+		}
+		failures++
+		if failures > d.retries {
+			return retryable.err
+		}
+
+		delay := d.backoff(failures)
+		if retryable.after > delay {
+			delay = retryable.after
+		}
+		d.logf("%s: %v (retrying in %v)", what, retryable.err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// backoff is how long to wait after a number of failures in a row. It
+// doubles with each one, and is jittered so that segments that failed
+// together don't all retry together.
+func (d *downloader) backoff(failures int) time.Duration {
+	delay := d.maxBackoff
+	if failures < 32 {
+		if exp := d.minBackoff << uint(failures-1); exp > 0 && exp < delay {
+			delay = exp
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// segmentCount is how many segments a file of the given size is fetched in.
+func (d *downloader) segmentCount(size int64) int {
+	n := int64(d.parallel)
+	if d.minSegmentSize > 0 && size/d.minSegmentSize < n {
+		n = size / d.minSegmentSize
+	}
+	if n < 1 {
+		n = 1
+	}
+	return int(n)
+}
+
+// do makes a request for the link. Errors that mean the request never got
+// a response are retryable.
+func (d *downloader) do(ctx context.Context, method string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &retryableError{err: err}
+	}
+	return resp, nil
+}
+
+// retryableStatus returns whether a response with the given status might
+// succeed if the request is made again.
+func retryableStatus(status int) bool {
+	return status == http.StatusRequestTimeout ||
+		status == http.StatusTooManyRequests ||
+		status >= 500
+}
+
+// statusError makes an error out of an unsuccessful response, including the
+// server's explanation if it gave one. It's retryable if the status is.
+func statusError(resp *http.Response) error {
+	message, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
+
+	text := strings.TrimSpace(string(message))
+	if text == "" {
+		text = resp.Status
+	}
+	err := errors.New(text)
+
+	if !retryableStatus(resp.StatusCode) {
+		return err
+	}
+
+	retryable := &retryableError{err: err}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryable.after = time.Duration(seconds) * time.Second
+	}
+	return retryable
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes <start>-<end>/<size>", returning its start and size.
+func parseContentRange(s string) (int64, int64, error) {
+	invalid := fmt.Errorf("invalid Content-Range: %q", s)
+
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, invalid
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, invalid
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, invalid
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	return start, size, nil
+}
+
+// downloadState records the progress of a download so that it can be
+// resumed. It's kept in a file next to the partial download.
+type downloadState struct {
+	ETag     string     `json:"etag"`
+	Size     int64      `json:"size"`
+	Segments []*segment `json:"segments"`
+
+	mu sync.Mutex
+}
+
+// segment is a part of the file that's fetched by its own requests. Start
+// is advanced as it's fetched, so the segment is done once it reaches End
+// (which is exclusive).
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// newDownloadState splits a file into segments of about the same size.
+func newDownloadState(info *fileInfo, n int) *downloadState {
+	st := &downloadState{ETag: info.etag, Size: info.size}
+
+	segmentSize := info.size / int64(n)
+	for i := 0; i < n; i++ {
+		seg := &segment{Start: int64(i) * segmentSize, End: int64(i+1) * segmentSize}
+		if i == n-1 {
+			seg.End = info.size
+		}
+		st.Segments = append(st.Segments, seg)
+	}
+	return st
+}
+
+// loadState loads the progress of an earlier download. It returns nil if
+// there's none.
+func loadState(path string) (*downloadState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var st downloadState
+	err = json.Unmarshal(data, &st)
+	if err != nil {
+		// Start over rather than making someone clean up after us.
+		return nil, nil
+	}
+	return &st, nil
+}
+
+// matches returns whether an earlier download was of the same version of the
+// file. Without an ETag, there's no telling.
+func (st *downloadState) matches(info *fileInfo) bool {
+	return st.ETag != "" && st.ETag == info.etag && st.Size == info.size
+}
+
+func (st *downloadState) advance(seg *segment, start int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	seg.Start = start
+}
+
+func (st *downloadState) bounds(seg *segment) (int64, int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return seg.Start, seg.End
+}
+
+func (st *downloadState) remaining() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var n int64
+	for _, seg := range st.Segments {
+		n += seg.End - seg.Start
+	}
+	return n
+}
+
+// save writes the state to a file. A temporary file is written first so that
+// a crash never leaves a half-written one.
+func (st *downloadState) save(path string) error {
+	st.mu.Lock()
+	data, err := json.Marshal(st)
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
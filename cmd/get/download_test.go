@@ -0,0 +1,386 @@
+package get
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testFile serves a file like the server does, and can be made to fail.
+type testFile struct {
+	content []byte
+	etag    string
+
+	// digest is sent as Repr-Digest unless it's empty.
+	digest string
+
+	mu     sync.Mutex
+	ranges []string
+
+	// failures is the number of GETs left that are cut off after
+	// failAfter bytes.
+	failures  int
+	failAfter int
+}
+
+func newTestFile(content []byte) *testFile {
+	sum := sha256.Sum256(content)
+	return &testFile{
+		content: content,
+		etag:    `"v1"`,
+		digest:  "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":",
+	}
+}
+
+func (f *testFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	fail := false
+	if r.Method == "GET" {
+		f.ranges = append(f.ranges, r.Header.Get("Range"))
+		if f.failures > 0 {
+			f.failures--
+			fail = true
+		}
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("ETag", f.etag)
+	if f.digest != "" {
+		w.Header().Set("Repr-Digest", f.digest)
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="raft.pdf"`)
+
+	if fail {
+		w = &cutOffWriter{ResponseWriter: w, left: f.failAfter}
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(f.content))
+}
+
+func (f *testFile) requestedRanges() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.ranges...)
+}
+
+// cutOffWriter stops writing a response after some number of bytes, which
+// leaves the client with a truncated body.
+type cutOffWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *cutOffWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		n, _ := w.ResponseWriter.Write(p[:w.left])
+		w.left = 0
+		return n, errors.New("cut off")
+	}
+	w.left -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func newTestDownloader(url string) *downloader {
+	return &downloader{
+		client:         &http.Client{},
+		url:            url,
+		parallel:       4,
+		minSegmentSize: 100,
+		retries:        3,
+		minBackoff:     time.Millisecond,
+		maxBackoff:     10 * time.Millisecond,
+		logf:           func(string, ...interface{}) {},
+	}
+}
+
+func testContent(n int) []byte {
+	content := make([]byte, n)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	return content
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rhttpserve-get")
+	assert.NoError(t, err)
+	return dir
+}
+
+// runDownload downloads from a server to a file in dir.
+func runDownload(t *testing.T, d *downloader, dir string) (string, error) {
+	info, err := d.head(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	filename, err := d.defaultFilename(info)
+	assert.NoError(t, err)
+	assert.Equal(t, "raft.pdf", filename)
+
+	return d.download(context.Background(), info, filepath.Join(dir, filename))
+}
+
+func assertDownloaded(t *testing.T, dir string, content []byte) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "raft.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	_, err = os.Stat(filepath.Join(dir, "raft.pdf.part"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "raft.pdf.part.state"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := newTestFile(testContent(1000))
+	server := httptest.NewServer(file)
+	defer server.Close()
+
+	algorithm, err := runDownload(t, newTestDownloader(server.URL+"/remote/raft.pdf"), dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha-256", algorithm)
+	assertDownloaded(t, dir, file.content)
+
+	ranges := file.requestedRanges()
+	assert.Len(t, ranges, 4)
+	assert.Contains(t, ranges, "bytes=0-249")
+	assert.Contains(t, ranges, "bytes=750-999")
+}
+
+func TestDownloadRetries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := newTestFile(testContent(1000))
+	file.failures = 6
+	file.failAfter = 10
+	server := httptest.NewServer(file)
+	defer server.Close()
+
+	_, err := runDownload(t, newTestDownloader(server.URL+"/remote/raft.pdf"), dir)
+	assert.NoError(t, err)
+	assertDownloaded(t, dir, file.content)
+}
+
+func TestDownloadResume(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := newTestFile(testContent(1000))
+	file.failures = 1000
+	file.failAfter = 50
+	server := httptest.NewServer(file)
+	defer server.Close()
+
+	d := newTestDownloader(server.URL + "/remote/raft.pdf")
+	d.parallel = 1
+	d.retries = 0
+
+	_, err := runDownload(t, d, dir)
+	assert.Error(t, err)
+
+	st, err := loadState(filepath.Join(dir, "raft.pdf.part.state"))
+	assert.NoError(t, err)
+	assert.Equal(t, []*segment{{Start: 50, End: 1000}}, st.Segments)
+
+	file.failures = 0
+	_, err = runDownload(t, d, dir)
+	assert.NoError(t, err)
+	assertDownloaded(t, dir, file.content)
+
+	ranges := file.requestedRanges()
+	assert.Equal(t, "bytes=50-999", ranges[len(ranges)-1])
+}
+
+func TestDownloadChanged(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := newTestFile(testContent(1000))
+	server := httptest.NewServer(file)
+	defer server.Close()
+
+	d := newTestDownloader(server.URL + "/remote/raft.pdf")
+	info, err := d.head(context.Background())
+	assert.NoError(t, err)
+
+	// The file changes between the HEAD and the GETs.
+	file.etag = `"v2"`
+	_, err = d.download(context.Background(), info, filepath.Join(dir, "raft.pdf"))
+	assert.Equal(t, errFileChanged, err)
+
+	_, err = os.Stat(filepath.Join(dir, "raft.pdf.part"))
+	assert.True(t, os.IsNotExist(err))
+
+	// A download left over from before the change is started over.
+	err = newDownloadState(&fileInfo{etag: `"v1"`, size: 1000}, 1).save(filepath.Join(dir, "raft.pdf.part.state"))
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "raft.pdf.part"), make([]byte, 1000), 0644)
+	assert.NoError(t, err)
+
+	_, err = runDownload(t, d, dir)
+	assert.NoError(t, err)
+	assertDownloaded(t, dir, file.content)
+}
+
+func TestDownloadBadDigest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := newTestFile(testContent(1000))
+	file.digest = newTestFile([]byte("other")).digest
+	server := httptest.NewServer(file)
+	defer server.Close()
+
+	_, err := runDownload(t, newTestDownloader(server.URL+"/remote/raft.pdf"), dir)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "sha-256 digest doesn't match")
+
+	_, err = os.Stat(filepath.Join(dir, "raft.pdf"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "raft.pdf.part"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadWhole(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	content := testContent(1000)
+	sum := sha256.Sum256(content)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No ranges, no length, and a digest that only comes at the end.
+		w.Header().Set("Trailer", "Repr-Digest")
+		if r.Method == "HEAD" {
+			return
+		}
+
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write(content)
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	}))
+	defer server.Close()
+
+	d := newTestDownloader(server.URL + "/remote/raft.pdf")
+	info, err := d.head(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, info.ranges)
+
+	algorithm, err := d.download(context.Background(), info, filepath.Join(dir, "raft.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, "sha-256", algorithm)
+	assertDownloaded(t, dir, content)
+}
+
+func TestHead(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky":
+			attempts++
+			if attempts < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Header().Set("Content-Disposition", `attachment; filename="../passwd"`)
+		case "/password":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/revoked":
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte("Link has been revoked"))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	info, err := newTestDownloader(server.URL + "/flaky").head(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "", info.filename)
+	assert.Equal(t, 3, attempts)
+
+	_, err = newTestDownloader(server.URL + "/password").head(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "password")
+
+	_, err = newTestDownloader(server.URL + "/revoked").head(context.Background())
+	assert.EqualError(t, err, "Link has been revoked")
+
+	_, err = newTestDownloader(server.URL + "/down").head(context.Background())
+	assert.EqualError(t, err, "503 Service Unavailable")
+}
+
+func TestDefaultFilename(t *testing.T) {
+	d := newTestDownloader("https://serve.example.com/remote/papers/raft.pdf?expires_at=1")
+	filename, err := d.defaultFilename(&fileInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, "raft.pdf", filename)
+
+	filename, err = d.defaultFilename(&fileInfo{filename: "Raft.pdf"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Raft.pdf", filename)
+
+	d = newTestDownloader("https://serve.example.com/.t/AQID")
+	_, err = d.defaultFilename(&fileInfo{})
+	assert.Error(t, err)
+}
+
+func TestBackoff(t *testing.T) {
+	d := newTestDownloader("")
+	d.minBackoff = time.Second
+	d.maxBackoff = 30 * time.Second
+
+	for failures, max := range map[int]time.Duration{
+		1:   time.Second,
+		3:   4 * time.Second,
+		10:  30 * time.Second,
+		100: 30 * time.Second,
+	} {
+		delay := d.backoff(failures)
+		assert.True(t, delay >= max/2 && delay <= max, "%v failures: %v", failures, delay)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, size, err := parseContentRange("bytes 50-99/1000")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), start)
+	assert.Equal(t, int64(1000), size)
+
+	for _, s := range []string{"", "bytes */1000", "bytes 50-99/*", "items 50-99/1000"} {
+		_, _, err := parseContentRange(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestDownloadStateSegments(t *testing.T) {
+	st := newDownloadState(&fileInfo{size: 10}, 3)
+	assert.Equal(t, []*segment{{0, 3}, {3, 6}, {6, 10}}, st.Segments)
+	assert.Equal(t, int64(10), st.remaining())
+
+	d := newTestDownloader("")
+	assert.Equal(t, 1, d.segmentCount(50))
+	assert.Equal(t, 2, d.segmentCount(250))
+	assert.Equal(t, 4, d.segmentCount(1<<30))
+}
@@ -0,0 +1,109 @@
+package get
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/brandur/rhttpserve/cmd"
+	"github.com/brandur/rhttpserve/common"
+	"github.com/spf13/cobra"
+)
+
+var (
+	output   string
+	parallel int
+	retries  int
+)
+
+var getCmd = &cobra.Command{
+	Use:   "get",
+	Short: `Downloads the file of a shared link.`,
+	Long: `
+Downloads the file of a signed link. Large files are fetched in several
+segments at once, requests that fail are retried with backoff, and the result
+is checked against the digest that the server sends with it (if it does).
+
+Example usage:
+
+	rhttpserve get 'https://serve.example.com/myremote/papers/raft.pdf?...'
+
+The file is saved under the name suggested by the server, or with --output:
+
+	rhttpserve get --output raft.pdf 'https://serve.example.com/...'
+
+Until it's complete, the download is kept in a .part file next to where it'll
+be saved, along with a .part.state file recording which parts have been
+fetched. Running the same command again resumes an interrupted download, as
+long as the file hasn't changed on the server since.
+
+Links that need a password can't be downloaded.
+`,
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(1, 1, command, args)
+
+		u, err := url.Parse(args[0])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			common.ExitWithError(fmt.Errorf("%q isn't a link", args[0]))
+		}
+
+		if parallel < 1 {
+			common.ExitWithError(fmt.Errorf("--parallel must be at least 1"))
+		}
+
+		d := &downloader{
+			client:         &http.Client{},
+			url:            args[0],
+			parallel:       parallel,
+			minSegmentSize: 1 << 20,
+			retries:        retries,
+			minBackoff:     500 * time.Millisecond,
+			maxBackoff:     30 * time.Second,
+			logf:           log.Printf,
+		}
+
+		ctx := context.Background()
+		info, err := d.head(ctx)
+		if err != nil {
+			common.ExitWithError(err)
+		}
+
+		path := output
+		if path == "" {
+			path, err = d.defaultFilename(info)
+			if err != nil {
+				common.ExitWithError(err)
+			}
+		}
+
+		if cmd.Verbose {
+			log.Printf("Size: %v bytes, ETag: %v, ranges: %v", info.size, info.etag, info.ranges)
+		}
+
+		algorithm, err := d.download(ctx, info, path)
+		if err != nil {
+			common.ExitWithError(err)
+		}
+
+		if algorithm == "" {
+			log.Printf("The server didn't send a digest, so the download couldn't be verified")
+		} else if cmd.Verbose {
+			log.Printf("Verified %s digest", algorithm)
+		}
+
+		fmt.Printf("%s\n", path)
+	},
+}
+
+func init() {
+	cmd.Root.AddCommand(getCmd)
+	getCmd.Flags().StringVarP(&output, "output", "o", "",
+		"Path to save the file to")
+	getCmd.Flags().IntVar(&parallel, "parallel", 4,
+		"Number of segments to fetch at once")
+	getCmd.Flags().IntVar(&retries, "retries", 5,
+		"Number of times in a row that a failed request is retried")
+}
@@ -0,0 +1,145 @@
+package inspect
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/brandur/rhttpserve/cmd"
+	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/signer"
+	"github.com/spf13/cobra"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: `Shows what a shared link is for.`,
+	Long: `
+Takes apart a link and shows what it points to, how long it's valid for, and
+any constraints on its use. Its signature isn't checked (see the verify
+command for that), so no keys are needed.
+
+Example usage:
+
+	rhttpserve inspect 'https://serve.example.com/myremote/papers/raft.pdf?...'
+
+Opaque links can only be inspected if RHTTPSERVE_TOKEN_KEY is set.
+`,
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(1, 1, command, args)
+
+		var tokenKey *[32]byte
+		var err error
+		if encoded := os.Getenv("RHTTPSERVE_TOKEN_KEY"); encoded != "" {
+			tokenKey, err = common.ParseTokenKey(encoded)
+			if err != nil {
+				common.ExitWithError(fmt.Errorf("RHTTPSERVE_TOKEN_KEY: %v", err))
+			}
+		}
+
+		link, err := signer.Parse(args[0], tokenKey)
+		if err != nil {
+			common.ExitWithError(err)
+		}
+
+		for _, field := range describe(link, time.Now()) {
+			fmt.Printf("%-18s %s\n", field[0]+":", field[1])
+		}
+	},
+}
+
+func init() {
+	cmd.Root.AddCommand(inspectCmd)
+}
+
+// describe lists the fields of a link as pairs of names and values, leaving
+// out any that the link doesn't have.
+func describe(l *signer.Link, now time.Time) [][2]string {
+	var fields [][2]string
+	add := func(name, value string) {
+		fields = append(fields, [2]string{name, value})
+	}
+
+	if len(l.Bundle) > 0 {
+		for i, remoteAndPath := range l.Bundle {
+			name := ""
+			if i == 0 {
+				name = "Bundle"
+			}
+			add(name, remoteAndPath)
+		}
+	} else {
+		add("Remote", l.Remote)
+		add("Path", l.Path)
+		if l.Prefix != "" {
+			add("Prefix", l.Prefix)
+		}
+	}
+
+	if l.Opaque {
+		add("Opaque", "yes")
+	}
+
+	switch l.Version {
+	case "":
+		add("Version", "1")
+	default:
+		add("Version", l.Version)
+	}
+
+	if l.KeyID != "" {
+		add("Key ID", l.KeyID)
+	}
+
+	if !l.IssuedAt.IsZero() {
+		add("Issued at", describeTime(l.IssuedAt, now))
+	}
+	if !l.NotBefore.IsZero() {
+		add("Not before", describeTime(l.NotBefore, now))
+	}
+	add("Expires at", describeTime(l.ExpiresAt, now))
+
+	if maxDownloads := l.Params.Get("max_downloads"); maxDownloads != "" {
+		add("Max downloads", maxDownloads)
+	}
+	if ip := l.Params.Get("ip"); ip != "" {
+		add("Addresses", ip)
+	}
+	if l.Params.Get("password_hash") != "" {
+		add("Password", "required")
+	}
+	if filename := l.Params.Get("filename"); filename != "" {
+		add("Filename", filename)
+	}
+	if disposition := l.Params.Get("disposition"); disposition != "" {
+		add("Disposition", disposition)
+	}
+
+	var responseParams []string
+	for param := range common.ResponseHeaderParams {
+		if _, ok := l.Params[param]; ok {
+			responseParams = append(responseParams, param)
+		}
+	}
+	sort.Strings(responseParams)
+	for _, param := range responseParams {
+		add(common.ResponseHeaderParams[param], l.Params.Get(param))
+	}
+
+	// The revocation list's entry for the link is keyed by this.
+	add("Digest", l.Digest())
+
+	return fields
+}
+
+// describeTime formats a time along with how far it is from now.
+func describeTime(t, now time.Time) string {
+	s := t.UTC().Format(time.RFC3339)
+
+	d := t.Sub(now) / time.Second * time.Second
+	if d < 0 {
+		return s + " (" + (-d).String() + " ago)"
+	}
+	return s + " (in " + d.String() + ")"
+}
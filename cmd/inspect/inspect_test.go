@@ -0,0 +1,64 @@
+package inspect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/internal/signertest"
+	"github.com/brandur/rhttpserve/signer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribe(t *testing.T) {
+	s := signertest.NewSigner("2017-01")
+	s.TokenKey = new([32]byte)
+	expiresAt := time.Unix(1484239044, 0)
+
+	rawURL, err := s.Sign(signer.LinkSpec{
+		Remote:          "remote",
+		Path:            "papers/raft.pdf",
+		ExpiresAt:       expiresAt,
+		NotBefore:       expiresAt.Add(-2 * time.Hour),
+		IssuedAt:        expiresAt.Add(-3 * time.Hour),
+		Filename:        "Raft.pdf",
+		IP:              "192.0.2.0/24",
+		MaxDownloads:    2,
+		Opaque:          true,
+		ResponseHeaders: map[string]string{"response-content-type": "application/pdf"},
+	})
+	assert.NoError(t, err)
+
+	link, err := signer.Parse(rawURL, s.TokenKey)
+	assert.NoError(t, err)
+
+	assert.Equal(t, [][2]string{
+		{"Remote", "remote"},
+		{"Path", "papers/raft.pdf"},
+		{"Opaque", "yes"},
+		{"Version", common.MessageVersion},
+		{"Key ID", "2017-01"},
+		{"Issued at", "2017-01-12T13:37:24Z (2h0m0s ago)"},
+		{"Not before", "2017-01-12T14:37:24Z (1h0m0s ago)"},
+		{"Expires at", "2017-01-12T16:37:24Z (in 1h0m0s)"},
+		{"Max downloads", "2"},
+		{"Addresses", "192.0.2.0/24"},
+		{"Filename", "Raft.pdf"},
+		{"Content-Type", "application/pdf"},
+		{"Digest", link.Digest()},
+	}, describe(link, expiresAt.Add(-time.Hour)))
+
+	rawURL, err = s.Sign(signer.LinkSpec{
+		Bundle:    []string{"remote:a.txt", "other:b.txt"},
+		ExpiresAt: expiresAt,
+	})
+	assert.NoError(t, err)
+
+	link, err = signer.Parse(rawURL, nil)
+	assert.NoError(t, err)
+
+	fields := describe(link, expiresAt.Add(time.Minute))
+	assert.Equal(t, [2]string{"Bundle", "remote:a.txt"}, fields[0])
+	assert.Equal(t, [2]string{"", "other:b.txt"}, fields[1])
+	assert.Equal(t, [2]string{"Expires at", "2017-01-12T16:37:24Z (1m0s ago)"}, fields[5])
+}
@@ -0,0 +1,131 @@
+package revoke
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/brandur/rhttpserve/cmd"
+	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/signer"
+	"github.com/spf13/cobra"
+)
+
+var file string
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: `Revokes shared links.`,
+	Long: `
+Produces revocation entries for links that were shared by mistake. A server
+configured with a revocation list (RHTTPSERVE_REVOCATIONS_FILE or
+RHTTPSERVE_REVOCATIONS_PATH) that contains a link's entry refuses it.
+
+Example usage:
+
+	rhttpserve revoke 'https://serve.example.com/myremote/papers/raft.pdf?...' >> revocations.txt
+
+Entries only identify links by a digest of what their signatures are over, so
+they're safe to publish. With --file, entries are added to the given revocation
+list, and entries for links that have since expired are removed from it:
+
+	rhttpserve revoke --file revocations.txt 'https://serve.example.com/...'
+
+Opaque links can only be revoked if RHTTPSERVE_TOKEN_KEY is set.
+`,
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(1, 99999, command, args)
+
+		var tokenKey *[32]byte
+		var err error
+		if encoded := os.Getenv("RHTTPSERVE_TOKEN_KEY"); encoded != "" {
+			tokenKey, err = common.ParseTokenKey(encoded)
+			if err != nil {
+				common.ExitWithError(fmt.Errorf("RHTTPSERVE_TOKEN_KEY: %v", err))
+			}
+		}
+
+		var revocations []common.Revocation
+		for _, arg := range args {
+			revocation, err := RevocationForURL(arg, tokenKey)
+			if err != nil {
+				common.ExitWithError(err)
+			}
+			revocations = append(revocations, revocation)
+		}
+
+		if file == "" {
+			for _, revocation := range revocations {
+				fmt.Printf("%s\n", revocation)
+			}
+			return
+		}
+
+		err = updateFile(file, revocations, time.Now())
+		if err != nil {
+			common.ExitWithError(err)
+		}
+	},
+}
+
+func init() {
+	cmd.Root.AddCommand(revokeCmd)
+	revokeCmd.Flags().StringVar(&file, "file", "",
+		"Add to the given revocation list instead of printing entries")
+}
+
+// RevocationForURL builds the revocation entry for a signed link. tokenKey is
+// needed to revoke opaque links, whose messages are sealed in their tokens,
+// and may be nil otherwise.
+func RevocationForURL(rawURL string, tokenKey *[32]byte) (common.Revocation, error) {
+	link, err := signer.Parse(rawURL, tokenKey)
+	if err != nil {
+		return common.Revocation{}, fmt.Errorf("%v: %v", err, rawURL)
+	}
+
+	return common.Revocation{
+		Digest:    link.Digest(),
+		ExpiresAt: link.ExpiresAt.Unix(),
+	}, nil
+}
+
+// updateFile adds revocations to the revocation list in a file, which is
+// created if it doesn't exist. Revocations for links that have expired by the
+// given time are removed, and comments are dropped.
+func updateFile(path string, revocations []common.Revocation, now time.Time) error {
+	var existing []common.Revocation
+
+	f, err := os.Open(path)
+	if err == nil {
+		existing, err = common.ParseRevocations(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var b bytes.Buffer
+	seen := make(map[string]bool)
+	for _, revocation := range append(existing, revocations...) {
+		if revocation.ExpiresAt < now.Unix() || seen[revocation.Digest] {
+			continue
+		}
+		seen[revocation.Digest] = true
+
+		b.WriteString(revocation.String())
+		b.WriteByte('\n')
+	}
+
+	// Write to a temporary file first so that a server reading the list
+	// never sees it half-written.
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, b.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
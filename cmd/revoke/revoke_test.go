@@ -0,0 +1,78 @@
+package revoke
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/internal/signertest"
+	"github.com/brandur/rhttpserve/signer"
+	"github.com/stretchr/testify/assert"
+)
+
+const testURL = "https://serve.example.com/remote/papers/raft.pdf?expires_at=1484239044&" +
+	"signature=QH816bQ_OlGDIIOHfhFYYTlSvVqtlNyboRgQDLJLp1R6wEU4tivChyPXIOOKETH_kvWN-UEakhNgVFU00jdIAA%3D%3D&v=2"
+
+func TestRevocationForURL(t *testing.T) {
+	revocation, err := RevocationForURL(testURL, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1484239044), revocation.ExpiresAt)
+	assert.Len(t, revocation.Digest, 64)
+
+	_, err = RevocationForURL("https://serve.example.com/remote/papers/raft.pdf?expires_at=1484239044", nil)
+	assert.Error(t, err)
+
+	_, err = RevocationForURL("https://serve.example.com/remote/papers/raft.pdf?signature=QH81", nil)
+	assert.Error(t, err)
+}
+
+func TestRevocationForOpaqueURL(t *testing.T) {
+	s := signertest.NewSigner("2017-01")
+	s.TokenKey = new([32]byte)
+
+	expiresAt := time.Unix(1484239044, 0)
+	rawURL, err := s.Sign(signer.LinkSpec{
+		Remote:    "remote",
+		Path:      "papers/raft.pdf",
+		ExpiresAt: expiresAt,
+		Opaque:    true,
+	})
+	assert.NoError(t, err)
+
+	// Opaque links can't be read without the token key.
+	_, err = RevocationForURL(rawURL, nil)
+	assert.Error(t, err)
+
+	revocation, err := RevocationForURL(rawURL, s.TokenKey)
+	assert.NoError(t, err)
+	assert.Equal(t, expiresAt.Unix(), revocation.ExpiresAt)
+
+	// The entry is for the link sealed in the token, which is what the
+	// server checks revocations against.
+	link, err := signer.Parse(rawURL, s.TokenKey)
+	assert.NoError(t, err)
+	assert.Equal(t, link.Digest(), revocation.Digest)
+}
+
+func TestUpdateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhttpserve")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "revocations.txt")
+	now := time.Unix(1484239044, 0)
+
+	expired := common.Revocation{Digest: common.LinkDigest([]byte("a")), ExpiresAt: now.Unix() - 1}
+	current := common.Revocation{Digest: common.LinkDigest([]byte("b")), ExpiresAt: now.Unix() + 1}
+	added := common.Revocation{Digest: common.LinkDigest([]byte("c")), ExpiresAt: now.Unix() + 1}
+
+	assert.NoError(t, updateFile(path, []common.Revocation{expired, current}, now.Add(-time.Hour)))
+	assert.NoError(t, updateFile(path, []common.Revocation{added, current}, now))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, current.String()+"\n"+added.String()+"\n", string(data))
+}
@@ -2,19 +2,18 @@ package serve
 
 import (
 	"encoding/base64"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/brandur/rhttpserve/cmd"
 	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/server"
 	"github.com/joeshaw/envdecode"
-	"github.com/ncw/rclone/fs"
 	"github.com/spf13/cobra"
-	"golang.org/x/crypto/ed25519"
 )
 
 var serveCmd = &cobra.Command{
@@ -37,21 +36,59 @@ Example usage:
 			common.ExitWithError(err)
 		}
 
-		publicKey, err := base64.URLEncoding.DecodeString(conf.PublicKey)
+		publicKeys, err := common.ParsePublicKeys(conf.PublicKey, conf.PublicKeys)
 		if err != nil {
 			common.ExitWithError(err)
 		}
 
-		server := FileServer{
-			PublicKey: ed25519.PublicKey(publicKey),
+		var trustedProxies []*net.IPNet
+		if len(conf.TrustedProxies) > 0 {
+			trustedProxies, err = common.ParseIPNets(strings.Join(conf.TrustedProxies, ","))
+			if err != nil {
+				common.ExitWithError(fmt.Errorf("RHTTPSERVE_TRUSTED_PROXIES: %v", err))
+			}
 		}
 
-		mux := http.NewServeMux()
-		mux.HandleFunc("/", server.ServeFile)
+		var tokenKey *[32]byte
+		if conf.TokenKey != "" {
+			tokenKey, err = common.ParseTokenKey(conf.TokenKey)
+			if err != nil {
+				common.ExitWithError(fmt.Errorf("RHTTPSERVE_TOKEN_KEY: %v", err))
+			}
+		}
+
+		cookieKey, err := base64.URLEncoding.DecodeString(conf.CookieKey)
+		if err != nil {
+			common.ExitWithError(fmt.Errorf("RHTTPSERVE_COOKIE_KEY: %v", err))
+		}
+
+		srv, err := server.New(server.Options{
+			AcceptV1:                conf.AcceptV1,
+			ClockSkew:               conf.ClockSkew,
+			CookieKey:               cookieKey,
+			DigestTrailer:           conf.DigestTrailer,
+			DownloadsFile:           conf.DownloadsFile,
+			ForwardedHeader:         conf.ForwardedHeader,
+			FsCacheIdleTimeout:      conf.FsCacheIdleTimeout,
+			MaxTTL:                  conf.MaxTTL,
+			PublicKeys:              publicKeys,
+			RedirectRemotes:         conf.RedirectRemotes,
+			RedirectTTL:             conf.RedirectTTL,
+			RevocationsFile:         conf.RevocationsFile,
+			RevocationsPath:         conf.RevocationsPath,
+			RevocationsPollInterval: conf.RevocationsPollInterval,
+			TokenKey:                tokenKey,
+			TrustedProxies:          trustedProxies,
+			UnlockTTL:               conf.UnlockTTL,
+			Verbose:                 cmd.Verbose,
+		})
+		if err != nil {
+			common.ExitWithError(err)
+		}
 
 		s := &http.Server{
 			Addr:    ":" + conf.Port,
-			Handler: mux,
+			Handler: srv,
 		}
 		log.Printf("Serving on port %s", conf.Port)
 		log.Fatal(s.ListenAndServe())
@@ -60,175 +97,79 @@ Example usage:
 
 // Config stores the configuration required by the serve command.
 type Config struct {
-	Port      string `env:"PORT,default=8090"`
-	PublicKey string `env:"RHTTPSERVE_PUBLIC_KEY,required"`
-}
-
-// FileServer is a basic encapsulation of the necessary information to serve a
-// file out of an rclone remote.
-type FileServer struct {
-	PublicKey ed25519.PublicKey
-}
+	// AcceptV1 is whether links signed in the original message format are
+	// accepted. Disable it once all the links signed before the move to the
+	// current format have expired.
+	AcceptV1 bool `env:"RHTTPSERVE_ACCEPT_V1,default=true"`
 
-// ServeFile serves a file out of an rclone remote based on the request path
-// and whether a valid signature was included.
-func (s *FileServer) ServeFile(w http.ResponseWriter, r *http.Request) {
-	// Don't serve non-GET|HEAD or anything at root (because we know it's not a
-	// file).
-	if r.Method != "GET" && r.Method != "HEAD" || r.URL.Path == "/" {
-		http.NotFound(w, r)
-		return
-	}
-
-	expiresAtStr, ok := getParam(w, r, "expires_at")
-	if !ok {
-		return
-	}
-
-	signatureEncoded, ok := getParam(w, r, "signature")
-	if !ok {
-		return
-	}
-	signatureStr, err := base64.URLEncoding.DecodeString(signatureEncoded)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Couldn't decode signature"))
-		return
-	}
-
-	expiresAtInt, err := strconv.ParseInt(expiresAtStr, 10, 64)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Couldn't parse expires_at"))
-		return
-	}
-
-	expiresAt := time.Unix(expiresAtInt, 0)
-	if expiresAt.Before(time.Now()) {
-		if cmd.Verbose {
-			log.Printf("Stale expires_at")
-		}
-
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Link is no longer valid because expires_at is in the past"))
-		return
-	}
-
-	// Note the first part will be empty because we start with a leading slash.
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid request path"))
-		return
-	}
-
-	remote := parts[1]
-	path := strings.Join(parts[2:], "/")
-
-	message := common.Message(remote, path, expiresAtInt)
-	if cmd.Verbose {
-		log.Printf("Message: %v", string(message))
-	}
-
-	ok = ed25519.Verify(s.PublicKey, message, []byte(signatureStr))
-	if !ok {
-		if cmd.Verbose {
-			log.Printf("Bad signature")
-		}
+	// ClockSkew is how far apart the clocks of the server and of the clients
+	// signing links are allowed to be.
+	ClockSkew time.Duration `env:"RHTTPSERVE_CLOCK_SKEW,default=1m"`
 
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Signature verification failed"))
-		return
-	}
+	// CookieKey is a URL-safe base64-encoded secret used to sign the cookies
+	// that unlock password-protected links. If it isn't set, a random one is
+	// generated, so cookies don't survive restarts and aren't shared between
+	// servers.
+	CookieKey string `env:"RHTTPSERVE_COOKIE_KEY"`
 
-	if !checkRemoteConfig(remote) {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Remote " + remote + " not configured in server environment"))
-		return
-	}
+	// DigestTrailer is whether files whose remote can't provide a checksum
+	// are sent with a SHA-256 digest computed while they're streamed, in a
+	// Repr-Digest trailer. Those responses don't have a Content-Length.
+	DigestTrailer bool `env:"RHTTPSERVE_DIGEST_TRAILER"`
 
-	rclonePath := remote + ":" + path
+	// DownloadsFile is where the number of times that links with a download
+	// limit have been used is kept. Links with a limit are refused unless
+	// it's set.
+	DownloadsFile string `env:"RHTTPSERVE_DOWNLOADS_FILE"`
 
-	// Rclone (or more specifically, newFsSrc, which is copied from rclone)
-	// mutates config between runs on single files in a way that doesn't
-	// allow it to be run twice in succession, so reset filters between runs.
-	fs.Config.Filter, err = fs.NewFilter()
-	if err != nil {
-		log.Printf("Failed to load filters: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(""))
-	}
+	// ForwardedHeader is the header that the trusted proxies record client
+	// addresses in, either X-Forwarded-For or Forwarded.
+	ForwardedHeader string `env:"RHTTPSERVE_FORWARDED_HEADER,default=X-Forwarded-For"`
 
-	fsrc := cmd.NewFsSrc([]string{rclonePath})
-
-	numObjects, size, err := fs.Count(fsrc)
-
-	if err == fs.ErrorDirNotFound {
-		if cmd.Verbose {
-			log.Printf("No such object")
-		}
+	FsCacheIdleTimeout time.Duration `env:"RHTTPSERVE_FS_CACHE_IDLE_TIMEOUT,default=30m"`
 
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("No such object"))
-		return
-	} else if err != nil {
-		log.Printf("Error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(""))
-		return
-	}
-
-	if numObjects > 1 {
-		if cmd.Verbose {
-			log.Printf("Can't serve directory")
-		}
+	// MaxTTL is the longest that a link may be valid for. Links signed to be
+	// valid for longer are refused. 0 means no limit.
+	MaxTTL time.Duration `env:"RHTTPSERVE_MAX_TTL"`
 
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Can only serve single files"))
-		return
-	}
-
-	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-	if cmd.Verbose {
-		log.Printf("Set size to %v (%v bytes)",
-			fs.SizeSuffix(size).Unit("Bytes"), size)
-	}
-
-	if r.Method == "HEAD" {
-		log.Printf("Serving HEAD: %s", rclonePath)
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(""))
-		return
-	}
-
-	// Try to force browsers to download the link instead of display it.
-	w.Header().Set("Content-Disposition", "attachment")
-
-	log.Printf("Serving: %s", rclonePath)
-	err = fs.Cat(fsrc, w)
-	if err != nil {
-		panic(err)
-	}
-
-	log.Printf("Successfully served: %s", rclonePath)
+	Port      string `env:"PORT,default=8090"`
+	PublicKey string `env:"RHTTPSERVE_PUBLIC_KEY"`
+
+	// PublicKeys are named public keys of the form "<key ID>:<key>". Links
+	// signed by a named key carry its ID so that the right key can be
+	// selected to verify them, which allows keys to be rotated without
+	// invalidating outstanding links all at once.
+	PublicKeys []string `env:"RHTTPSERVE_PUBLIC_KEYS"`
+
+	// RedirectRemotes are remotes whose files are served by redirecting to a
+	// presigned URL on their backend instead of proxying them. S3, Google
+	// Cloud Storage (with a service account), and B2 remotes are supported.
+	RedirectRemotes []string      `env:"RHTTPSERVE_REDIRECT_REMOTES"`
+	RedirectTTL     time.Duration `env:"RHTTPSERVE_REDIRECT_TTL,default=5m"`
+
+	// RevocationsFile and RevocationsPath are a local file and a file in a
+	// remote (of the form "remote:path") listing revoked links, as produced
+	// by the revoke command. Both are optional, and both are reloaded
+	// periodically.
+	RevocationsFile         string        `env:"RHTTPSERVE_REVOCATIONS_FILE"`
+	RevocationsPath         string        `env:"RHTTPSERVE_REVOCATIONS_PATH"`
+	RevocationsPollInterval time.Duration `env:"RHTTPSERVE_REVOCATIONS_POLL_INTERVAL,default=1m"`
+
+	// TokenKey is a URL-safe base64-encoded 32-byte key shared with clients
+	// that sign opaque links, which carry their signed link encrypted in a
+	// token. Opaque links are refused unless it's set.
+	TokenKey string `env:"RHTTPSERVE_TOKEN_KEY"`
+
+	// TrustedProxies are the addresses (or CIDR blocks) of proxies in front
+	// of the server. The header named by ForwardedHeader is only believed
+	// when it comes from one of them.
+	TrustedProxies []string `env:"RHTTPSERVE_TRUSTED_PROXIES"`
+
+	// UnlockTTL is how long a password-protected link stays unlocked for
+	// once its password has been entered.
+	UnlockTTL time.Duration `env:"RHTTPSERVE_UNLOCK_TTL,default=10m"`
 }
 
 func init() {
 	cmd.Root.AddCommand(serveCmd)
 }
-
-func checkRemoteConfig(remote string) bool {
-	envRemoteName := "RCLONE_CONFIG_" + strings.ToUpper(strings.Replace(remote+"_TYPE", "-", "_", -1))
-	_, found := os.LookupEnv(envRemoteName)
-	return found
-}
-
-func getParam(w http.ResponseWriter, r *http.Request, name string) (string, bool) {
-	param := r.URL.Query().Get(name)
-	if param == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Need parameter: " + name))
-		return "", false
-	}
-	return param, true
-}
@@ -1,26 +1,42 @@
 package sign
 
 import (
+	"bufio"
+	"context"
 	"encoding/base64"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
-	"path/filepath"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/brandur/rhttpserve/cmd"
 	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/signer"
 	"github.com/joeshaw/envdecode"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
-	curl      bool
-	skipCheck bool
+	bundle       bool
+	curl         bool
+	expiresAtStr string
+	expiresIn    time.Duration
+	notBeforeStr string
+	filename     string
+	inline       bool
+	ip           string
+	maxDownloads int
+	opaque       bool
+	password     bool
+	prefix       bool
+	skipCheck    bool
+
+	// responseHeaders holds the values of the flags that override response
+	// headers, keyed by parameter.
+	responseHeaders = make(map[string]*string)
 )
 
 var signCmd = &cobra.Command{
@@ -32,7 +48,55 @@ should be a path relative to the remote's root.
 
 Example usage:
 
-	rhttpserve sign my/file.pdf
+	rhttpserve sign myremote:my/file.pdf
+
+With --prefix, the link authorizes any object under a directory instead of a
+single file. Recipients can swap in the path of any file below it, browse it,
+or download it all at once by adding archive=zip or archive=tar.gz:
+
+	rhttpserve sign --prefix myremote:photos/trip/
+
+With --bundle, a single link is produced for all the given files (which may be
+in different directories or remotes). It downloads them as a zip archive:
+
+	rhttpserve sign --bundle myremote:papers/raft.pdf other:slides/raft.key
+
+With --inline, browsers display the file (say a PDF or a video) instead of
+downloading it, and --filename changes the name that it's saved as. Both are
+covered by the signature:
+
+	rhttpserve sign --inline --filename "Raft.pdf" myremote:papers/raft.pdf
+
+Links expire after 48 hours unless --expires-in (like 2h) or --expires-at is
+given. With --not-before, a link doesn't work until the given time. Servers may
+refuse links that are valid for too long:
+
+	rhttpserve sign --not-before 2017-02-01T09:00:00Z --expires-in 8h myremote:papers/raft.pdf
+
+With --max-downloads, the link stops working after it's been downloaded that
+many times. The server must be configured with RHTTPSERVE_DOWNLOADS_FILE:
+
+	rhttpserve sign --max-downloads 1 myremote:papers/raft.pdf
+
+Headers of the response can be overridden with flags named after S3's
+equivalent parameters, like --response-cache-control and
+--response-content-type. These are covered by the signature too.
+
+With --ip, the link only works for clients with one of the given addresses or
+in one of the given networks (a comma-separated list):
+
+	rhttpserve sign --ip 203.0.113.0/24,2001:db8::/32 myremote:papers/raft.pdf
+
+With --password, a password is asked for that recipients must enter before the
+file is served. The link only carries a salted scrypt hash of it:
+
+	rhttpserve sign --password myremote:papers/raft.pdf
+
+With --opaque, the link's remote, path, and parameters are encrypted into a
+single token so that they aren't revealed to anyone who sees it. The client and
+server must share RHTTPSERVE_TOKEN_KEY:
+
+	rhttpserve sign --opaque myremote:papers/raft.pdf
 `,
 	Run: func(command *cobra.Command, args []string) {
 		cmd.CheckArgs(1, 99999, command, args)
@@ -48,34 +112,107 @@ Example usage:
 			common.ExitWithError(err)
 		}
 
-		generator := URLGenerator{
+		if conf.KeyID != "" {
+			err = common.ValidateKeyID(conf.KeyID)
+			if err != nil {
+				common.ExitWithError(err)
+			}
+		}
+
+		sgnr := signer.Signer{
 			Host:       conf.Host,
+			KeyID:      conf.KeyID,
 			PrivateKey: ed25519.PrivateKey(privateKey),
 		}
 
-		for _, arg := range args {
-			// Maybe make this configurable at some point.
-			expiresAt := time.Now().Add(48 * time.Hour)
+		if cmd.Verbose {
+			sgnr.Logger = log.New(os.Stderr, "", log.LstdFlags)
+		}
+
+		if conf.TokenKey != "" {
+			sgnr.TokenKey, err = common.ParseTokenKey(conf.TokenKey)
+			if err != nil {
+				common.ExitWithError(fmt.Errorf("RHTTPSERVE_TOKEN_KEY: %v", err))
+			}
+		}
+
+		if expiresAtStr != "" && command.Flags().Changed("expires-in") {
+			common.ExitWithError(fmt.Errorf("only one of --expires-at and --expires-in can be used"))
+		}
+
+		expiresAt, notBefore, err := linkTimes(time.Now(), expiresAtStr, expiresIn, notBeforeStr)
+		if err != nil {
+			common.ExitWithError(err)
+		}
+
+		// The server won't accept a link that doesn't work yet, so there's
+		// no point in checking it.
+		if notBefore.After(time.Now()) {
+			skipCheck = true
+		}
 
-			url, filename, err := generator.Generate(arg, expiresAt)
+		// Neither will it for a link that's bound to addresses that we might
+		// not be coming from.
+		if ip != "" {
+			skipCheck = true
+		}
+
+		var linkPassword string
+		if password {
+			linkPassword, err = readPassword()
 			if err != nil {
 				common.ExitWithError(err)
 			}
 
-			// Check that the URL that we just generated and the file that it
-			// points to is valid by issuing a HEAD request to the server.
-			if !skipCheck {
-				err = checkURL(url)
-				if err != nil {
-					common.ExitWithError(err)
+			// The server would only respond with its password form.
+			skipCheck = true
+		}
+
+		if opaque && sgnr.TokenKey == nil {
+			common.ExitWithError(fmt.Errorf("opaque links need RHTTPSERVE_TOKEN_KEY"))
+		}
+
+		spec := signer.LinkSpec{
+			ExpiresAt:    expiresAt,
+			Filename:     filename,
+			Inline:       inline,
+			IP:           ip,
+			MaxDownloads: maxDownloads,
+			NotBefore:    notBefore,
+			Opaque:       opaque,
+			Password:     linkPassword,
+			Prefix:       prefix,
+		}
+		for param, value := range responseHeaders {
+			if *value != "" {
+				if spec.ResponseHeaders == nil {
+					spec.ResponseHeaders = make(map[string]string)
 				}
+				spec.ResponseHeaders[param] = *value
 			}
+		}
 
-			if curl {
-				fmt.Printf("curl -o '%s' '%s'\n", filename, url)
-			} else {
-				fmt.Printf("%s\n", url)
+		if filename != "" && !bundle && len(args) > 1 {
+			common.ExitWithError(fmt.Errorf("--filename can only be used with a single file"))
+		}
+
+		if bundle {
+			if prefix {
+				common.ExitWithError(fmt.Errorf("bundles can't be scoped to a prefix"))
 			}
+
+			spec.Bundle = args
+			signLink(&sgnr, spec)
+			return
+		}
+
+		for _, arg := range args {
+			spec.Remote, spec.Path, err = common.SplitRemotePath(arg)
+			if err != nil {
+				common.ExitWithError(err)
+			}
+
+			signLink(&sgnr, spec)
 		}
 	},
 }
@@ -84,78 +221,141 @@ Example usage:
 type Config struct {
 	Host       string `env:"RHTTPSERVE_HOST,required"`
 	PrivateKey string `env:"RHTTPSERVE_PRIVATE_KEY,required"`
+
+	// KeyID names the private key so that a server trusting several public
+	// keys knows which one to verify with. Optional.
+	KeyID string `env:"RHTTPSERVE_KEY_ID"`
+
+	// TokenKey is the key shared with the server that opaque links are
+	// encrypted with. Only needed for opaque links.
+	TokenKey string `env:"RHTTPSERVE_TOKEN_KEY"`
 }
 
-// URLGenerator is a basic encapsulation of the information necessary to
-// generated a signed URL for an rhttpserve server.
-type URLGenerator struct {
-	Host       string
-	PrivateKey ed25519.PrivateKey
+func init() {
+	cmd.Root.AddCommand(signCmd)
+	signCmd.Flags().BoolVar(&bundle, "bundle", false,
+		"Produce a single link to a zip archive of all the given files")
+	signCmd.Flags().BoolVar(&curl, "curl", false, "Output as cURL command")
+	signCmd.Flags().StringVar(&expiresAtStr, "expires-at", "",
+		"Time that the link expires at (RFC 3339, like 2017-02-01T15:04:05Z)")
+	signCmd.Flags().DurationVar(&expiresIn, "expires-in", 48*time.Hour,
+		"How long until the link expires")
+	signCmd.Flags().StringVar(&filename, "filename", "",
+		"Name that the file should be saved as")
+	signCmd.Flags().BoolVar(&inline, "inline", false,
+		"Ask browsers to display the file instead of downloading it")
+	for param, header := range common.ResponseHeaderParams {
+		responseHeaders[param] = signCmd.Flags().String(param, "",
+			"Override the "+header+" header of the response")
+	}
+	signCmd.Flags().StringVar(&ip, "ip", "",
+		"Comma-separated addresses or CIDR blocks that the link can be used from")
+	signCmd.Flags().IntVar(&maxDownloads, "max-downloads", 0,
+		"Number of times that the link can be downloaded (0 for no limit)")
+	signCmd.Flags().StringVar(&notBeforeStr, "not-before", "",
+		"Time that the link starts working at (RFC 3339)")
+	signCmd.Flags().BoolVar(&opaque, "opaque", false,
+		"Encrypt the link's remote, path, and parameters into an opaque token")
+	signCmd.Flags().BoolVar(&password, "password", false,
+		"Ask for a password that must be entered to use the link")
+	signCmd.Flags().BoolVar(&prefix, "prefix", false,
+		"Authorize any object under the given directory")
+	signCmd.Flags().BoolVar(&skipCheck, "skip-check", false,
+		"Skip issuing server check of generated URL")
 }
 
-// Generate generates a URL based off a remote path and an expiry time.
-func (s *URLGenerator) Generate(remoteAndPath string, expiresAt time.Time) (string, string, error) {
-	scheme := "https"
-	if s.Host == "localhost" || strings.HasPrefix(s.Host, "localhost:") {
-		scheme = "http"
+// readPassword reads a link's password. It's prompted for twice if stdin is a
+// terminal, and otherwise read from the first line of stdin so that it can be
+// piped in.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("couldn't read password: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	first, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
 	}
 
-	parts := strings.Split(remoteAndPath, ":")
-	if len(parts) != 2 {
-		return "", "", fmt.Errorf("arguments should be of the form of remote:path/to/file")
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	second, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
 	}
-	remote := parts[0]
-	path := parts[1]
 
-	u := url.URL{
-		Host:   s.Host,
-		Path:   remote + "/" + path,
-		Scheme: scheme,
+	if string(first) != string(second) {
+		return "", fmt.Errorf("passwords don't match")
 	}
+	return string(first), nil
+}
+
+// linkTimes works out when a link expires and when it starts working (which
+// is the zero time if it works right away) from the values of the command's
+// flags. expiresIn counts from when the link starts working.
+func linkTimes(now time.Time, expiresAtStr string, expiresIn time.Duration, notBeforeStr string) (time.Time, time.Time, error) {
+	var expiresAt, notBefore time.Time
+	var err error
 
-	message := common.Message(remote, path, expiresAt.Unix())
-	if cmd.Verbose {
-		log.Printf("Message: %v", string(message))
+	start := now
+	if notBeforeStr != "" {
+		notBefore, err = time.Parse(time.RFC3339, notBeforeStr)
+		if err != nil {
+			return expiresAt, notBefore, fmt.Errorf("couldn't parse --not-before: %v", err)
+		}
+		start = notBefore
 	}
 
-	signature := ed25519.Sign(s.PrivateKey, message)
+	if expiresAtStr != "" {
+		expiresAt, err = time.Parse(time.RFC3339, expiresAtStr)
+		if err != nil {
+			return expiresAt, notBefore, fmt.Errorf("couldn't parse --expires-at: %v", err)
+		}
+	} else {
+		expiresAt = start.Add(expiresIn)
+	}
 
-	u.RawQuery = fmt.Sprintf("expires_at=%v&signature=%v",
-		expiresAt.Unix(), base64.URLEncoding.EncodeToString(signature))
+	if !start.Before(expiresAt) {
+		return expiresAt, notBefore, fmt.Errorf("link would expire before it starts working")
+	}
 
-	filename := filepath.Base(path)
-	return u.String(), filename, nil
-}
+	if !expiresAt.After(now) {
+		return expiresAt, notBefore, fmt.Errorf("link would already be expired")
+	}
 
-func init() {
-	cmd.Root.AddCommand(signCmd)
-	signCmd.Flags().BoolVar(&curl, "curl", false, "Output as cURL command")
-	signCmd.Flags().BoolVar(&skipCheck, "skip-check", false,
-		"Skip issuing server check of generated URL")
+	return expiresAt, notBefore, nil
 }
 
-func checkURL(url string) error {
-	resp, err := http.Head(url)
+// signLink signs a link, checks it (unless asked not to), and prints it.
+func signLink(sgnr *signer.Signer, spec signer.LinkSpec) {
+	url, err := sgnr.Sign(spec)
 	if err != nil {
-		return err
+		common.ExitWithError(err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		// Re-request with GET so we can see a response body.
-		resp, err := http.Get(url)
+	// Check that the URL that we just generated and the file (or directory)
+	// that it points to is valid by issuing a HEAD request to the server.
+	if !skipCheck {
+		err := signer.Check(context.Background(), nil, url)
 		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-
-		message, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
+			common.ExitWithError(err)
 		}
-
-		return fmt.Errorf(string(message))
 	}
 
-	return nil
+	filename := spec.DownloadName()
+	if curl && prefix {
+		// Download the whole directory as an archive.
+		fmt.Printf("curl -o '%s.zip' '%s&archive=zip'\n", filename, url)
+	} else if curl {
+		fmt.Printf("curl -o '%s' '%s'\n", filename, url)
+	} else {
+		fmt.Printf("%s\n", url)
+	}
 }
@@ -0,0 +1,36 @@
+package sign
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkTimes(t *testing.T) {
+	now := time.Date(2017, 2, 1, 8, 0, 0, 0, time.UTC)
+
+	expiresAt, notBefore, err := linkTimes(now, "", 48*time.Hour, "")
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(48*time.Hour), expiresAt)
+	assert.True(t, notBefore.IsZero())
+
+	expiresAt, notBefore, err = linkTimes(now, "", 8*time.Hour, "2017-02-01T09:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 2, 1, 17, 0, 0, 0, time.UTC), expiresAt.UTC())
+	assert.Equal(t, time.Date(2017, 2, 1, 9, 0, 0, 0, time.UTC), notBefore.UTC())
+
+	expiresAt, _, err = linkTimes(now, "2017-02-03T00:00:00+01:00", 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 2, 2, 23, 0, 0, 0, time.UTC), expiresAt.UTC())
+
+	for _, tc := range [][2]string{
+		{"2017-02-01T07:00:00Z", ""},
+		{"2017-02-01T10:00:00Z", "2017-02-01T11:00:00Z"},
+		{"tomorrow", ""},
+		{"", "tomorrow"},
+	} {
+		_, _, err := linkTimes(now, tc[0], time.Hour, tc[1])
+		assert.Error(t, err, "%v", tc)
+	}
+}
@@ -0,0 +1,284 @@
+package verify
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brandur/rhttpserve/cmd"
+	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/signer"
+	"github.com/joeshaw/envdecode"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ed25519"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: `Checks a shared link without a server.`,
+	Long: `
+Checks a link the same way that a server configured with the same public keys
+would, and explains exactly why it would be refused if it would be. Useful when
+a recipient reports that a link doesn't work.
+
+Example usage:
+
+	rhttpserve verify 'https://serve.example.com/myremote/papers/raft.pdf?...'
+
+Links are verified against RHTTPSERVE_PUBLIC_KEY and RHTTPSERVE_PUBLIC_KEYS,
+and RHTTPSERVE_ACCEPT_V1, RHTTPSERVE_CLOCK_SKEW, and RHTTPSERVE_MAX_TTL are
+respected like they are by the server. Opaque links can be verified if
+RHTTPSERVE_TOKEN_KEY is set.
+
+Whether a link has been revoked, has run out of downloads, or is being used
+from an allowed address can only be checked by the server.
+`,
+	Run: func(command *cobra.Command, args []string) {
+		cmd.CheckArgs(1, 1, command, args)
+
+		var conf Config
+		err := envdecode.Decode(&conf)
+		if err != nil {
+			common.ExitWithError(err)
+		}
+
+		publicKeys, err := common.ParsePublicKeys(conf.PublicKey, conf.PublicKeys)
+		if err != nil {
+			common.ExitWithError(err)
+		}
+
+		var tokenKey *[32]byte
+		if conf.TokenKey != "" {
+			tokenKey, err = common.ParseTokenKey(conf.TokenKey)
+			if err != nil {
+				common.ExitWithError(fmt.Errorf("RHTTPSERVE_TOKEN_KEY: %v", err))
+			}
+		}
+
+		link, err := signer.Parse(args[0], tokenKey)
+		if err != nil {
+			common.ExitWithError(err)
+		}
+
+		if cmd.Verbose {
+			log.Printf("Message: %q", string(link.Message()))
+		}
+
+		v := &verifier{
+			policy: common.LinkPolicy{
+				AcceptV1:  conf.AcceptV1,
+				ClockSkew: conf.ClockSkew,
+				MaxTTL:    conf.MaxTTL,
+			},
+			publicKeys: publicKeys,
+		}
+		err = v.verify(link, time.Now())
+		if err != nil {
+			common.ExitWithError(err)
+		}
+
+		fmt.Printf("Link is valid\n")
+		for _, note := range serverChecks(link) {
+			fmt.Printf("%s\n", note)
+		}
+	},
+}
+
+// Config stores the configuration used by the verify command. Its variables
+// are the same as the server's.
+type Config struct {
+	AcceptV1   bool          `env:"RHTTPSERVE_ACCEPT_V1,default=true"`
+	ClockSkew  time.Duration `env:"RHTTPSERVE_CLOCK_SKEW,default=1m"`
+	MaxTTL     time.Duration `env:"RHTTPSERVE_MAX_TTL"`
+	PublicKey  string        `env:"RHTTPSERVE_PUBLIC_KEY"`
+	PublicKeys []string      `env:"RHTTPSERVE_PUBLIC_KEYS"`
+	TokenKey   string        `env:"RHTTPSERVE_TOKEN_KEY"`
+}
+
+func init() {
+	cmd.Root.AddCommand(verifyCmd)
+}
+
+// linkParams are the parameters that the signer sets on links. Any others
+// that a link has were probably added after it was signed.
+var linkParams = map[string]bool{
+	"bundle":        true,
+	"disposition":   true,
+	"expires_at":    true,
+	"filename":      true,
+	"iat":           true,
+	"ip":            true,
+	"kid":           true,
+	"max_downloads": true,
+	"not_before":    true,
+	"password_hash": true,
+	"prefix":        true,
+	"signature":     true,
+	"v":             true,
+}
+
+// verifier checks links like a server would, but explains why one isn't valid
+// in more detail than a server tells its clients.
+type verifier struct {
+	policy     common.LinkPolicy
+	publicKeys map[string]ed25519.PublicKey
+}
+
+// verify makes the checks of a link that a server makes that don't depend on
+// its state or on the request, in the same order, and returns an error
+// describing the first that fails.
+func (v *verifier) verify(l *signer.Link, now time.Time) error {
+	err := v.policy.CheckVersion(l.Params)
+	if err != nil {
+		return err
+	}
+
+	err = v.policy.CheckValidity(l.Params, now)
+	if err != nil {
+		return err
+	}
+
+	// Like the server, only report a path outside of the link's prefix once
+	// the signature is known to be good.
+	pathErr := l.CheckPath()
+	if pathErr != nil && pathErr != signer.ErrOutsidePrefix {
+		return fmt.Errorf("canonicalization mismatch: %v", pathErr)
+	}
+
+	_, err = common.ParseLinkConstraints(l.Params)
+	if err != nil {
+		return err
+	}
+
+	publicKey, ok := v.publicKeys[l.KeyID]
+	if !ok {
+		if l.KeyID == "" {
+			return fmt.Errorf("wrong key: link doesn't name a key, and there's no unnamed " +
+				"public key (RHTTPSERVE_PUBLIC_KEY) to verify it with")
+		}
+		return fmt.Errorf("wrong key: link was signed with key %q, which isn't among the "+
+			"public keys (known: %q)", l.KeyID, keyIDs(v.publicKeys))
+	}
+
+	if !ed25519.Verify(publicKey, l.Message(), l.Signature) {
+		return v.diagnoseSignature(l)
+	}
+
+	if pathErr == signer.ErrOutsidePrefix {
+		return fmt.Errorf("tampered path: %q is outside of the link's prefix %q", l.Path, l.Prefix)
+	}
+
+	return nil
+}
+
+// diagnoseSignature works out why a link's signature doesn't verify by trying
+// it against the other public keys and against the likely ways that a link
+// gets mangled on its way to a recipient.
+func (v *verifier) diagnoseSignature(l *signer.Link) error {
+	for _, keyID := range keyIDs(v.publicKeys) {
+		if keyID != l.KeyID && ed25519.Verify(v.publicKeys[keyID], l.Message(), l.Signature) {
+			return fmt.Errorf("wrong key: link names key %q but was signed with key %q "+
+				"(check RHTTPSERVE_KEY_ID where it was signed)", l.KeyID, keyID)
+		}
+	}
+
+	publicKey := v.publicKeys[l.KeyID]
+	verifies := func(variant signer.Link) bool {
+		return ed25519.Verify(publicKey, variant.Message(), l.Signature)
+	}
+
+	if l.Version != "" {
+		// Mail clients and trackers like to append parameters of their own.
+		var added []string
+		params := url.Values{}
+		for key, values := range l.Params {
+			if linkParams[key] || common.RequestParams[key] {
+				params[key] = values
+			} else if _, ok := common.ResponseHeaderParams[key]; ok {
+				params[key] = values
+			} else {
+				added = append(added, key)
+			}
+		}
+		if len(added) > 0 {
+			variant := *l
+			variant.Params = params
+			if verifies(variant) {
+				sort.Strings(added)
+				return fmt.Errorf("canonicalization mismatch: parameters were added to the "+
+					"link after it was signed: %s", strings.Join(added, ", "))
+			}
+		}
+	}
+
+	// The path of a prefix-scoped link isn't signed, so only the paths of
+	// other links could have been mangled.
+	if l.Prefix == "" {
+		for _, p := range pathVariants(l.Path) {
+			variant := *l
+			variant.Path = p
+			if verifies(variant) {
+				return fmt.Errorf("canonicalization mismatch: link was signed for path %q, "+
+					"but its path is %q, which was probably re-encoded in transit", p, l.Path)
+			}
+		}
+	}
+
+	return fmt.Errorf("tampered link: signature doesn't match the link's remote, path, or " +
+		"parameters, so one of them was changed after it was signed")
+}
+
+// pathVariants returns the forms that a path might have had before being
+// mangled by a client that re-encoded it.
+func pathVariants(p string) []string {
+	var variants []string
+
+	// Decoding a second time undoes an escaped percent sign, as in "%2520".
+	decoded, err := url.QueryUnescape(strings.Replace(p, "+", "%2B", -1))
+	if err == nil && decoded != p {
+		variants = append(variants, decoded)
+	}
+
+	if strings.Contains(p, " ") {
+		variants = append(variants, strings.Replace(p, " ", "+", -1))
+	}
+	if strings.Contains(p, "+") {
+		variants = append(variants, strings.Replace(p, "+", " ", -1))
+	}
+
+	if strings.HasSuffix(p, "/") {
+		variants = append(variants, strings.TrimSuffix(p, "/"))
+	} else {
+		variants = append(variants, p+"/")
+	}
+
+	return variants
+}
+
+// serverChecks describes the checks that only the server can make of a link.
+func serverChecks(l *signer.Link) []string {
+	var notes []string
+	if ip := l.Params.Get("ip"); ip != "" {
+		notes = append(notes, "It can only be used from: "+ip)
+	}
+	if l.Params.Get("password_hash") != "" {
+		notes = append(notes, "It needs a password, which can't be checked here")
+	}
+	if maxDownloads := l.Params.Get("max_downloads"); maxDownloads != "" {
+		notes = append(notes, "It can be downloaded "+maxDownloads+" times in total, "+
+			"which the server keeps count of")
+	}
+	return notes
+}
+
+func keyIDs(publicKeys map[string]ed25519.PublicKey) []string {
+	var ids []string
+	for id := range publicKeys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
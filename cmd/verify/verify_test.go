@@ -0,0 +1,235 @@
+package verify
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/internal/signertest"
+	"github.com/brandur/rhttpserve/internal/testkeys"
+	"github.com/brandur/rhttpserve/signer"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+var testExpiresAt = time.Unix(1484239044, 0)
+
+func newTestVerifier(t *testing.T) (*verifier, *signer.Signer) {
+	v := &verifier{
+		policy: common.LinkPolicy{
+			AcceptV1:  true,
+			ClockSkew: time.Minute,
+		},
+		publicKeys: map[string]ed25519.PublicKey{
+			"2017-01": testkeys.PublicKey,
+			"2017-02": testkeys.OtherPublicKey,
+		},
+	}
+	return v, signertest.NewSigner("2017-01")
+}
+
+// verifySigned signs a link, mangles its URL, and verifies it an hour before
+// it expires. Unless the spec says otherwise, the link was issued an hour
+// before that.
+func verifySigned(t *testing.T, v *verifier, s *signer.Signer, spec signer.LinkSpec, mangle func(string) string) error {
+	spec.ExpiresAt = testExpiresAt
+	if spec.IssuedAt.IsZero() {
+		spec.IssuedAt = testExpiresAt.Add(-2 * time.Hour)
+	}
+	rawURL, err := s.Sign(spec)
+	assert.NoError(t, err)
+
+	link, err := signer.Parse(mangle(rawURL), nil)
+	assert.NoError(t, err)
+
+	return v.verify(link, testExpiresAt.Add(-time.Hour))
+}
+
+func unchanged(s string) string { return s }
+
+func TestVerify(t *testing.T) {
+	v, s := newTestVerifier(t)
+	spec := signer.LinkSpec{Remote: "remote", Path: "papers/raft 2014.pdf"}
+
+	err := verifySigned(t, v, s, spec, unchanged)
+	assert.NoError(t, err)
+
+	link, err := s.Sign(signer.LinkSpec{
+		Remote:    "remote",
+		Path:      "papers/raft.pdf",
+		ExpiresAt: testExpiresAt,
+		IssuedAt:  testExpiresAt.Add(-2 * time.Hour),
+	})
+	assert.NoError(t, err)
+	l, err := signer.Parse(link, nil)
+	assert.NoError(t, err)
+
+	err = v.verify(l, testExpiresAt.Add(time.Hour))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "link expired at 2017-01-12T16:37:24Z (1h0m0s ago)")
+
+	v.policy.MaxTTL = time.Minute
+	err = v.verify(l, testExpiresAt.Add(-time.Hour))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "longer than the maximum")
+
+	// Without an issue time, there's nothing to measure the link's lifetime
+	// from.
+	l.Params.Del("iat")
+	err = v.verify(l, testExpiresAt.Add(-time.Hour))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "neither iat nor not_before")
+
+	// Nor can a link be issued in the future to stretch its lifetime.
+	l.Params.Set("iat", strconv.FormatInt(testExpiresAt.Add(-time.Minute).Unix(), 10))
+	err = v.verify(l, testExpiresAt.Add(-time.Hour))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "link claims to have been issued at 2017-01-12T16:36:24Z (in 59m0s)")
+}
+
+func TestVerifyNotBefore(t *testing.T) {
+	v, s := newTestVerifier(t)
+	spec := signer.LinkSpec{Remote: "remote", Path: "papers/raft.pdf", NotBefore: testExpiresAt.Add(-time.Minute)}
+
+	err := verifySigned(t, v, s, spec, unchanged)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "isn't valid until")
+
+	// Within the allowed clock skew.
+	spec.NotBefore = testExpiresAt.Add(-time.Hour + 30*time.Second)
+	err = verifySigned(t, v, s, spec, unchanged)
+	assert.NoError(t, err)
+}
+
+func TestVerifyWrongKey(t *testing.T) {
+	v, s := newTestVerifier(t)
+	spec := signer.LinkSpec{Remote: "remote", Path: "papers/raft.pdf"}
+
+	s.KeyID = "2016-12"
+	err := verifySigned(t, v, s, spec, unchanged)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `wrong key: link was signed with key "2016-12"`)
+
+	s.KeyID = ""
+	err = verifySigned(t, v, s, spec, unchanged)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "link doesn't name a key")
+
+	// The signing client's key ID doesn't match its private key.
+	s.KeyID = "2017-02"
+	err = verifySigned(t, v, s, spec, unchanged)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `wrong key: link names key "2017-02" but was signed with key "2017-01"`)
+}
+
+func TestVerifyCanonicalization(t *testing.T) {
+	v, s := newTestVerifier(t)
+
+	err := verifySigned(t, v, s, signer.LinkSpec{Remote: "remote", Path: "papers/raft.pdf"},
+		func(u string) string { return u + "&utm_source=newsletter" })
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "parameters were added to the link after it was signed: utm_source")
+
+	err = verifySigned(t, v, s, signer.LinkSpec{Remote: "remote", Path: "papers/raft 2014.pdf"},
+		func(u string) string { return strings.Replace(u, "%20", "%2520", 1) })
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `canonicalization mismatch: link was signed for path "papers/raft 2014.pdf"`)
+
+	err = verifySigned(t, v, s, signer.LinkSpec{Remote: "remote", Path: "papers/raft 2014.pdf"},
+		func(u string) string { return strings.Replace(u, "%20", "+", 1) })
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "canonicalization mismatch")
+
+	err = verifySigned(t, v, s, signer.LinkSpec{Remote: "remote", Path: "papers/raft.pdf"},
+		func(u string) string { return strings.Replace(u, "papers/raft.pdf", "papers//raft.pdf", 1) })
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "canonicalization mismatch: path")
+
+	err = verifySigned(t, v, s, signer.LinkSpec{Remote: "remote", Path: "papers/raft.pdf"},
+		func(u string) string { return strings.Replace(u, "papers/raft.pdf", "papers%2Fraft.pdf", 1) })
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "encoded slash")
+}
+
+func TestVerifyTampered(t *testing.T) {
+	v, s := newTestVerifier(t)
+
+	err := verifySigned(t, v, s, signer.LinkSpec{Remote: "remote", Path: "papers/raft.pdf"},
+		func(u string) string { return strings.Replace(u, "raft.pdf", "paxos.pdf", 1) })
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tampered link")
+
+	err = verifySigned(t, v, s, signer.LinkSpec{Remote: "remote", Path: "papers/raft.pdf", MaxDownloads: 1},
+		func(u string) string { return strings.Replace(u, "max_downloads=1", "max_downloads=9", 1) })
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tampered link")
+
+	err = verifySigned(t, v, s, signer.LinkSpec{Remote: "remote", Path: "photos/", Prefix: true},
+		func(u string) string { return strings.Replace(u, "/remote/photos/", "/remote/secrets/a.jpg", 1) })
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `tampered path: "secrets/a.jpg" is outside of the link's prefix "photos/"`)
+}
+
+func TestVerifyInvalidParams(t *testing.T) {
+	v, s := newTestVerifier(t)
+
+	// Links with parameters that the server would refuse are refused the same
+	// way, before their signatures are even checked.
+	for _, tc := range []struct {
+		spec           signer.LinkSpec
+		signed, mangle string
+		message        string
+	}{
+		{signer.LinkSpec{Inline: true}, "disposition=inline", "disposition=form-data",
+			`invalid disposition "form-data"`},
+		{signer.LinkSpec{Filename: "Raft.pdf"}, "filename=Raft.pdf", "filename=..%2FRaft.pdf",
+			`invalid filename can't contain '/'`},
+		{signer.LinkSpec{MaxDownloads: 1}, "max_downloads=1", "max_downloads=0",
+			`couldn't parse max_downloads "0"`},
+		{signer.LinkSpec{IP: "192.0.2.1"}, "ip=192.0.2.1", "ip=office",
+			"couldn't parse ip"},
+		{signer.LinkSpec{Password: "correct horse"}, "password_hash=", "password_hash=hunter2&x=",
+			"couldn't parse password_hash"},
+		{signer.LinkSpec{ResponseHeaders: map[string]string{"response-content-type": "text/plain"}},
+			"response-content-type=text%2Fplain", "response-content-type=text%0D%0AX:%20y",
+			"invalid response-content-type"},
+	} {
+		spec := tc.spec
+		spec.Remote, spec.Path = "remote", "papers/raft.pdf"
+
+		err := verifySigned(t, v, s, spec, func(u string) string {
+			assert.Contains(t, u, tc.signed)
+			return strings.Replace(u, tc.signed, tc.mangle, 1)
+		})
+		if assert.Error(t, err, tc.mangle) {
+			assert.Contains(t, err.Error(), tc.message)
+		}
+	}
+}
+
+func TestVerifyV1(t *testing.T) {
+	v, s := newTestVerifier(t)
+
+	l := &signer.Link{
+		Remote:    "remote",
+		Path:      "papers/raft.pdf",
+		KeyID:     "2017-01",
+		ExpiresAt: testExpiresAt,
+	}
+	l.Signature = ed25519.Sign(s.PrivateKey, l.Message())
+
+	l.Params = map[string][]string{"expires_at": {"1484239044"}, "kid": {"2017-01"}}
+	assert.NoError(t, v.verify(l, testExpiresAt.Add(-time.Hour)))
+
+	l.Params["filename"] = []string{"evil.exe"}
+	err := v.verify(l, testExpiresAt.Add(-time.Hour))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `parameter "filename" isn't covered`)
+
+	v.policy.AcceptV1 = false
+	err = v.verify(l, testExpiresAt.Add(-time.Hour))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "original signature format")
+}
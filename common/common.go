@@ -1,10 +1,79 @@
 package common
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
 )
 
+// BundleRemote is used in place of a remote name in the path of a bundle link.
+// It can't be mistaken for a real remote because rclone doesn't allow dots in
+// remote names.
+const BundleRemote = ".bundle"
+
+// TokenRemote is used in place of a remote name in the path of an opaque link,
+// which is followed by the link's token. Like BundleRemote, it can't be
+// mistaken for a real remote.
+const TokenRemote = ".t"
+
+// tokenVersion is the first byte of every token so that their format can be
+// changed later.
+const tokenVersion = 1
+
+// MessageVersion is the version of the message format produced by
+// CanonicalMessage. Links carry it in their "v" parameter. Links without one
+// were signed with the original format produced by Message and KeyedMessage.
+const MessageVersion = "2"
+
+// RequestParams are parameters that a link's recipient may add to it. They're
+// left out of the message that's signed because they only choose how
+// something that the link already authorizes is delivered.
+var RequestParams = map[string]bool{
+	// archive downloads a directory under a prefix-scoped link as a single
+	// archive instead of listing it.
+	"archive": true,
+}
+
+// ResponseHeaderParams are parameters that a link can carry to override a
+// header of the response to it, keyed to the header that each overrides.
+// They're named after the equivalent parameters of S3's presigned URLs.
+var ResponseHeaderParams = map[string]string{
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+	"response-content-language":    "Content-Language",
+	"response-content-type":        "Content-Type",
+	"response-expires":             "Expires",
+}
+
+// messageTag begins every payload produced by CanonicalMessage so that it can
+// never be confused with a payload in another format.
+const messageTag = "rhttpserve-v2"
+
+// keyIDPattern matches valid key IDs. They're kept to a conservative set of
+// characters so that they can't be confused with separators in a message or
+// URL.
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
 // ExitWithError exits the program after printing the given error's message.
 func ExitWithError(err error) {
 	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -15,3 +84,746 @@ func ExitWithError(err error) {
 func Message(remote, path string, expiresAt int64) []byte {
 	return []byte(fmt.Sprintf("%v|%v|%v", remote, path, expiresAt))
 }
+
+// KeyedMessage generates a message payload based off the ID of the key that
+// will sign it, a path and expiry time. An empty key ID produces the same
+// payload as Message so that links signed by an unnamed key stay valid.
+func KeyedMessage(keyID, remote, path string, expiresAt int64) []byte {
+	if keyID == "" {
+		return Message(remote, path, expiresAt)
+	}
+	return []byte(fmt.Sprintf("%v|%v|%v|%v", keyID, remote, path, expiresAt))
+}
+
+// ValidateKeyID returns an error if the given key ID contains characters other
+// than letters, digits, dots, dashes, and underscores.
+func ValidateKeyID(keyID string) error {
+	if !keyIDPattern.MatchString(keyID) {
+		return fmt.Errorf("invalid key ID %q: may only contain letters, digits, '.', '-', and '_'", keyID)
+	}
+	return nil
+}
+
+// ValidateFilename returns an error if the given filename, which a link asks
+// for its file to be saved as, is empty or contains control characters or path
+// separators.
+func ValidateFilename(filename string) error {
+	if filename == "" {
+		return fmt.Errorf("filename can't be empty")
+	}
+	if !utf8.ValidString(filename) {
+		return fmt.Errorf("filename must be valid UTF-8")
+	}
+	for _, c := range filename {
+		if c < 0x20 || c == 0x7F || c == '/' || c == '\\' {
+			return fmt.Errorf("filename can't contain %q", c)
+		}
+	}
+	return nil
+}
+
+// ValidateHeaderValue returns an error if the given value can't be used as the
+// value of an HTTP header.
+func ValidateHeaderValue(value string) error {
+	if value == "" {
+		return fmt.Errorf("header value can't be empty")
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 0x20 && c != '\t' || c == 0x7F {
+			return fmt.Errorf("header value can't contain %q", c)
+		}
+	}
+	return nil
+}
+
+// LinkConstraints are the constraints on how a link can be used that are set
+// by its parameters.
+type LinkConstraints struct {
+	// Prefix is set if the link authorizes any object under a directory. It
+	// ends with a slash.
+	Prefix string
+
+	// Disposition is either "attachment" or "inline".
+	Disposition string
+
+	// Filename is what the link's file is saved as instead of its own name.
+	// It's empty if the link doesn't give one.
+	Filename string
+
+	// MaxDownloads is how many times the link may be downloaded, or 0 if
+	// there's no limit.
+	MaxDownloads int
+
+	// IPNets are the addresses that the link may be used from. It's empty if
+	// the link can be used from anywhere.
+	IPNets []*net.IPNet
+
+	// Password checks the password needed to unlock the link. It's nil if
+	// the link doesn't have one.
+	Password *PasswordVerifier
+}
+
+// ParseLinkConstraints parses the parameters of a link that constrain its use,
+// returning an error for the first that isn't valid. The server and the verify
+// command both check links' parameters with it so that they agree about which
+// links are valid.
+func ParseLinkConstraints(params url.Values) (*LinkConstraints, error) {
+	constraints := &LinkConstraints{}
+
+	if prefix := params.Get("prefix"); prefix != "" {
+		normalized, err := NormalizePath(prefix)
+		if err != nil || !strings.HasSuffix(normalized, "/") {
+			return nil, fmt.Errorf("invalid prefix %q: should be a directory path", prefix)
+		}
+		constraints.Prefix = normalized
+	}
+
+	constraints.Disposition = params.Get("disposition")
+	switch constraints.Disposition {
+	case "":
+		constraints.Disposition = "attachment"
+	case "attachment", "inline":
+	default:
+		return nil, fmt.Errorf("invalid disposition %q", constraints.Disposition)
+	}
+
+	if filename := params.Get("filename"); filename != "" {
+		err := ValidateFilename(filename)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v", err)
+		}
+		constraints.Filename = filename
+	}
+
+	if maxDownloadsStr := params.Get("max_downloads"); maxDownloadsStr != "" {
+		maxDownloads, err := strconv.Atoi(maxDownloadsStr)
+		if err != nil || maxDownloads < 1 {
+			return nil, fmt.Errorf("couldn't parse max_downloads %q", maxDownloadsStr)
+		}
+		constraints.MaxDownloads = maxDownloads
+	}
+
+	if ipStr := params.Get("ip"); ipStr != "" {
+		ipNets, err := ParseIPNets(ipStr)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse ip: %v", err)
+		}
+		constraints.IPNets = ipNets
+	}
+
+	if passwordHash := params.Get("password_hash"); passwordHash != "" {
+		password, err := ParsePasswordVerifier(passwordHash)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse password_hash: %v", err)
+		}
+		constraints.Password = password
+	}
+
+	// Go through response headers in order so that the same error is always
+	// returned for a link with several bad ones.
+	var headerParams []string
+	for param := range ResponseHeaderParams {
+		headerParams = append(headerParams, param)
+	}
+	sort.Strings(headerParams)
+
+	for _, param := range headerParams {
+		if _, ok := params[param]; !ok {
+			continue
+		}
+
+		err := ValidateHeaderValue(params.Get(param))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %v", param, err)
+		}
+	}
+
+	return constraints, nil
+}
+
+// v1Params are the only parameters that a link in the original format may
+// carry. Its message doesn't cover any others, so they can't be trusted.
+var v1Params = map[string]bool{
+	"expires_at": true,
+	"kid":        true,
+	"signature":  true,
+}
+
+// LinkPolicy is what a server requires of links besides a valid signature and
+// valid constraints. The server and the verify command both check links with
+// it so that they agree about which links are valid.
+type LinkPolicy struct {
+	// AcceptV1 is whether links signed in the original format are accepted.
+	AcceptV1 bool
+
+	// ClockSkew is how far the clocks of the server and of whoever signed a
+	// link may disagree.
+	ClockSkew time.Duration
+
+	// MaxTTL is the longest that a link may be valid for, measured from its
+	// not_before (or from when it was issued if it doesn't have one) to its
+	// expiry. Links in the original format, which can't say when they were
+	// issued, are measured from now. 0 means no limit.
+	MaxTTL time.Duration
+}
+
+// CheckVersion returns an error if a link with the given parameters is in a
+// format that the policy doesn't accept, or carries parameters that its
+// signature can't cover.
+func (p LinkPolicy) CheckVersion(params url.Values) error {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	switch version := params.Get("v"); version {
+	case "":
+		if !p.AcceptV1 {
+			return fmt.Errorf("link uses the original signature format, which isn't accepted")
+		}
+
+		for _, key := range keys {
+			if !v1Params[key] {
+				return fmt.Errorf("parameter %q isn't covered by the signature of a link in "+
+					"the original format", key)
+			}
+		}
+
+	case MessageVersion:
+		for _, key := range keys {
+			if len(params[key]) > 1 {
+				return fmt.Errorf("parameter %q appears more than once", key)
+			}
+		}
+
+	default:
+		return fmt.Errorf("link version %q isn't supported", version)
+	}
+
+	return nil
+}
+
+// CheckValidity returns an error if a link with the given parameters isn't
+// valid at the given time: it's expired, it isn't valid yet, or it's valid for
+// longer than the policy's maximum TTL.
+func (p LinkPolicy) CheckValidity(params url.Values, now time.Time) error {
+	parseTime := func(param string) (time.Time, bool, error) {
+		s := params.Get(param)
+		if s == "" {
+			return time.Time{}, false, nil
+		}
+
+		unix, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("couldn't parse %v", param)
+		}
+		return time.Unix(unix, 0), true, nil
+	}
+
+	expiresAt, ok, err := parseTime("expires_at")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("link doesn't have an expires_at")
+	}
+	if expiresAt.Before(now) {
+		return fmt.Errorf("link expired at %v (%v ago)",
+			expiresAt.UTC().Format(time.RFC3339), now.Sub(expiresAt))
+	}
+
+	// The link's validity window starts at not_before if it has one, and
+	// otherwise when it was issued. For links that say neither, now is the
+	// earliest that we know they could be used.
+	validFrom := now
+
+	issuedAt, haveIssuedAt, err := parseTime("iat")
+	if err != nil {
+		return err
+	}
+	if haveIssuedAt {
+		// A link that claims to be issued later than it was could outlive
+		// the maximum TTL.
+		if now.Add(p.ClockSkew).Before(issuedAt) {
+			return fmt.Errorf("link claims to have been issued at %v (in %v)",
+				issuedAt.UTC().Format(time.RFC3339), issuedAt.Sub(now))
+		}
+		validFrom = issuedAt
+	}
+
+	notBefore, haveNotBefore, err := parseTime("not_before")
+	if err != nil {
+		return err
+	}
+	if haveNotBefore {
+		if now.Add(p.ClockSkew).Before(notBefore) {
+			return fmt.Errorf("link isn't valid until %v (in %v)",
+				notBefore.UTC().Format(time.RFC3339), notBefore.Sub(now))
+		}
+		validFrom = notBefore
+	}
+
+	if p.MaxTTL <= 0 {
+		return nil
+	}
+
+	if params.Get("v") != "" && !haveIssuedAt && !haveNotBefore {
+		return fmt.Errorf("link has neither iat nor not_before, so its lifetime can't be " +
+			"checked against the maximum TTL")
+	}
+
+	if expiresAt.Sub(validFrom) > p.MaxTTL+p.ClockSkew {
+		return fmt.Errorf("link is valid for %v, which is longer than the maximum of %v",
+			expiresAt.Sub(validFrom), p.MaxTTL)
+	}
+
+	return nil
+}
+
+// CanonicalMessage generates a version 2 message payload.
+//
+// Every field is length-prefixed so that no two combinations of values
+// produce the same payload, and every parameter of a link except its
+// signature is included so that none can be added, removed, or altered.
+// HEAD is treated as GET so that a link can be checked before it's used.
+// RequestParams are also left out so that a recipient can add them.
+func CanonicalMessage(method, remote, path string, params url.Values) []byte {
+	var b bytes.Buffer
+	b.WriteString(messageTag)
+	b.WriteByte('\n')
+
+	if method == "HEAD" {
+		method = "GET"
+	}
+	writeField(&b, method)
+	writeField(&b, remote)
+	writeField(&b, path)
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		if key != "signature" && !RequestParams[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		values := append([]string(nil), params[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			writeField(&b, key)
+			writeField(&b, value)
+		}
+	}
+
+	return b.Bytes()
+}
+
+// NormalizePath checks that a path within a remote is in the normalized form
+// that's signed in version 2 messages and returns it. Normalized paths are
+// relative to the remote's root and don't contain empty, "." or ".."
+// segments (although they may end with a slash), or control characters.
+func NormalizePath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("path is empty")
+	}
+
+	if strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("path %q should be relative to the remote's root", path)
+	}
+
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	for _, segment := range segments {
+		switch segment {
+		case "":
+			return "", fmt.Errorf("path %q contains an empty segment", path)
+		case ".", "..":
+			return "", fmt.Errorf("path %q contains a relative segment", path)
+		}
+	}
+
+	for _, c := range path {
+		if c < 0x20 || c == 0x7F {
+			return "", fmt.Errorf("path %q contains a control character", path)
+		}
+	}
+
+	return path, nil
+}
+
+// CheckLinkPath checks that the path of a version 2 link is in the normalized
+// form that its message covers. escapedPath is the path of the link's URL as
+// it's escaped there, and path is the part of it after the remote, unescaped.
+func CheckLinkPath(escapedPath, path string) error {
+	// A slash that's been encoded would be decoded into the path and make it
+	// look like it has more segments than it does.
+	if strings.Contains(strings.ToLower(escapedPath), "%2f") {
+		return fmt.Errorf("path contains an encoded slash")
+	}
+
+	_, err := NormalizePath(path)
+	return err
+}
+
+func writeField(b *bytes.Buffer, value string) {
+	fmt.Fprintf(b, "%d:%s\n", len(value), value)
+}
+
+// EncodeBundle encodes a bundle's manifest, a list of objects of the form
+// "remote:path", for use as a link parameter.
+func EncodeBundle(remoteAndPaths []string) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strings.Join(remoteAndPaths, "\n")))
+}
+
+// DecodeBundle decodes a bundle's manifest that was encoded with EncodeBundle
+// and checks that each of its entries is a normalized path to a file.
+func DecodeBundle(encoded string) ([]string, error) {
+	manifest, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode bundle: %v", err)
+	}
+
+	remoteAndPaths := strings.Split(string(manifest), "\n")
+	for _, remoteAndPath := range remoteAndPaths {
+		_, path, err := SplitRemotePath(remoteAndPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasSuffix(path, "/") {
+			return nil, fmt.Errorf("bundles can only contain files, but %q is a directory", remoteAndPath)
+		}
+	}
+
+	return remoteAndPaths, nil
+}
+
+// SplitRemotePath splits a string of the form "remote:path" into its remote
+// and normalized path.
+func SplitRemotePath(remoteAndPath string) (string, string, error) {
+	// Split on the first colon only because paths may contain them too.
+	parts := strings.SplitN(remoteAndPath, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("%q should be of the form of remote:path/to/file", remoteAndPath)
+	}
+
+	path, err := NormalizePath(parts[1])
+	if err != nil {
+		return "", "", err
+	}
+
+	return parts[0], path, nil
+}
+
+// ParseIPNets parses a comma-separated list of IP addresses and CIDR blocks,
+// like "192.0.2.1,198.51.100.0/24". An address is treated as a block
+// containing only itself.
+func ParseIPNets(s string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, fmt.Errorf("empty entry in address list %q", s)
+		}
+
+		if strings.Contains(part, "/") {
+			_, ipNet, err := net.ParseCIDR(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR block %q", part)
+			}
+			ipNets = append(ipNets, ipNet)
+			continue
+		}
+
+		ip := net.ParseIP(part)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", part)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	return ipNets, nil
+}
+
+// LinkDigest identifies a link by the message that its signature is over.
+//
+// Links aren't identified by their signatures because more than one signature
+// verifies for the same message: its S half can have the group order added to
+// it. The digest doesn't reveal the signature, so the link can't be rebuilt
+// from it.
+func LinkDigest(message []byte) string {
+	sum := sha256.Sum256(message)
+	return hex.EncodeToString(sum[:])
+}
+
+// Revocation is an entry in a revocation list. It revokes the link whose
+// message has the given digest. It's only needed until the link expires.
+type Revocation struct {
+	Digest    string
+	ExpiresAt int64
+}
+
+// String formats the revocation as a line of a revocation list.
+func (r Revocation) String() string {
+	return fmt.Sprintf("%s %d", r.Digest, r.ExpiresAt)
+}
+
+// ParseRevocations parses a revocation list, which has a revocation on each
+// line in the form produced by Revocation.String. Blank lines and lines
+// starting with "#" are ignored.
+func ParseRevocations(r io.Reader) ([]Revocation, error) {
+	var revocations []Revocation
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %v: should be of the form <digest> <expires_at>", line)
+		}
+
+		digest, err := hex.DecodeString(fields[0])
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("line %v: invalid digest", line)
+		}
+
+		expiresAt, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: invalid expires_at", line)
+		}
+
+		revocations = append(revocations, Revocation{
+			Digest:    strings.ToLower(fields[0]),
+			ExpiresAt: expiresAt,
+		})
+	}
+
+	return revocations, scanner.Err()
+}
+
+// Parameters of the scrypt verifiers produced by NewPasswordVerifier. Checking
+// a password takes around 100 ms and 32 MB of memory.
+const (
+	passwordLogN    = 15
+	passwordR       = 8
+	passwordP       = 1
+	passwordSaltLen = 16
+	passwordKeyLen  = 32
+)
+
+// PasswordVerifier is used to check the password of a password-protected link
+// without the link containing the password itself. It's a salted scrypt hash.
+type PasswordVerifier struct {
+	LogN int
+	R    int
+	P    int
+	Salt []byte
+	Hash []byte
+}
+
+// NewPasswordVerifier generates a verifier for a password with a random salt.
+func NewPasswordVerifier(password string) (*PasswordVerifier, error) {
+	if password == "" {
+		return nil, fmt.Errorf("password can't be empty")
+	}
+
+	salt := make([]byte, passwordSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &PasswordVerifier{LogN: passwordLogN, R: passwordR, P: passwordP, Salt: salt}
+	v.Hash, err = v.hash(password)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ParsePasswordVerifier parses a verifier in the form produced by
+// PasswordVerifier.String. Parameters that would make checking a password
+// unreasonably expensive are refused.
+func ParsePasswordVerifier(s string) (*PasswordVerifier, error) {
+	fields := strings.Split(s, ".")
+	if len(fields) != 6 || fields[0] != "scrypt" {
+		return nil, fmt.Errorf("password verifier should be of the form scrypt.<log N>.<r>.<p>.<salt>.<hash>")
+	}
+
+	var params [3]int
+	for i := range params {
+		n, err := strconv.Atoi(fields[i+1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid scrypt parameter %q", fields[i+1])
+		}
+		params[i] = n
+	}
+
+	v := &PasswordVerifier{LogN: params[0], R: params[1], P: params[2]}
+
+	// scrypt needs 128 * r * N bytes of memory, which is kept to 256 MB.
+	if v.LogN > 20 || v.R<<uint(v.LogN) > 1<<21 || v.P > 4 {
+		return nil, fmt.Errorf("scrypt parameters are too expensive")
+	}
+
+	var err error
+	v.Salt, err = base64.RawURLEncoding.DecodeString(fields[4])
+	if err != nil || len(v.Salt) == 0 {
+		return nil, fmt.Errorf("invalid salt")
+	}
+	v.Hash, err = base64.RawURLEncoding.DecodeString(fields[5])
+	if err != nil || len(v.Hash) < 16 {
+		return nil, fmt.Errorf("invalid hash")
+	}
+
+	return v, nil
+}
+
+// String formats the verifier for use as a link parameter.
+func (v *PasswordVerifier) String() string {
+	return fmt.Sprintf("scrypt.%d.%d.%d.%s.%s", v.LogN, v.R, v.P,
+		base64.RawURLEncoding.EncodeToString(v.Salt),
+		base64.RawURLEncoding.EncodeToString(v.Hash))
+}
+
+// Check returns whether a password is the one that the verifier was generated
+// for.
+func (v *PasswordVerifier) Check(password string) bool {
+	hash, err := v.hash(password)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, v.Hash) == 1
+}
+
+func (v *PasswordVerifier) hash(password string) ([]byte, error) {
+	keyLen := len(v.Hash)
+	if keyLen == 0 {
+		keyLen = passwordKeyLen
+	}
+	return scrypt.Key([]byte(password), v.Salt, 1<<uint(v.LogN), v.R, v.P, keyLen)
+}
+
+// ParseTokenKey decodes a URL-safe base64-encoded key for sealing tokens.
+func ParseTokenKey(s string) (*[32]byte, error) {
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode token key: %v", err)
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("token key should be 32 bytes, but is %v", len(b))
+	}
+
+	var key [32]byte
+	copy(key[:], b)
+	return &key, nil
+}
+
+// SealToken encrypts the path and query of a signed link (like
+// "/remote/path?expires_at=...") into a token for an opaque link, so that
+// only servers with the key can see what the link points to. The token can be
+// used as a path segment.
+func SealToken(key *[32]byte, requestURI string) (string, error) {
+	var nonce [24]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return "", err
+	}
+
+	box := append([]byte{tokenVersion}, nonce[:]...)
+	box = secretbox.Seal(box, []byte(requestURI), &nonce, key)
+	return base64.RawURLEncoding.EncodeToString(box), nil
+}
+
+// OpenToken decrypts a token that was produced by SealToken, returning the path
+// and query of the link inside it.
+func OpenToken(key *[32]byte, token string) (string, error) {
+	box, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decode token")
+	}
+
+	if len(box) < 1+24+secretbox.Overhead || box[0] != tokenVersion {
+		return "", fmt.Errorf("malformed token")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], box[1:25])
+
+	requestURI, ok := secretbox.Open(nil, box[25:], &nonce, key)
+	if !ok {
+		return "", fmt.Errorf("couldn't decrypt token")
+	}
+	return string(requestURI), nil
+}
+
+// ParsePublicKeys decodes an unnamed public key (which may be empty) along
+// with any number of named ones of the form "<key ID>:<key>".
+func ParsePublicKeys(unnamed string, named []string) (map[string]ed25519.PublicKey, error) {
+	publicKeys := make(map[string]ed25519.PublicKey)
+
+	if unnamed != "" {
+		publicKey, err := decodePublicKey(unnamed)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys[""] = publicKey
+	}
+
+	for _, pair := range named {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("public keys should be of the form <key ID>:<key>")
+		}
+
+		keyID := parts[0]
+		err := ValidateKeyID(keyID)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := publicKeys[keyID]; ok {
+			return nil, fmt.Errorf("duplicate key ID: %v", keyID)
+		}
+
+		publicKey, err := decodePublicKey(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %v", keyID, err)
+		}
+		publicKeys[keyID] = publicKey
+	}
+
+	if len(publicKeys) < 1 {
+		return nil, fmt.Errorf("need at least one of RHTTPSERVE_PUBLIC_KEY or RHTTPSERVE_PUBLIC_KEYS")
+	}
+
+	return publicKeys, nil
+}
+
+func decodePublicKey(encoded string) (ed25519.PublicKey, error) {
+	publicKey, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key should be %v bytes, but was %v",
+			ed25519.PublicKeySize, len(publicKey))
+	}
+
+	return ed25519.PublicKey(publicKey), nil
+}
@@ -1,10 +1,366 @@
 package common
 
 import (
-	"github.com/stretchr/testify/assert"
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/internal/testkeys"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestMessage(t *testing.T) {
 	assert.Equal(t, "remote|path/to/file|123", string(Message("remote", "path/to/file", 123)))
 }
+
+func TestKeyedMessage(t *testing.T) {
+	assert.Equal(t, "remote|path/to/file|123", string(KeyedMessage("", "remote", "path/to/file", 123)))
+	assert.Equal(t, "2017-01|remote|path/to/file|123", string(KeyedMessage("2017-01", "remote", "path/to/file", 123)))
+}
+
+func TestParseIPNets(t *testing.T) {
+	ipNets, err := ParseIPNets("192.0.2.1, 198.51.100.0/24,2001:db8::/32")
+	assert.NoError(t, err)
+	assert.Len(t, ipNets, 3)
+	assert.Equal(t, "192.0.2.1/32", ipNets[0].String())
+	assert.Equal(t, "198.51.100.0/24", ipNets[1].String())
+	assert.Equal(t, "2001:db8::/32", ipNets[2].String())
+
+	for _, s := range []string{"", "192.0.2.1,", "192.0.2.256", "198.51.100.0/33", "office"} {
+		_, err := ParseIPNets(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParseRevocations(t *testing.T) {
+	digest := LinkDigest([]byte("message"))
+	revocation := Revocation{Digest: digest, ExpiresAt: 1484239044}
+	assert.Equal(t, digest+" 1484239044", revocation.String())
+
+	revocations, err := ParseRevocations(strings.NewReader(
+		"# Shared with the wrong person\n\n" + revocation.String() + "\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []Revocation{revocation}, revocations)
+
+	for _, list := range []string{
+		digest,
+		digest + " soon",
+		"abc 1484239044",
+		digest + " 1484239044 extra",
+	} {
+		_, err := ParseRevocations(strings.NewReader(list))
+		assert.Error(t, err, list)
+	}
+}
+
+func TestValidateKeyID(t *testing.T) {
+	assert.NoError(t, ValidateKeyID("2017-01_a.b"))
+	assert.Error(t, ValidateKeyID(""))
+	assert.Error(t, ValidateKeyID("a|b"))
+	assert.Error(t, ValidateKeyID("a:b"))
+}
+
+func TestValidateFilename(t *testing.T) {
+	assert.NoError(t, ValidateFilename("Report (final).pdf"))
+	assert.NoError(t, ValidateFilename("résumé \"2017\".pdf"))
+	assert.Error(t, ValidateFilename(""))
+	assert.Error(t, ValidateFilename("a/b.pdf"))
+	assert.Error(t, ValidateFilename("a\\b.pdf"))
+	assert.Error(t, ValidateFilename("a\nb.pdf"))
+	assert.Error(t, ValidateFilename("\xff.pdf"))
+}
+
+func TestValidateHeaderValue(t *testing.T) {
+	assert.NoError(t, ValidateHeaderValue("public, max-age=3600"))
+	assert.NoError(t, ValidateHeaderValue("text/plain;\tcharset=utf-8"))
+	assert.Error(t, ValidateHeaderValue(""))
+	assert.Error(t, ValidateHeaderValue("text/plain\r\nSet-Cookie: a=b"))
+}
+
+func TestParseLinkConstraints(t *testing.T) {
+	constraints, err := ParseLinkConstraints(url.Values{})
+	assert.NoError(t, err)
+	assert.Equal(t, &LinkConstraints{Disposition: "attachment"}, constraints)
+
+	verifier, err := NewPasswordVerifier("correct horse")
+	assert.NoError(t, err)
+
+	constraints, err = ParseLinkConstraints(url.Values{
+		"prefix":                 {"photos/trip/"},
+		"disposition":            {"inline"},
+		"filename":               {"Trip.zip"},
+		"max_downloads":          {"3"},
+		"ip":                     {"192.0.2.0/24"},
+		"password_hash":          {verifier.String()},
+		"response-cache-control": {"no-cache"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "photos/trip/", constraints.Prefix)
+	assert.Equal(t, "inline", constraints.Disposition)
+	assert.Equal(t, "Trip.zip", constraints.Filename)
+	assert.Equal(t, 3, constraints.MaxDownloads)
+	assert.Len(t, constraints.IPNets, 1)
+	assert.True(t, constraints.Password.Check("correct horse"))
+
+	for _, tc := range []struct {
+		param, value, message string
+	}{
+		{"prefix", "photos/trip", `invalid prefix "photos/trip": should be a directory path`},
+		{"prefix", "photos/../secrets/", `invalid prefix "photos/../secrets/": should be a directory path`},
+		{"disposition", "form-data", `invalid disposition "form-data"`},
+		{"filename", "../evil.exe", `invalid filename can't contain '/'`},
+		{"max_downloads", "0", `couldn't parse max_downloads "0"`},
+		{"max_downloads", "many", `couldn't parse max_downloads "many"`},
+		{"ip", "office", "couldn't parse ip: "},
+		{"password_hash", "hunter2", "couldn't parse password_hash: "},
+		{"response-content-type", "text/html\r\nSet-Cookie: a=b", "invalid response-content-type: "},
+	} {
+		_, err := ParseLinkConstraints(url.Values{tc.param: {tc.value}})
+		if assert.Error(t, err, "%+v", tc) {
+			assert.Contains(t, err.Error(), tc.message, "%+v", tc)
+		}
+	}
+}
+
+func TestLinkPolicyCheckVersion(t *testing.T) {
+	policy := LinkPolicy{AcceptV1: true}
+
+	assert.NoError(t, policy.CheckVersion(url.Values{"expires_at": {"1"}, "kid": {"a"}, "signature": {"s"}}))
+	assert.NoError(t, policy.CheckVersion(url.Values{"v": {"2"}, "filename": {"a.txt"}}))
+
+	for _, tc := range []struct {
+		params  url.Values
+		message string
+	}{
+		{url.Values{"filename": {"evil.exe"}}, `parameter "filename" isn't covered`},
+		{url.Values{"v": {"2"}, "ip": {"192.0.2.1", "198.51.100.1"}}, `parameter "ip" appears more than once`},
+		{url.Values{"v": {"3"}}, `link version "3" isn't supported`},
+	} {
+		err := policy.CheckVersion(tc.params)
+		if assert.Error(t, err, "%v", tc.params) {
+			assert.Contains(t, err.Error(), tc.message)
+		}
+	}
+
+	policy.AcceptV1 = false
+	assert.Error(t, policy.CheckVersion(url.Values{"expires_at": {"1"}}))
+}
+
+func TestLinkPolicyCheckValidity(t *testing.T) {
+	policy := LinkPolicy{ClockSkew: time.Minute, MaxTTL: 24 * time.Hour}
+	now := time.Unix(1484239044, 0)
+	unix := func(d time.Duration) string {
+		return strconv.FormatInt(now.Add(d).Unix(), 10)
+	}
+
+	for _, tc := range []struct {
+		params  url.Values
+		message string
+	}{
+		{url.Values{"v": {"2"}, "iat": {unix(0)}, "expires_at": {unix(time.Hour)}}, ""},
+		{url.Values{"v": {"2"}, "not_before": {unix(30 * time.Second)}, "expires_at": {unix(time.Hour)}}, ""},
+		{url.Values{"expires_at": {unix(time.Hour)}}, ""},
+		{url.Values{"v": {"2"}, "iat": {unix(0)}}, "link doesn't have an expires_at"},
+		{url.Values{"v": {"2"}, "iat": {unix(0)}, "expires_at": {"soon"}}, "couldn't parse expires_at"},
+		{url.Values{"v": {"2"}, "iat": {unix(-2 * time.Hour)}, "expires_at": {unix(-time.Hour)}},
+			"link expired at 2017-01-12T15:37:24Z (1h0m0s ago)"},
+		{url.Values{"v": {"2"}, "not_before": {unix(time.Hour)}, "expires_at": {unix(2 * time.Hour)}},
+			"link isn't valid until 2017-01-12T17:37:24Z (in 1h0m0s)"},
+		{url.Values{"v": {"2"}, "iat": {unix(300 * 24 * time.Hour)}, "expires_at": {unix(301 * 24 * time.Hour)}},
+			"link claims to have been issued at"},
+		{url.Values{"v": {"2"}, "expires_at": {unix(time.Hour)}}, "link has neither iat nor not_before"},
+		{url.Values{"v": {"2"}, "iat": {unix(-2 * time.Hour)}, "expires_at": {unix(23 * time.Hour)}},
+			"link is valid for 25h0m0s, which is longer than the maximum of 24h0m0s"},
+	} {
+		err := policy.CheckValidity(tc.params, now)
+		if tc.message == "" {
+			assert.NoError(t, err, "%v", tc.params)
+		} else if assert.Error(t, err, "%v", tc.params) {
+			assert.Contains(t, err.Error(), tc.message)
+		}
+	}
+}
+
+func TestCanonicalMessage(t *testing.T) {
+	params := url.Values{
+		"v":          {"2"},
+		"expires_at": {"123"},
+		"kid":        {"2017-01"},
+		"signature":  {"ignored"},
+	}
+	assert.Equal(t,
+		"rhttpserve-v2\n3:GET\n6:remote\n12:path/to/file\n"+
+			"10:expires_at\n3:123\n3:kid\n7:2017-01\n1:v\n1:2\n",
+		string(CanonicalMessage("GET", "remote", "path/to/file", params)))
+
+	// Request parameters aren't signed.
+	withArchive := url.Values{"archive": {"zip"}}
+	for key, values := range params {
+		withArchive[key] = values
+	}
+	assert.Equal(t,
+		CanonicalMessage("GET", "remote", "path/to/file", params),
+		CanonicalMessage("GET", "remote", "path/to/file", withArchive))
+
+	// HEAD is signed as GET.
+	assert.Equal(t,
+		CanonicalMessage("GET", "remote", "path/to/file", params),
+		CanonicalMessage("HEAD", "remote", "path/to/file", params))
+
+	// Fields can't bleed into each other.
+	assert.NotEqual(t,
+		CanonicalMessage("GET", "remote", "a|b", url.Values{}),
+		CanonicalMessage("GET", "remote|a", "b", url.Values{}))
+	assert.NotEqual(t,
+		CanonicalMessage("GET", "remote", "path", url.Values{"a": {"1\n1:b"}}),
+		CanonicalMessage("GET", "remote", "path", url.Values{"a": {"1"}, "b": {""}}))
+}
+
+func TestNormalizePath(t *testing.T) {
+	path, err := NormalizePath("path/to/file:with:colons.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "path/to/file:with:colons.txt", path)
+
+	path, err = NormalizePath("path/to/dir/")
+	assert.NoError(t, err)
+	assert.Equal(t, "path/to/dir/", path)
+
+	for _, bad := range []string{"", "/path", "path//file", "path/./file", "path/../file", "..", "path/\x00"} {
+		_, err = NormalizePath(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	remoteAndPaths := []string{"remote:papers/raft.pdf", "other:photos/a:b.jpg"}
+	decoded, err := DecodeBundle(EncodeBundle(remoteAndPaths))
+	assert.NoError(t, err)
+	assert.Equal(t, remoteAndPaths, decoded)
+
+	_, err = DecodeBundle(EncodeBundle([]string{"remote:photos/"}))
+	assert.Error(t, err)
+
+	_, err = DecodeBundle(EncodeBundle([]string{"remote:../etc/passwd"}))
+	assert.Error(t, err)
+
+	_, err = DecodeBundle("not base64!")
+	assert.Error(t, err)
+}
+
+func TestSplitRemotePath(t *testing.T) {
+	remote, path, err := SplitRemotePath("remote:papers/raft:2014.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, "remote", remote)
+	assert.Equal(t, "papers/raft:2014.pdf", path)
+
+	_, _, err = SplitRemotePath("papers/raft.pdf")
+	assert.Error(t, err)
+
+	_, _, err = SplitRemotePath(":papers/raft.pdf")
+	assert.Error(t, err)
+}
+
+func TestPasswordVerifier(t *testing.T) {
+	v, err := NewPasswordVerifier("correct horse")
+	assert.NoError(t, err)
+	assert.True(t, v.Check("correct horse"))
+	assert.False(t, v.Check("correct horse "))
+
+	parsed, err := ParsePasswordVerifier(v.String())
+	assert.NoError(t, err)
+	assert.Equal(t, v, parsed)
+	assert.True(t, parsed.Check("correct horse"))
+
+	// Salts are random, so the same password doesn't give the same verifier.
+	other, err := NewPasswordVerifier("correct horse")
+	assert.NoError(t, err)
+	assert.NotEqual(t, v.String(), other.String())
+
+	_, err = NewPasswordVerifier("")
+	assert.Error(t, err)
+
+	for _, bad := range []string{
+		"",
+		"bcrypt.15.8.1.c2FsdA.aGFzaGhhc2hoYXNoaGFzaA",
+		"scrypt.15.8.c2FsdA.aGFzaGhhc2hoYXNoaGFzaA",
+		"scrypt.x.8.1.c2FsdA.aGFzaGhhc2hoYXNoaGFzaA",
+		"scrypt.30.8.1.c2FsdA.aGFzaGhhc2hoYXNoaGFzaA",
+		"scrypt.20.8.1.c2FsdA.aGFzaGhhc2hoYXNoaGFzaA",
+		"scrypt.15.8.1..aGFzaGhhc2hoYXNoaGFzaA",
+		"scrypt.15.8.1.c2FsdA.aGFzaA",
+	} {
+		_, err = ParsePasswordVerifier(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestToken(t *testing.T) {
+	key, err := ParseTokenKey(base64.URLEncoding.EncodeToString(make([]byte, 32)))
+	assert.NoError(t, err)
+
+	requestURI := "/remote/papers/raft.pdf?expires_at=1484239044&signature=abc&v=2"
+	token, err := SealToken(key, requestURI)
+	assert.NoError(t, err)
+	assert.NotContains(t, token, "raft")
+	assert.NotContains(t, token, "/")
+
+	opened, err := OpenToken(key, token)
+	assert.NoError(t, err)
+	assert.Equal(t, requestURI, opened)
+
+	// Tokens don't open with another key.
+	otherKey, err := ParseTokenKey(base64.URLEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	assert.NoError(t, err)
+	_, err = OpenToken(otherKey, token)
+	assert.Error(t, err)
+
+	// Or after being tampered with.
+	box, err := base64.RawURLEncoding.DecodeString(token)
+	assert.NoError(t, err)
+	box[len(box)-1] ^= 1
+	_, err = OpenToken(key, base64.RawURLEncoding.EncodeToString(box))
+	assert.Error(t, err)
+
+	for _, bad := range []string{"", "not base64!", "AQID"} {
+		_, err = OpenToken(key, bad)
+		assert.Error(t, err, bad)
+	}
+
+	_, err = ParseTokenKey(base64.URLEncoding.EncodeToString(make([]byte, 16)))
+	assert.Error(t, err)
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	testPublicKey := testkeys.Encode(testkeys.PublicKey)
+	testOtherPublicKey := testkeys.Encode(testkeys.OtherPublicKey)
+
+	publicKeys, err := ParsePublicKeys(testPublicKey, nil)
+	assert.NoError(t, err)
+	assert.Len(t, publicKeys, 1)
+	assert.Contains(t, publicKeys, "")
+
+	publicKeys, err = ParsePublicKeys("", []string{
+		"2017-01:" + testPublicKey,
+		"2017-02:" + testOtherPublicKey,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, publicKeys, 2)
+	assert.Contains(t, publicKeys, "2017-01")
+	assert.Contains(t, publicKeys, "2017-02")
+
+	_, err = ParsePublicKeys("", nil)
+	assert.Error(t, err)
+
+	_, err = ParsePublicKeys("", []string{testPublicKey})
+	assert.Error(t, err)
+
+	_, err = ParsePublicKeys("", []string{"a:" + testPublicKey, "a:" + testOtherPublicKey})
+	assert.Error(t, err)
+
+	_, err = ParsePublicKeys("", []string{"a:c2hvcnQ="})
+	assert.Error(t, err)
+}
@@ -0,0 +1,18 @@
+// Package signertest provides signers for tests of packages that work with
+// signed links.
+package signertest
+
+import (
+	"github.com/brandur/rhttpserve/internal/testkeys"
+	"github.com/brandur/rhttpserve/signer"
+)
+
+// NewSigner returns a signer for links to serve.example.com that signs with
+// testkeys.PrivateKey under the given key ID.
+func NewSigner(keyID string) *signer.Signer {
+	return &signer.Signer{
+		Host:       "serve.example.com",
+		KeyID:      keyID,
+		PrivateKey: testkeys.PrivateKey,
+	}
+}
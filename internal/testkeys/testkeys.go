@@ -0,0 +1,54 @@
+// Package testkeys provides key pairs for tests that sign and verify links.
+// They're generated afresh every time the tests run.
+package testkeys
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	// PublicKey and PrivateKey are the key pair that tests sign links with.
+	PublicKey, PrivateKey = generateKey()
+
+	// OtherPublicKey and OtherPrivateKey are a second key pair, for tests
+	// where a link is verified with the wrong key.
+	OtherPublicKey, OtherPrivateKey = generateKey()
+)
+
+// Encode encodes a key the way that it's given in the environment.
+func Encode(key []byte) string {
+	return base64.URLEncoding.EncodeToString(key)
+}
+
+func generateKey() (ed25519.PublicKey, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return publicKey, privateKey
+}
+
+// order is the order of the group that ed25519 works in, little-endian.
+var order = [32]byte{
+	0xed, 0xd3, 0xf5, 0x5c, 0x1a, 0x63, 0x12, 0x58,
+	0xd6, 0x9c, 0xf7, 0xa2, 0xde, 0xf9, 0xde, 0x14,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10,
+}
+
+// Malleate returns a different signature that still verifies for the same
+// message as the given one, by adding the group order to its S half.
+func Malleate(signature []byte) []byte {
+	malleated := append([]byte(nil), signature...)
+
+	var carry uint
+	for i := range order {
+		sum := uint(malleated[32+i]) + uint(order[i]) + carry
+		malleated[32+i] = byte(sum)
+		carry = sum >> 8
+	}
+	return malleated
+}
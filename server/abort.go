@@ -0,0 +1,54 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// AbortedResponses returns how many responses have been cut off because
+// something went wrong on the server's side after their header was sent, like
+// a read from a remote that failed even after being resumed.
+func (s *Server) AbortedResponses() int64 {
+	return atomic.LoadInt64(&s.abortedResponses)
+}
+
+// ClientAbortedResponses returns how many responses have been cut off because
+// writing them to the client failed, which is usually because it went away
+// before the download finished.
+func (s *Server) ClientAbortedResponses() int64 {
+	return atomic.LoadInt64(&s.clientAbortedResponses)
+}
+
+// clientWriter writes the body of a response, remembering the first write
+// that fails so that a response aborted because of the client can be told
+// apart from one aborted because of the remote.
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// abortResponse gives up on a response whose header has already been sent
+// and whose body was being written through body.
+//
+// The connection is dropped (or, over HTTP/2, the stream is reset) so that
+// the client sees that the body is incomplete, rather than the response just
+// ending early. Callers should return right after.
+func (s *Server) abortResponse(w http.ResponseWriter, body *clientWriter, rclonePath string, err error) {
+	if body.err != nil {
+		atomic.AddInt64(&s.clientAbortedResponses, 1)
+		s.logf("Client went away during response for %s: %v", rclonePath, body.err)
+	} else {
+		atomic.AddInt64(&s.abortedResponses, 1)
+		s.logf("Aborted response for %s: %v", rclonePath, err)
+	}
+	abortHandler(w)
+}
@@ -0,0 +1,25 @@
+//go:build !go1.8
+// +build !go1.8
+
+package server
+
+import (
+	"errors"
+	"net/http"
+)
+
+// abortHandler aborts the response being written to w.
+//
+// Before Go 1.8, there's no quiet way to do this, so HTTP/1.x connections are
+// hijacked and closed instead. Anything else (like an HTTP/2 stream) falls
+// back to a panic, which net/http recovers and logs before resetting.
+func abortHandler(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		conn, _, err := hj.Hijack()
+		if err == nil {
+			conn.Close()
+			return
+		}
+	}
+	panic(errors.New("response aborted"))
+}
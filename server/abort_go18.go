@@ -0,0 +1,13 @@
+//go:build go1.8
+// +build go1.8
+
+package server
+
+import "net/http"
+
+// abortHandler aborts the response being written to w. The panic is
+// recovered by net/http, which closes the connection (or resets the HTTP/2
+// stream) without logging a stack trace.
+func abortHandler(w http.ResponseWriter) {
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAbortResponse(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "12")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		s.abortResponse(w, &clientWriter{w: w}, "remote:hello.txt", errors.New("connection reset"))
+	}))
+	defer server.Close()
+
+	// The client gets the start of the body, but can tell that it's
+	// incomplete.
+	resp, err := http.Get(server.URL)
+	if assert.NoError(t, err) {
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Error(t, err)
+		assert.Equal(t, "hello", string(content))
+	}
+	assert.Equal(t, int64(1), s.AbortedResponses())
+	assert.Equal(t, int64(0), s.ClientAbortedResponses())
+}
+
+func TestAbortResponseForClient(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	// Responses cut off because the client went away are counted
+	// separately from those cut off because of a problem reading the file.
+	func() {
+		defer func() { recover() }()
+
+		w := httptest.NewRecorder()
+		body := &clientWriter{w: failingWriter{}}
+		_, err := body.Write([]byte("hello"))
+		s.abortResponse(w, body, "remote:hello.txt", err)
+	}()
+	assert.Equal(t, int64(0), s.AbortedResponses())
+	assert.Equal(t, int64(1), s.ClientAbortedResponses())
+}
+
+// failingWriter is a client that's gone away.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// archiveFormat is a way of bundling many objects into a single download.
+type archiveFormat struct {
+	contentType string
+	extension   string
+
+	// newWriter wraps the response in an archiveWriter.
+	newWriter func(w io.Writer) archiveWriter
+}
+
+// archiveWriter writes objects into an archive.
+type archiveWriter interface {
+	// Create adds an entry for an object to the archive under the given name
+	// and returns a writer that the object's contents should be written to
+	// before the next call to Create or Close.
+	Create(name string, obj fs.Object) (io.Writer, error)
+
+	// Close finishes the archive. It doesn't close the underlying writer.
+	Close() error
+}
+
+// archiveFormats are the formats that can be requested with an archive
+// parameter.
+var archiveFormats = map[string]*archiveFormat{
+	"tar.gz": {
+		contentType: "application/gzip",
+		extension:   ".tar.gz",
+		newWriter: func(w io.Writer) archiveWriter {
+			gw := gzip.NewWriter(w)
+			return &tarArchiveWriter{gw: gw, tw: tar.NewWriter(gw)}
+		},
+	},
+	"zip": {
+		contentType: "application/zip",
+		extension:   ".zip",
+		newWriter: func(w io.Writer) archiveWriter {
+			return &zipArchiveWriter{zw: zip.NewWriter(w)}
+		},
+	},
+}
+
+// serveArchive streams every object under a prefix-scoped link's directory as
+// a single archive.
+//
+// Objects are written into the archive as they're listed, so nothing is
+// staged to disk and memory use doesn't grow with the size of the directory.
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request, link *link) {
+	formatName := link.params.Get("archive")
+	format, ok := archiveFormats[formatName]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Unsupported archive format: " + formatName))
+		return
+	}
+
+	rclonePath := link.remote + ":" + link.path
+
+	root, rel := splitRoot(link.path)
+	f, err := s.fsCache.Get(link.remote, root)
+	if err != nil {
+		s.logf("Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(""))
+		return
+	}
+
+	// Listed objects are relative to the Fs's root, so their names in the
+	// archive are taken relative to the directory within it.
+	dir := strings.TrimSuffix(link.path, "/")
+	listDir := strings.TrimSuffix(rel, "/")
+	list := fs.NewLister().SetLevel(-1).Start(f, listDir)
+	defer abortListing(list)
+
+	// Pull the first object before writing anything so that a missing
+	// directory or bad credentials can still produce a proper error.
+	obj, err := list.GetObject()
+
+	if err == fs.ErrorDirNotFound {
+		if s.opts.Verbose {
+			s.logf("No such directory")
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No such directory"))
+		return
+	} else if err != nil {
+		if isAuthError(err) {
+			s.fsCache.Invalidate(link.remote, root, f)
+		}
+
+		s.logf("Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(""))
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition",
+		link.contentDisposition(path.Base(dir)+format.extension))
+
+	if r.Method == "HEAD" {
+		s.logf("Serving archive HEAD: %s", rclonePath)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	finish, ok := s.beginDownload(w, link, wholeDownload)
+	if !ok {
+		return
+	}
+
+	s.logf("Serving archive: %s (%s)", rclonePath, formatName)
+	w.WriteHeader(http.StatusOK)
+
+	body := &clientWriter{w: w}
+	aw := format.newWriter(body)
+	numObjects := 0
+	for ; obj != nil && err == nil; obj, err = list.GetObject() {
+		name := obj.Remote()
+		if listDir != "" {
+			name = strings.TrimPrefix(name, listDir+"/")
+		}
+		if s.opts.Verbose {
+			s.logf("Adding to archive: %s", name)
+		}
+
+		var entry io.Writer
+		entry, err = aw.Create(name, obj)
+		if err != nil {
+			break
+		}
+
+		err = s.copyObject(entry, obj)
+		if err != nil {
+			break
+		}
+		numObjects++
+	}
+	if err == nil {
+		err = aw.Close()
+	}
+	if err != nil {
+		finish(0)
+		s.abortResponse(w, body, rclonePath, err)
+		return
+	}
+
+	finish(wholeDownload.bytes)
+	s.logf("Successfully served archive: %s (%v objects)", rclonePath, numObjects)
+}
+
+// abortListing stops a listing, draining any remaining results so that the
+// goroutines producing them don't block forever. It's safe to call on a
+// listing that's already finished.
+func abortListing(list *fs.Lister) {
+	go func() {
+		for {
+			obj, dir, err := list.Get()
+			if obj == nil && dir == nil && err == nil {
+				return
+			}
+		}
+	}()
+	list.Finished()
+}
+
+// copyObject copies the whole of an object to w. Like copyRange, it resumes
+// the read if it fails partway through, except for objects whose size isn't
+// known, since there's no telling whether their streams ended early.
+func (s *Server) copyObject(w io.Writer, obj fs.Object) (err error) {
+	if obj.Size() >= 0 {
+		_, err = s.copyRange(w, obj, httpRange{start: 0, length: obj.Size()})
+		return err
+	}
+
+	in, err := obj.Open()
+	if err != nil {
+		return err
+	}
+	defer fs.CheckClose(in, &err)
+
+	_, err = io.Copy(w, in)
+	return err
+}
+
+type tarArchiveWriter struct {
+	gw *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarArchiveWriter) Create(name string, obj fs.Object) (io.Writer, error) {
+	// Tar needs to know an entry's size before its contents are written.
+	if obj.Size() < 0 {
+		return nil, fmt.Errorf("can't add %s to tar archive because its size is unknown", name)
+	}
+
+	err := a.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     obj.Size(),
+		ModTime:  obj.ModTime(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.tw, nil
+}
+
+func (a *tarArchiveWriter) Close() error {
+	err := a.tw.Close()
+	if err != nil {
+		return err
+	}
+	return a.gw.Close()
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) Create(name string, obj fs.Object) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Deflate,
+	}
+	header.SetModTime(obj.ModTime())
+
+	return a.zw.CreateHeader(header)
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// addToArchive adds an entry with the given contents to an archive.
+func addToArchive(t *testing.T, aw archiveWriter, name, content string) {
+	w, err := aw.Create(name, &fakeObject{content: content})
+	assert.NoError(t, err)
+	_, err = io.WriteString(w, content)
+	assert.NoError(t, err)
+}
+
+// readTestZip returns the contents of each file in a zip archive, keyed by
+// name.
+func readTestZip(t *testing.T, archive []byte) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		content, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		rc.Close()
+
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+func TestZipArchiveWriter(t *testing.T) {
+	var buf bytes.Buffer
+	aw := archiveFormats["zip"].newWriter(&buf)
+	addToArchive(t, aw, "a.txt", "hello")
+	addToArchive(t, aw, "sub/b.txt", "world")
+	assert.NoError(t, aw.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	assert.Len(t, zr.File, 2)
+	assert.Equal(t, "sub/b.txt", zr.File[1].Name)
+
+	rc, err := zr.File[1].Open()
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(content))
+}
+
+func TestTarArchiveWriter(t *testing.T) {
+	var buf bytes.Buffer
+	aw := archiveFormats["tar.gz"].newWriter(&buf)
+	addToArchive(t, aw, "a.txt", "hello")
+	assert.NoError(t, aw.Close())
+
+	gr, err := gzip.NewReader(&buf)
+	assert.NoError(t, err)
+	tr := tar.NewReader(gr)
+
+	header, err := tr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", header.Name)
+	assert.Equal(t, int64(5), header.Size)
+
+	content, err := ioutil.ReadAll(tr)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCopyObject(t *testing.T) {
+	defer func(backoff time.Duration) { resumeBackoff = backoff }(resumeBackoff)
+	resumeBackoff = 0
+
+	s := newTestServer(t)
+	defer s.Close()
+
+	// Reads of objects going into archives are resumed like any others.
+	var buf bytes.Buffer
+	obj := &flakyObject{fakeObject: fakeObject{content: "hello, world"}, failAfter: 5, failures: 1}
+	assert.NoError(t, s.copyObject(&buf, obj))
+	assert.Equal(t, "hello, world", buf.String())
+	assert.Equal(t, 2, obj.opens)
+}
+
+func TestServeArchive(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{
+		"photos/a.jpg":       "a",
+		"photos/beach/b.jpg": "bb",
+		"secrets/c.jpg":      "ccc",
+	})
+
+	w := serveTest(s, "GET", signTestIndexPath(t, "photos/")+"&archive=zip", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="photos.zip"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, map[string]string{
+		"a.jpg":       "a",
+		"beach/b.jpg": "bb",
+	}, readTestZip(t, w.Body.Bytes()))
+
+	// Names are relative to the directory being archived.
+	w = serveTest(s, "GET", signTestIndexPath(t, "photos/beach/")+"&archive=zip", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]string{"b.jpg": "bb"}, readTestZip(t, w.Body.Bytes()))
+
+	w = serveTest(s, "GET", signTestIndexPath(t, "photos/")+"&archive=tar.gz", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	gr, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	tr := tar.NewReader(gr)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{"a.jpg", "beach/b.jpg"}, names)
+
+	w = serveTest(s, "GET", signTestIndexPath(t, "photos/missing/")+"&archive=zip", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "No such directory", w.Body.String())
+
+	w = serveTest(s, "GET", signTestIndexPath(t, "photos/")+"&archive=rar", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Unsupported archive format: rar", w.Body.String())
+}
+
+func TestServeArchiveHEAD(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{"photos/a.jpg": "a"})
+
+	w := serveTest(s, "HEAD", signTestIndexPath(t, "photos/")+"&archive=zip", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="photos.zip"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "", w.Body.String())
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/ncw/rclone/fs"
+)
+
+// bundleEntry is an object in a bundle along with the name it's given in the
+// archive.
+type bundleEntry struct {
+	name          string
+	remoteAndPath string
+	obj           fs.Object
+}
+
+// serveBundle streams the objects listed in a bundle link's manifest as a
+// single zip archive.
+//
+// The manifest travels in the link's "bundle" parameter, which is covered by
+// the signature like any other parameter, so the set of objects can't be
+// changed without invalidating the link.
+func (s *Server) serveBundle(w http.ResponseWriter, r *http.Request, link *link) {
+	if link.version != common.MessageVersion || link.prefix != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bundle links must be v" + common.MessageVersion + " and can't have a prefix"))
+		return
+	}
+
+	encoded, ok := getParam(w, r, "bundle")
+	if !ok {
+		return
+	}
+
+	remoteAndPaths, err := common.DecodeBundle(encoded)
+	if err != nil {
+		s.writeLinkError(w, link.opaque, http.StatusBadRequest, "Invalid bundle", err.Error())
+		return
+	}
+
+	// Look up every object before writing anything so that a missing one can
+	// still produce a proper error.
+	names := bundleNames(remoteAndPaths)
+	entries := make([]bundleEntry, len(remoteAndPaths))
+	for i, remoteAndPath := range remoteAndPaths {
+		remote, p, _ := common.SplitRemotePath(remoteAndPath)
+
+		if !s.opts.Remotes.Configured(remote) {
+			s.writeLinkError(w, link.opaque, http.StatusBadRequest, "Remote not configured in server environment",
+				"Remote "+remote+" not configured in server environment")
+			return
+		}
+
+		obj, err := s.newObject(remote, p)
+
+		if err == fs.ErrorObjectNotFound || err == fs.ErrorDirNotFound {
+			if s.opts.Verbose {
+				s.logf("No such object: %s", remoteAndPath)
+			}
+
+			s.writeLinkError(w, link.opaque, http.StatusNotFound, "No such object", "No such object: "+remoteAndPath)
+			return
+		} else if err != nil {
+			s.logf("Error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(""))
+			return
+		}
+
+		entries[i] = bundleEntry{name: names[i], remoteAndPath: remoteAndPath, obj: obj}
+	}
+
+	w.Header().Set("Content-Type", archiveFormats["zip"].contentType)
+	w.Header().Set("Content-Disposition", link.contentDisposition(link.path))
+
+	if r.Method == "HEAD" {
+		s.logf("Serving bundle HEAD: %v objects", len(entries))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	finish, ok := s.beginDownload(w, link, wholeDownload)
+	if !ok {
+		return
+	}
+
+	s.logf("Serving bundle: %v objects", len(entries))
+	w.WriteHeader(http.StatusOK)
+
+	body := &clientWriter{w: w}
+	aw := archiveFormats["zip"].newWriter(body)
+	for _, entry := range entries {
+		if s.opts.Verbose {
+			s.logf("Adding to bundle: %s as %s", entry.remoteAndPath, entry.name)
+		}
+
+		var part io.Writer
+		part, err = aw.Create(entry.name, entry.obj)
+		if err != nil {
+			break
+		}
+
+		err = s.copyObject(part, entry.obj)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = aw.Close()
+	}
+	if err != nil {
+		finish(0)
+		s.abortResponse(w, body, "bundle", err)
+		return
+	}
+
+	finish(wholeDownload.bytes)
+	s.logf("Successfully served bundle: %v objects", len(entries))
+}
+
+// bundleNames picks a name in the archive for each of a bundle's objects.
+// Objects are named after their base name, and a counter is added to the names
+// of any that collide, like "report (2).pdf".
+func bundleNames(remoteAndPaths []string) []string {
+	names := make([]string, len(remoteAndPaths))
+	taken := make(map[string]bool)
+
+	for i, remoteAndPath := range remoteAndPaths {
+		base := path.Base(remoteAndPath[strings.Index(remoteAndPath, ":")+1:])
+		ext := path.Ext(base)
+		stem := strings.TrimSuffix(base, ext)
+
+		name := base
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+		}
+
+		taken[name] = true
+		names[i] = name
+	}
+
+	return names
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// signTestBundlePath signs a link to a bundle of the given objects.
+func signTestBundlePath(t *testing.T, remoteAndPaths ...string) string {
+	return signTestPath(t, common.BundleRemote, "bundle.zip", url.Values{
+		"v":      {"2"},
+		"bundle": {common.EncodeBundle(remoteAndPaths)},
+	})
+}
+
+func TestBundleNames(t *testing.T) {
+	assert.Equal(t,
+		[]string{"raft.pdf", "raft (2).pdf", "notes", "raft (3).pdf", "notes (2)"},
+		bundleNames([]string{
+			"remote:papers/raft.pdf",
+			"other:raft.pdf",
+			"remote:notes",
+			"remote:old/raft.pdf",
+			"other:a:b/notes",
+		}))
+}
+
+func TestServeBundle(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{
+		"papers/raft.pdf":  "raft",
+		"papers/paxos.pdf": "paxos",
+		"old/raft.pdf":     "old raft",
+	})
+
+	w := serveTest(s, "GET", signTestBundlePath(t,
+		"remote:papers/raft.pdf", "remote:papers/paxos.pdf", "remote:old/raft.pdf"), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="bundle.zip"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, map[string]string{
+		"raft.pdf":     "raft",
+		"paxos.pdf":    "paxos",
+		"raft (2).pdf": "old raft",
+	}, readTestZip(t, w.Body.Bytes()))
+
+	// Nothing is sent if any of the objects is missing.
+	w = serveTest(s, "GET", signTestBundlePath(t,
+		"remote:papers/raft.pdf", "remote:papers/missing.pdf"), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "No such object: remote:papers/missing.pdf", w.Body.String())
+
+	w = serveTest(s, "GET", signTestBundlePath(t, "unknown:papers/raft.pdf"), nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Remote unknown not configured in server environment", w.Body.String())
+}
+
+func TestServeBundleHEAD(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{"papers/raft.pdf": "raft"})
+
+	w := serveTest(s, "HEAD", signTestBundlePath(t, "remote:papers/raft.pdf"), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Equal(t, "", w.Body.String())
+
+	// Missing objects are found without downloading anything.
+	w = serveTest(s, "HEAD", signTestBundlePath(t, "remote:papers/missing.pdf"), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
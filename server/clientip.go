@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP works out the address of the client that made a request, or
+// returns nil if it can't be determined.
+//
+// Proxies add the address that they received a request from to the given
+// header, either Forwarded or X-Forwarded-For. Starting from the address that
+// connected to us, we walk back through those addresses for as long as the
+// one that we're on belongs to a trusted proxy. Anything before that could
+// have been made up by the client, so it's never believed.
+//
+// The other header is never read, because proxies pass it through untouched
+// and all of it could have come from the client.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet, header string) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	hops := forwardedFor(r, header)
+	for i := len(hops) - 1; i >= 0 && ipNetsContain(trustedProxies, ip); i-- {
+		ip = parseForwardedAddr(hops[i])
+		if ip == nil {
+			// A trusted proxy hid or didn't know the address before it.
+			return nil
+		}
+	}
+
+	return ip
+}
+
+// forwardedFor returns the addresses in the given forwarding header that a
+// request was forwarded for, oldest first.
+func forwardedFor(r *http.Request, header string) []string {
+	var hops []string
+
+	if header == "Forwarded" {
+		for _, value := range r.Header["Forwarded"] {
+			for _, element := range strings.Split(value, ",") {
+				hop := ""
+				for _, pair := range strings.Split(element, ";") {
+					parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+					if len(parts) == 2 && strings.EqualFold(parts[0], "for") {
+						hop = strings.Trim(parts[1], `"`)
+					}
+				}
+
+				// Keep elements without an address so that they can't be
+				// skipped over.
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+
+	for _, value := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseForwardedAddr parses an address from a forwarding header, which may
+// include a port and, for IPv6, brackets. nil is returned for anything else,
+// like the "unknown" and obfuscated identifiers of the Forwarded header.
+func parseForwardedAddr(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// ipNetsContain returns whether any of the given blocks contains an address.
+func ipNetsContain(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, err := common.ParseIPNets("10.0.0.0/8,2001:db8::1")
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		remoteAddr      string
+		forwardedHeader string
+		header          http.Header
+		expected        string
+	}{
+		// Headers are ignored unless they come from a trusted proxy.
+		{"203.0.113.9:1234", "X-Forwarded-For", nil, "203.0.113.9"},
+		{"203.0.113.9:1234", "X-Forwarded-For", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.9"},
+
+		// Addresses added by the client before it reached a trusted proxy
+		// aren't believed.
+		{"10.1.2.3:1234", "X-Forwarded-For", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"10.1.2.3:1234", "X-Forwarded-For", http.Header{"X-Forwarded-For": {"192.0.2.7, 198.51.100.1"}}, "198.51.100.1"},
+		{"10.1.2.3:1234", "X-Forwarded-For", http.Header{"X-Forwarded-For": {"192.0.2.7, 198.51.100.1, 10.4.5.6"}}, "198.51.100.1"},
+		{"10.1.2.3:1234", "X-Forwarded-For", nil, "10.1.2.3"},
+
+		{"[2001:db8::1]:1234", "Forwarded", http.Header{"Forwarded": {`for="[2001:db8::2]:4711";proto=https`}}, "2001:db8::2"},
+		{"10.1.2.3:1234", "Forwarded", http.Header{"Forwarded": {"for=192.0.2.7, for=198.51.100.1"}}, "198.51.100.1"},
+		{"10.1.2.3:1234", "Forwarded", http.Header{"Forwarded": {"for=unknown"}}, ""},
+		{"10.1.2.3:1234", "Forwarded", http.Header{"Forwarded": {"for=198.51.100.1, proto=https"}}, ""},
+
+		// Only the header that the proxies set is read, so a client can't
+		// pass off an address in the other one as its own.
+		{"10.1.1.1:1234", "X-Forwarded-For", http.Header{
+			"X-Forwarded-For": {"203.0.113.66"},
+			"Forwarded":       {"for=198.51.100.7"},
+		}, "203.0.113.66"},
+		{"10.1.1.1:1234", "Forwarded", http.Header{
+			"X-Forwarded-For": {"198.51.100.7"},
+			"Forwarded":       {"for=203.0.113.66"},
+		}, "203.0.113.66"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for name, values := range tc.header {
+			r.Header[name] = values
+		}
+
+		ip := clientIP(r, trustedProxies, tc.forwardedHeader)
+		if tc.expected == "" {
+			assert.Nil(t, ip, "%+v", tc)
+		} else {
+			assert.Equal(t, tc.expected, ip.String(), "%+v", tc)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// etagHashTypes are the hash types that we'll try to derive an entity tag from,
+// in order of preference.
+var etagHashTypes = []fs.HashType{fs.HashMD5, fs.HashSHA1}
+
+// checkIfRange returns whether a Range header should be honored given the
+// request's If-Range precondition (if any).
+func checkIfRange(r *http.Request, etag string, modTime time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+
+	// If-Range requires a strong comparison, so weak tags never match.
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return ir == etag
+	}
+
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+
+	// HTTP dates only have second precision.
+	return modTime.Truncate(time.Second).Equal(t)
+}
+
+// checkPreconditionFailed returns whether the request's If-Match or
+// If-Unmodified-Since preconditions show that the client expected a
+// different version of an object, in which case a 412 should be sent.
+func checkPreconditionFailed(r *http.Request, etag string, modTime time.Time) bool {
+	// If-Match takes precedence over If-Unmodified-Since when both are
+	// present.
+	if im := r.Header.Get("If-Match"); im != "" {
+		return !etagListMatch(im, etag, true)
+	}
+
+	ius := r.Header.Get("If-Unmodified-Since")
+	if ius == "" {
+		return false
+	}
+
+	t, err := http.ParseTime(ius)
+	if err != nil {
+		return false
+	}
+
+	return modTime.Truncate(time.Second).After(t)
+}
+
+// checkNotModified returns whether the request's If-None-Match or
+// If-Modified-Since preconditions show that the client already has the
+// current version of an object, in which case a 304 should be sent.
+func checkNotModified(r *http.Request, etag string, modTime time.Time) bool {
+	// If-None-Match takes precedence over If-Modified-Since when both are
+	// present.
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatch(inm, etag, false)
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" {
+		return false
+	}
+
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+
+	return !modTime.Truncate(time.Second).After(t)
+}
+
+// etagListMatch returns whether etag matches any of the tags in a
+// comma-separated If-Match or If-None-Match list. If-Match uses the strong
+// comparison function, under which weak tags never match, and If-None-Match
+// uses the weak one.
+func etagListMatch(list, etag string, strong bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strong {
+			if candidate == etag && !strings.HasPrefix(etag, "W/") {
+				return true
+			}
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// objectETag derives a strong entity tag for an object.
+//
+// It's built from a checksum if the object's backend can provide one, and
+// otherwise from its size and modification time.
+func objectETag(obj fs.Object) string {
+	hashes := obj.Fs().Hashes()
+	for _, hashType := range etagHashTypes {
+		if !hashes.Contains(hashType) {
+			continue
+		}
+
+		sum, err := obj.Hash(hashType)
+		if err == nil && sum != "" {
+			return `"` + sum + `"`
+		}
+	}
+
+	return fmt.Sprintf(`"%x-%x"`, obj.Size(), obj.ModTime().UnixNano())
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckIfRange(t *testing.T) {
+	modTime := time.Date(2017, 1, 12, 10, 7, 46, 500, time.UTC)
+	etag := `"abc"`
+
+	r, _ := http.NewRequest("GET", "/remote/file", nil)
+	assert.True(t, checkIfRange(r, etag, modTime))
+
+	r.Header.Set("If-Range", modTime.Format(http.TimeFormat))
+	assert.True(t, checkIfRange(r, etag, modTime))
+
+	r.Header.Set("If-Range", modTime.Add(-time.Hour).Format(http.TimeFormat))
+	assert.False(t, checkIfRange(r, etag, modTime))
+
+	r.Header.Set("If-Range", `"abc"`)
+	assert.True(t, checkIfRange(r, etag, modTime))
+
+	r.Header.Set("If-Range", `W/"abc"`)
+	assert.False(t, checkIfRange(r, etag, modTime))
+
+	r.Header.Set("If-Range", `"def"`)
+	assert.False(t, checkIfRange(r, etag, modTime))
+}
+
+func TestCheckNotModified(t *testing.T) {
+	modTime := time.Date(2017, 1, 12, 10, 7, 46, 500, time.UTC)
+	etag := `"abc"`
+
+	r, _ := http.NewRequest("GET", "/remote/file", nil)
+	assert.False(t, checkNotModified(r, etag, modTime))
+
+	r.Header.Set("If-Modified-Since", modTime.Format(http.TimeFormat))
+	assert.True(t, checkNotModified(r, etag, modTime))
+
+	r.Header.Set("If-Modified-Since", modTime.Add(-time.Hour).Format(http.TimeFormat))
+	assert.False(t, checkNotModified(r, etag, modTime))
+
+	// If-None-Match takes precedence.
+	r.Header.Set("If-Modified-Since", modTime.Format(http.TimeFormat))
+	r.Header.Set("If-None-Match", `"def"`)
+	assert.False(t, checkNotModified(r, etag, modTime))
+
+	r.Header.Set("If-None-Match", `"def", W/"abc"`)
+	assert.True(t, checkNotModified(r, etag, modTime))
+
+	r.Header.Set("If-None-Match", "*")
+	assert.True(t, checkNotModified(r, etag, modTime))
+}
+
+func TestCheckPreconditionFailed(t *testing.T) {
+	modTime := time.Date(2017, 1, 12, 10, 7, 46, 500, time.UTC)
+	etag := `"abc"`
+
+	r, _ := http.NewRequest("GET", "/remote/file", nil)
+	assert.False(t, checkPreconditionFailed(r, etag, modTime))
+
+	r.Header.Set("If-Unmodified-Since", modTime.Format(http.TimeFormat))
+	assert.False(t, checkPreconditionFailed(r, etag, modTime))
+
+	r.Header.Set("If-Unmodified-Since", modTime.Add(-time.Hour).Format(http.TimeFormat))
+	assert.True(t, checkPreconditionFailed(r, etag, modTime))
+
+	// If-Match takes precedence.
+	r.Header.Set("If-Match", `"def", "abc"`)
+	assert.False(t, checkPreconditionFailed(r, etag, modTime))
+
+	r.Header.Set("If-Match", `W/"abc"`)
+	assert.True(t, checkPreconditionFailed(r, etag, modTime))
+
+	r.Header.Set("If-Match", "*")
+	assert.False(t, checkPreconditionFailed(r, etag, modTime))
+}
+
+func TestServeHTTPConditional(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{"file.txt": "hello, world"})
+	target := signTestPath(t, "remote", "file.txt", url.Values{"v": {"2"}})
+
+	w := serveTest(s, "GET", target, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	lastModified := w.Header().Get("Last-Modified")
+	assert.NotEqual(t, "", etag)
+	assert.Equal(t, "Thu, 12 Jan 2017 10:07:46 GMT", lastModified)
+
+	for _, header := range []http.Header{
+		{"If-None-Match": {etag}},
+		{"If-Modified-Since": {lastModified}},
+	} {
+		w = serveTest(s, "GET", target, header)
+		assert.Equal(t, http.StatusNotModified, w.Code, "%v", header)
+		assert.Equal(t, etag, w.Header().Get("ETag"), "%v", header)
+		assert.Equal(t, "", w.Body.String(), "%v", header)
+	}
+
+	for _, header := range []http.Header{
+		{"If-Match": {`"stale"`}},
+		{"If-Unmodified-Since": {"Wed, 11 Jan 2017 10:07:46 GMT"}},
+	} {
+		w = serveTest(s, "GET", target, header)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code, "%v", header)
+		assert.Equal(t, "", w.Body.String(), "%v", header)
+	}
+
+	w = serveTest(s, "GET", target, http.Header{"If-Match": {etag}, "If-None-Match": {`"stale"`}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello, world", w.Body.String())
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strings"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// digestHashTypes are the hash types that are sent as digests of an object if
+// its backend provides them, along with their names in the Digest (RFC 3230)
+// and Repr-Digest (RFC 9530) headers.
+var digestHashTypes = []struct {
+	hashType   fs.HashType
+	digestName string
+	reprName   string
+}{
+	{fs.HashMD5, "MD5", "md5"},
+	{fs.HashSHA1, "SHA", "sha"},
+}
+
+// objectDigest is a checksum of the whole of an object.
+type objectDigest struct {
+	digestName string
+	reprName   string
+	sum        []byte
+}
+
+// objectDigests returns the checksums of an object that its backend can
+// provide. It's empty if there are none.
+func objectDigests(obj fs.Object) []objectDigest {
+	var digests []objectDigest
+
+	hashes := obj.Fs().Hashes()
+	for _, dt := range digestHashTypes {
+		if !hashes.Contains(dt.hashType) {
+			continue
+		}
+
+		sum, err := obj.Hash(dt.hashType)
+		if err != nil || sum == "" {
+			continue
+		}
+
+		raw, err := hex.DecodeString(sum)
+		if err != nil {
+			continue
+		}
+
+		digests = append(digests, objectDigest{dt.digestName, dt.reprName, raw})
+	}
+
+	return digests
+}
+
+// setDigestHeaders sets the Digest and Repr-Digest headers from an object's
+// checksums. They describe the whole object, so they're sent with responses
+// to range requests as well, but Content-MD5 describes the body of the
+// response and is only sent when that's the whole object.
+func setDigestHeaders(header http.Header, digests []objectDigest, whole bool) {
+	if len(digests) == 0 {
+		return
+	}
+
+	var digest, repr []string
+	for _, d := range digests {
+		sum := base64.StdEncoding.EncodeToString(d.sum)
+		digest = append(digest, d.digestName+"="+sum)
+		repr = append(repr, d.reprName+"=:"+sum+":")
+
+		if whole && d.digestName == "MD5" {
+			header.Set("Content-MD5", sum)
+		}
+	}
+
+	header.Set("Digest", strings.Join(digest, ","))
+	header.Set("Repr-Digest", strings.Join(repr, ", "))
+}
+
+// trailerDigest computes a SHA-256 digest of an object while it's streamed,
+// to be sent as a Repr-Digest trailer for backends that can't provide a
+// checksum up front.
+type trailerDigest struct {
+	hash hash.Hash
+}
+
+func newTrailerDigest() *trailerDigest {
+	return &trailerDigest{hash: sha256.New()}
+}
+
+// announce declares the trailer. It has to be called before the response's
+// header is written. Trailers can only follow a chunked body in HTTP/1.1, so
+// the response's Content-Length is dropped.
+func (t *trailerDigest) announce(header http.Header) {
+	header.Set("Trailer", "Repr-Digest")
+	header.Del("Content-Length")
+}
+
+// set sets the trailer once the whole object has been written through
+// t.hash.
+func (t *trailerDigest) set(header http.Header) {
+	header.Set("Repr-Digest",
+		"sha-256=:"+base64.StdEncoding.EncodeToString(t.hash.Sum(nil))+":")
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectDigests(t *testing.T) {
+	obj := &fakeObject{
+		fs:      &fakeFs{hashes: fs.NewHashSet(fs.HashMD5, fs.HashSHA1)},
+		content: "hello",
+	}
+
+	header := http.Header{}
+	setDigestHeaders(header, objectDigests(obj), true)
+	assert.Equal(t, "XUFAKrxLKna5cZ2REBfFkg==", header.Get("Content-MD5"))
+	assert.Equal(t, "MD5=XUFAKrxLKna5cZ2REBfFkg==,SHA=qvTGHdzF6KLavt4PO0gs2a6pQ00=",
+		header.Get("Digest"))
+	assert.Equal(t, "md5=:XUFAKrxLKna5cZ2REBfFkg==:, sha=:qvTGHdzF6KLavt4PO0gs2a6pQ00=:",
+		header.Get("Repr-Digest"))
+
+	// Content-MD5 covers only the body, so it's left out of partial
+	// responses.
+	header = http.Header{}
+	setDigestHeaders(header, objectDigests(obj), false)
+	assert.Equal(t, "", header.Get("Content-MD5"))
+	assert.NotEqual(t, "", header.Get("Repr-Digest"))
+
+	obj.fs.hashes = fs.NewHashSet(fs.HashSHA1)
+	header = http.Header{}
+	setDigestHeaders(header, objectDigests(obj), true)
+	assert.Equal(t, "", header.Get("Content-MD5"))
+	assert.Equal(t, "SHA=qvTGHdzF6KLavt4PO0gs2a6pQ00=", header.Get("Digest"))
+
+	obj.fs.hashes = fs.NewHashSet()
+	assert.Empty(t, objectDigests(obj))
+	header = http.Header{}
+	setDigestHeaders(header, nil, true)
+	assert.Empty(t, header)
+}
+
+func TestTrailerDigest(t *testing.T) {
+	header := http.Header{"Content-Length": {"5"}}
+	trailer := newTrailerDigest()
+	trailer.announce(header)
+	assert.Equal(t, "Repr-Digest", header.Get("Trailer"))
+	assert.Equal(t, "", header.Get("Content-Length"))
+
+	trailer.hash.Write([]byte("hello"))
+	trailer.set(header)
+	assert.Equal(t, "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:",
+		header.Get("Repr-Digest"))
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// contentDisposition builds a Content-Disposition header value as described by
+// RFC 6266. The filename is included as a quoted ASCII fallback for older
+// clients and, if it contains anything else, also encoded as per RFC 5987.
+func contentDisposition(disposition, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+
+	var fallback []rune
+	ascii := true
+	for _, c := range filename {
+		switch {
+		case c < 0x20 || c == 0x7F || c > 0x7E:
+			ascii = false
+			fallback = append(fallback, '_')
+		case c == '"' || c == '\\':
+			fallback = append(fallback, '\\', c)
+		default:
+			fallback = append(fallback, c)
+		}
+	}
+
+	value := fmt.Sprintf(`%s; filename="%s"`, disposition, string(fallback))
+	if !ascii {
+		value += "; filename*=UTF-8''" + encodeExtValue(filename)
+	}
+	return value
+}
+
+// encodeExtValue percent-encodes a string's UTF-8 bytes for use in an RFC 5987
+// ext-value, leaving only attr-chars unescaped.
+func encodeExtValue(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentDisposition(t *testing.T) {
+	assert.Equal(t, "attachment", contentDisposition("attachment", ""))
+	assert.Equal(t, `attachment; filename="trip.zip"`,
+		contentDisposition("attachment", "trip.zip"))
+	assert.Equal(t, `inline; filename="a \"quoted\" name.pdf"`,
+		contentDisposition("inline", `a "quoted" name.pdf`))
+	assert.Equal(t, `attachment; filename="R_sum_ (1).pdf"; filename*=UTF-8''R%C3%A9sum%C3%A9%20%281%29.pdf`,
+		contentDisposition("attachment", "Résumé (1).pdf"))
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// downloadStore counts how much of their downloads links with a download
+// limit have used.
+//
+// Every response that sends part of a file uses up that part of a download, so
+// a file fetched in several ranges (in parallel, or resumed after being
+// interrupted) adds up to a single download, while fetching it again in any
+// way counts again. Archives and bundles, whose size isn't known up front,
+// use up a whole download when they complete.
+//
+// Links are keyed by their digests rather than their signatures, so that
+// re-encoding a link's signature (see common.LinkDigest) doesn't start a new
+// count.
+//
+// Counts are kept in memory and every response is appended to a file as a
+// line of JSON, so they survive restarts. Entries for links that have expired
+// are dropped when the file is loaded.
+type downloadStore struct {
+	logger Logger
+	now    func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	counts map[string]*big.Rat
+
+	// reserved counts parts of downloads that are being sent. They're taken
+	// into account so that concurrent requests can't go over a link's limit.
+	reserved map[string]*big.Rat
+}
+
+// downloadPart is the part of a download that a response sends: a number of
+// bytes out of a file of the given size.
+type downloadPart struct {
+	bytes, size int64
+}
+
+// wholeDownload is a part that makes up a whole download.
+var wholeDownload = downloadPart{bytes: 1, size: 1}
+
+// rat returns the fraction of a download that a part makes up. A response
+// for an empty file is a whole download.
+func (p downloadPart) rat() *big.Rat {
+	if p.size <= 0 {
+		return big.NewRat(1, 1)
+	}
+	return big.NewRat(p.bytes, p.size)
+}
+
+// downloadRecord is a line of a download store's file. Each represents a
+// response that sent part of a download. Records from before parts were
+// counted don't have a size, and represent a whole download.
+type downloadRecord struct {
+	Key       string `json:"key"`
+	ExpiresAt int64  `json:"expires_at"`
+	Bytes     int64  `json:"bytes,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+}
+
+func (r downloadRecord) part() downloadPart {
+	if r.Size == 0 {
+		return wholeDownload
+	}
+	return downloadPart{bytes: r.Bytes, size: r.Size}
+}
+
+// openDownloadStore loads the download store in the file at the given path,
+// creating it if it doesn't exist.
+func openDownloadStore(path string, logger Logger) (*downloadStore, error) {
+	s := &downloadStore{
+		logger:   logger,
+		now:      time.Now,
+		counts:   make(map[string]*big.Rat),
+		reserved: make(map[string]*big.Rat),
+	}
+
+	records, err := s.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rewrite the file with only the records that are still needed so that
+	// it doesn't grow forever.
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		err = enc.Encode(record)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't compact download store: %v", err)
+	}
+
+	s.file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load reads the records of unexpired links from a download store's file and
+// tallies them.
+func (s *downloadStore) load(path string) ([]downloadRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Make sure that the file can be created before we go any further.
+		return nil, os.MkdirAll(filepath.Dir(path), 0700)
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	now := s.now().Unix()
+
+	var records []downloadRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var record downloadRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// A line may have been cut short by a crash. Anything else
+			// in the file is still good.
+			s.logger.Printf("Skipping bad line %v of download store: %v", line, err)
+			continue
+		}
+
+		if record.ExpiresAt < now {
+			continue
+		}
+
+		records = append(records, record)
+		addRat(s.counts, record.Key, record.part().rat())
+	}
+
+	return records, scanner.Err()
+}
+
+// Used returns how many of its downloads a link has used, which may be a
+// fraction.
+func (s *downloadStore) Used(key string) *big.Rat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used := new(big.Rat)
+	if count, ok := s.counts[key]; ok {
+		used.Set(count)
+	}
+	return used
+}
+
+// Reserve takes part of a download for a response that's about to start,
+// returning false if it would go over the link's limit along with what's
+// been used or reserved already. The reservation must be given up with
+// Commit.
+func (s *downloadStore) Reserve(key string, part downloadPart, maxDownloads int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := part.rat()
+	if count, ok := s.counts[key]; ok {
+		total.Add(total, count)
+	}
+	if reserved, ok := s.reserved[key]; ok {
+		total.Add(total, reserved)
+	}
+	if total.Cmp(big.NewRat(int64(maxDownloads), 1)) > 0 {
+		return false
+	}
+
+	addRat(s.reserved, key, part.rat())
+	return true
+}
+
+// Commit gives up a reservation and records the part of a download that was
+// actually sent, which is less than the part that was reserved if the
+// response was cut short.
+func (s *downloadStore) Commit(key string, reserved, sent downloadPart, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addRat(s.reserved, key, new(big.Rat).Neg(reserved.rat()))
+
+	if sent.bytes <= 0 && sent.size > 0 {
+		return nil
+	}
+	addRat(s.counts, key, sent.rat())
+
+	data, err := json.Marshal(downloadRecord{
+		Key:       key,
+		ExpiresAt: expiresAt.Unix(),
+		Bytes:     sent.bytes,
+		Size:      sent.size,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Close closes the store's file.
+func (s *downloadStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// addRat adds x to the value of key in m, removing it if that leaves
+// nothing.
+func addRat(m map[string]*big.Rat, key string, x *big.Rat) {
+	sum, ok := m[key]
+	if !ok {
+		sum = new(big.Rat)
+		m[key] = sum
+	}
+
+	sum.Add(sum, x)
+	if sum.Sign() <= 0 {
+		delete(m, key)
+	}
+}
+
+// checkDownloads makes sure that a link with a download limit has downloads
+// left, writing 410 Gone to the response and returning false if it doesn't.
+func (s *Server) checkDownloads(w http.ResponseWriter, link *link) bool {
+	if link.maxDownloads == 0 {
+		return true
+	}
+
+	if s.downloads == nil {
+		s.logf("Link has a download limit, but no downloads file is configured")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server isn't configured to track downloads"))
+		return false
+	}
+
+	if s.downloads.Used(link.digest()).Cmp(big.NewRat(int64(link.maxDownloads), 1)) >= 0 {
+		writeDownloadsUsed(w)
+		return false
+	}
+
+	return true
+}
+
+// beginDownload reserves the part of one of a link's downloads that a
+// response is about to send. If that would go over the link's limit, 410 Gone
+// is written to the response and false is returned. Otherwise, the returned
+// function must be called with the number of bytes of the part that were
+// actually sent once the response is finished.
+func (s *Server) beginDownload(w http.ResponseWriter, link *link, part downloadPart) (func(sent int64), bool) {
+	if link.maxDownloads == 0 {
+		return func(int64) {}, true
+	}
+
+	key := link.digest()
+	if !s.downloads.Reserve(key, part, link.maxDownloads) {
+		writeDownloadsUsed(w)
+		return nil, false
+	}
+
+	return func(sent int64) {
+		err := s.downloads.Commit(key, part, downloadPart{bytes: sent, size: part.size}, link.expiresAt)
+		if err != nil {
+			s.logf("Error recording download: %v", err)
+		}
+	}, true
+}
+
+func writeDownloadsUsed(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusGone)
+	w.Write([]byte("Link has been used the maximum number of times"))
+}
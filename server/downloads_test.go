@@ -0,0 +1,127 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhttpserve")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "downloads", "downloads.jsonl")
+	expiresAt := time.Now().Add(time.Hour)
+
+	s, err := openDownloadStore(path, stdLogger{})
+	assert.NoError(t, err)
+
+	// Concurrent downloads can't go over the limit.
+	assert.True(t, s.Reserve("a", wholeDownload, 2))
+	assert.True(t, s.Reserve("a", wholeDownload, 2))
+	assert.False(t, s.Reserve("a", downloadPart{bytes: 1, size: 100}, 2))
+
+	// Downloads that don't send anything don't count.
+	assert.NoError(t, s.Commit("a", wholeDownload, downloadPart{bytes: 0, size: 1}, expiresAt))
+	assert.NoError(t, s.Commit("a", wholeDownload, wholeDownload, expiresAt))
+	assert.Equal(t, "1", s.Used("a").RatString())
+
+	// Parts of a file add up, and a response that's cut short only counts
+	// for what it sent.
+	assert.True(t, s.Reserve("a", downloadPart{bytes: 50, size: 100}, 2))
+	assert.True(t, s.Reserve("a", downloadPart{bytes: 50, size: 100}, 2))
+	assert.False(t, s.Reserve("a", downloadPart{bytes: 1, size: 100}, 2))
+	assert.NoError(t, s.Commit("a", downloadPart{bytes: 50, size: 100}, downloadPart{bytes: 50, size: 100}, expiresAt))
+	assert.NoError(t, s.Commit("a", downloadPart{bytes: 50, size: 100}, downloadPart{bytes: 20, size: 100}, expiresAt))
+	assert.Equal(t, "17/10", s.Used("a").RatString())
+	assert.True(t, s.Reserve("a", downloadPart{bytes: 30, size: 100}, 2))
+	assert.NoError(t, s.Commit("a", downloadPart{bytes: 30, size: 100}, downloadPart{bytes: 30, size: 100}, expiresAt))
+	assert.Equal(t, "2", s.Used("a").RatString())
+	assert.False(t, s.Reserve("a", downloadPart{bytes: 1, size: 100}, 2))
+
+	assert.True(t, s.Reserve("b", wholeDownload, 1))
+	assert.NoError(t, s.Commit("b", wholeDownload, wholeDownload, time.Now().Add(-time.Second)))
+
+	// Counts survive a restart, except for those of expired links. A line
+	// that was cut short is skipped, and lines from before parts were counted
+	// are whole downloads.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte(`{"key":"c","expires_at":` + strconv.FormatInt(expiresAt.Unix(), 10) + "}\n"))
+	assert.NoError(t, err)
+	_, err = f.Write([]byte(`{"key":"a","expi`))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	s, err = openDownloadStore(path, stdLogger{})
+	assert.NoError(t, err)
+	assert.Equal(t, "2", s.Used("a").RatString())
+	assert.Equal(t, "0", s.Used("b").RatString())
+	assert.Equal(t, "1", s.Used("c").RatString())
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), `"b"`)
+	assert.NotContains(t, string(data), `"expi`+"\n")
+}
+
+func TestServeHTTPMaxDownloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhttpserve")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := strings.Repeat("x", 100)
+	s := newTestFileServer(t, map[string]string{"file.txt": content})
+	s.downloads, err = openDownloadStore(filepath.Join(dir, "downloads.jsonl"), stdLogger{})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	// Leaving off the last byte doesn't get around the limit.
+	target := signTestPath(t, "remote", "file.txt", url.Values{"v": {"2"}, "max_downloads": {"1"}})
+	w := serveTest(s, "GET", target, http.Header{"Range": {"bytes=0-98"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	w = serveTest(s, "GET", target, http.Header{"Range": {"bytes=0-98"}})
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	// The rest of the file can still be fetched though, and a HEAD request
+	// doesn't use anything.
+	w = serveTest(s, "HEAD", target, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveTest(s, "GET", target, http.Header{"Range": {"bytes=99-"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	w = serveTest(s, "GET", target, http.Header{"Range": {"bytes=99-"}})
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	// A file fetched in segments counts as a single download.
+	target = signTestPath(t, "remote", "file.txt", url.Values{"v": {"2"}, "max_downloads": {"2"}})
+	for _, r := range []string{"bytes=0-24", "bytes=25-49", "bytes=50-74", "bytes=75-99"} {
+		w = serveTest(s, "GET", target, http.Header{"Range": {r}})
+		assert.Equal(t, http.StatusPartialContent, w.Code, r)
+	}
+	w = serveTest(s, "GET", target, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.String())
+	w = serveTest(s, "GET", target, http.Header{"Range": {"bytes=0-0"}})
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	// Re-encoding a link's signature into another one that verifies doesn't
+	// start a new count.
+	target = signTestPath(t, "remote", "file.txt", url.Values{
+		"v":             {"2"},
+		"max_downloads": {"1"},
+		"filename":      {"copy.txt"},
+	})
+	w = serveTest(s, "GET", target, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveTest(s, "GET", malleateTestPath(t, target), nil)
+	assert.Equal(t, http.StatusGone, w.Code)
+}
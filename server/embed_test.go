@@ -0,0 +1,58 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/internal/signertest"
+	"github.com/brandur/rhttpserve/internal/testkeys"
+	"github.com/brandur/rhttpserve/server"
+	"github.com/brandur/rhttpserve/signer"
+	_ "github.com/ncw/rclone/local"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// TestEmbedding builds a server only through the package's public API, the
+// way that another program embedding it would, and serves a file out of a
+// local remote with it.
+func TestEmbedding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhttpserve-embed")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("embedded"), 0644)
+	assert.NoError(t, err)
+
+	// A local remote is rooted in the working directory.
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	os.Setenv("RCLONE_CONFIG_EMBEDTEST_TYPE", "local")
+	defer os.Unsetenv("RCLONE_CONFIG_EMBEDTEST_TYPE")
+
+	srv, err := server.New(server.Options{
+		PublicKeys: map[string]ed25519.PublicKey{"2017-01": testkeys.PublicKey},
+	})
+	assert.NoError(t, err)
+	defer srv.Close()
+
+	link, err := signertest.NewSigner("2017-01").Sign(signer.LinkSpec{
+		Remote:    "embedtest",
+		Path:      "file.txt",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", link, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "embedded", w.Body.String())
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// authErrorMarkers are substrings of error messages that suggest that a
+// remote's credentials have gone bad, for backends whose errors don't carry a
+// status code that we can inspect.
+var authErrorMarkers = []string{
+	"invalid_grant",
+	"oauth2:",
+	"unauthorized",
+}
+
+// fsCache is a concurrency-safe cache of rclone Fs instances keyed by remote
+// name and the root within the remote that they were created at.
+//
+// Creating an Fs can be expensive: some backends refresh an OAuth token or
+// warm a directory cache when they're initialized. Keeping instances around
+// between requests lets repeated downloads from the same remote reuse HTTP
+// clients, tokens and cached state.
+type fsCache struct {
+	// idleTimeout is how long an Fs may go unused before it's evicted.
+	idleTimeout time.Duration
+
+	// newFs creates a new Fs rooted at a directory in a remote.
+	newFs func(remote, root string) (fs.Fs, error)
+
+	// now returns the current time. Overridden in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[fsCacheKey]*fsCacheEntry
+}
+
+// fsCacheKey identifies an Fs in an fsCache.
+type fsCacheKey struct {
+	remote string
+	root   string
+}
+
+// fsCacheEntry is a single Fs in an fsCache. Its Fs is being created until
+// ready is closed, after which f and err are safe to read.
+type fsCacheEntry struct {
+	f        fs.Fs
+	err      error
+	lastUsed time.Time
+	ready    chan struct{}
+}
+
+func newFsCache(idleTimeout time.Duration, newFs func(remote, root string) (fs.Fs, error)) *fsCache {
+	return &fsCache{
+		idleTimeout: idleTimeout,
+		newFs:       newFs,
+		now:         time.Now,
+		entries:     make(map[fsCacheKey]*fsCacheEntry),
+	}
+}
+
+// Get returns an Fs rooted at the given directory of a remote, creating one if
+// there isn't one cached already.
+//
+// Concurrent callers asking for the same Fs while it's being created wait for
+// that one instead of creating their own.
+func (c *fsCache) Get(remote, root string) (fs.Fs, error) {
+	key := fsCacheKey{remote: remote, root: root}
+
+	c.mu.Lock()
+	c.evictIdleLocked()
+
+	e, ok := c.entries[key]
+	if ok {
+		e.lastUsed = c.now()
+		c.mu.Unlock()
+		<-e.ready
+		return e.f, e.err
+	}
+
+	e = &fsCacheEntry{lastUsed: c.now(), ready: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	e.f, e.err = c.newFs(remote, root)
+	close(e.ready)
+
+	// Don't hold onto failures so that the next request tries again.
+	if e.err != nil {
+		c.mu.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+
+	return e.f, e.err
+}
+
+// Invalidate removes an Fs from the cache so that the next call to Get for the
+// same remote and root creates a new one. It's a no-op if the cached Fs isn't
+// f, which happens when another request has already replaced it.
+func (c *fsCache) Invalidate(remote, root string, f fs.Info) {
+	key := fsCacheKey{remote: remote, root: root}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	select {
+	case <-e.ready:
+	default:
+		// Still being created, so it can't be the Fs that failed.
+		return
+	}
+
+	if fs.Info(e.f) == f {
+		delete(c.entries, key)
+	}
+}
+
+// evictIdleLocked removes entries that haven't been used within the idle
+// timeout. c.mu must be held.
+func (c *fsCache) evictIdleLocked() {
+	cutoff := c.now().Add(-c.idleTimeout)
+	for key, e := range c.entries {
+		if e.lastUsed.Before(cutoff) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// splitRoot splits a path in a remote into the root that an Fs for it should
+// be created at and the path relative to that root.
+//
+// Bucket-based backends like S3, B2, GCS and Swift only know which bucket to
+// use from the root of their Fs, and can't look up objects from the root of a
+// remote, so the first element of any path that has more than one is made the
+// root. For other backends this costs an extra cached Fs per top-level
+// directory.
+func splitRoot(p string) (root, rel string) {
+	i := strings.Index(p, "/")
+	if i < 0 {
+		return "", p
+	}
+	return p[:i], p[i+1:]
+}
+
+// isAuthError returns whether err looks like it was caused by bad or expired
+// credentials, in which case a remote's Fs should be recreated.
+func isAuthError(err error) bool {
+	cause := errors.Cause(err)
+
+	switch e := cause.(type) {
+	case interface {
+		StatusCode() int
+	}:
+		return e.StatusCode() == 401 || e.StatusCode() == 403
+
+	case *googleapi.Error:
+		return e.Code == 401 || e.Code == 403
+	}
+
+	message := strings.ToLower(cause.Error())
+	for _, marker := range authErrorMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+)
+
+func newTestFsCache() (*fsCache, *time.Time, *int) {
+	now := time.Date(2017, 1, 12, 10, 7, 46, 0, time.UTC)
+	created := 0
+
+	c := newFsCache(10*time.Minute, func(remote, root string) (fs.Fs, error) {
+		if remote == "broken" {
+			return nil, fmt.Errorf("no such remote")
+		}
+		created++
+		return &fakeFs{}, nil
+	})
+	c.now = func() time.Time { return now }
+
+	return c, &now, &created
+}
+
+func TestFsCacheReuse(t *testing.T) {
+	c, _, created := newTestFsCache()
+
+	f1, err := c.Get("remote", "")
+	assert.NoError(t, err)
+	f2, err := c.Get("remote", "")
+	assert.NoError(t, err)
+	assert.True(t, f1 == f2)
+
+	_, err = c.Get("other", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, *created)
+}
+
+func TestFsCacheIdleEviction(t *testing.T) {
+	c, now, created := newTestFsCache()
+
+	_, err := c.Get("remote", "")
+	assert.NoError(t, err)
+
+	*now = now.Add(5 * time.Minute)
+	_, err = c.Get("remote", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, *created)
+
+	*now = now.Add(11 * time.Minute)
+	_, err = c.Get("remote", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, *created)
+}
+
+func TestFsCacheInvalidate(t *testing.T) {
+	c, _, created := newTestFsCache()
+
+	f1, err := c.Get("remote", "")
+	assert.NoError(t, err)
+
+	c.Invalidate("remote", "", f1)
+	f2, err := c.Get("remote", "")
+	assert.NoError(t, err)
+	assert.False(t, f1 == f2)
+	assert.Equal(t, 2, *created)
+
+	// Invalidating a stale instance leaves the current one alone.
+	c.Invalidate("remote", "", f1)
+	f3, err := c.Get("remote", "")
+	assert.NoError(t, err)
+	assert.True(t, f2 == f3)
+}
+
+func TestFsCacheRoots(t *testing.T) {
+	c, _, created := newTestFsCache()
+
+	// An Fs is only reused for the same root of a remote, since bucket-based
+	// backends can't look in any bucket but the one they were created for.
+	f1, err := c.Get("remote", "bucket1")
+	assert.NoError(t, err)
+	f2, err := c.Get("remote", "bucket2")
+	assert.NoError(t, err)
+	assert.False(t, f1 == f2)
+	assert.Equal(t, 2, *created)
+
+	// Invalidating one root leaves the others alone.
+	c.Invalidate("remote", "bucket1", f1)
+	f3, err := c.Get("remote", "bucket2")
+	assert.NoError(t, err)
+	assert.True(t, f2 == f3)
+}
+
+func TestFsCacheDoesntCacheErrors(t *testing.T) {
+	c, _, _ := newTestFsCache()
+
+	_, err := c.Get("broken", "")
+	assert.Error(t, err)
+	assert.Empty(t, c.entries)
+}
+
+func TestIsAuthError(t *testing.T) {
+	assert.True(t, isAuthError(&googleapi.Error{Code: 401}))
+	assert.False(t, isAuthError(&googleapi.Error{Code: 404}))
+	assert.True(t, isAuthError(fmt.Errorf("oauth2: cannot fetch token: 400 Bad Request")))
+	assert.False(t, isAuthError(fs.ErrorObjectNotFound))
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// indexTemplate renders a directory index as HTML.
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td { padding: 0.2em 1em 0.2em 0; }
+td.size { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Download all as: {{range $format, $url := .ArchiveURLs}}<a href="{{$url}}">{{$format}}</a> {{end}}</p>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{- if .ParentURL}}
+<tr><td><a href="{{.ParentURL}}">../</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr>
+<td><a href="{{.URL}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td>
+<td class="size">{{if not .IsDir}}{{.Size}}{{end}}</td>
+<td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// index is a listing of a single directory in a remote.
+type index struct {
+	Title     string       `json:"title"`
+	ParentURL string       `json:"parent_url,omitempty"`
+	Entries   []indexEntry `json:"entries"`
+
+	// ArchiveURLs link to downloads of the whole directory, keyed by
+	// archive format.
+	ArchiveURLs map[string]string `json:"archive_urls"`
+}
+
+// indexEntry is a single file or directory in an index.
+type indexEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+
+	// URL links to the entry with the same authorization as the index.
+	URL string `json:"url"`
+}
+
+// indexEntries sorts directories first, then everything by name.
+type indexEntries []indexEntry
+
+func (e indexEntries) Len() int      { return len(e) }
+func (e indexEntries) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e indexEntries) Less(i, j int) bool {
+	if e[i].IsDir != e[j].IsDir {
+		return e[i].IsDir
+	}
+	return e[i].Name < e[j].Name
+}
+
+// serveIndex lists the directory at a prefix-scoped link's path as HTML, or as
+// JSON if the client asks for it with Accept.
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request, link *link) {
+	rclonePath := link.remote + ":" + link.path
+
+	// Listed entries are relative to the Fs's root, so it's added back to
+	// them to make their links.
+	root, rel := splitRoot(link.path)
+	f, err := s.fsCache.Get(link.remote, root)
+	if err != nil {
+		s.logf("Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(""))
+		return
+	}
+
+	dir := strings.TrimSuffix(link.path, "/")
+	objects, dirs, err := fs.NewLister().SetLevel(1).Start(f, strings.TrimSuffix(rel, "/")).GetAll()
+
+	if err == fs.ErrorDirNotFound {
+		if s.opts.Verbose {
+			s.logf("No such directory")
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No such directory"))
+		return
+	} else if err != nil {
+		if isAuthError(err) {
+			s.fsCache.Invalidate(link.remote, root, f)
+		}
+
+		s.logf("Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(""))
+		return
+	}
+
+	idx := index{
+		Title:       link.remote + ":" + link.path,
+		Entries:     make([]indexEntry, 0, len(objects)+len(dirs)),
+		ArchiveURLs: make(map[string]string),
+	}
+
+	for formatName := range archiveFormats {
+		idx.ArchiveURLs[formatName] = linkURL(r, link.remote, link.path) +
+			"&archive=" + url.QueryEscape(formatName)
+	}
+
+	if link.path != link.prefix {
+		idx.ParentURL = linkURL(r, link.remote, path.Dir(dir)+"/")
+	}
+
+	for _, d := range dirs {
+		idx.Entries = append(idx.Entries, indexEntry{
+			Name:    path.Base(d.Remote()),
+			IsDir:   true,
+			Size:    d.Size(),
+			ModTime: d.ModTime(),
+			URL:     linkURL(r, link.remote, path.Join(root, d.Remote())+"/"),
+		})
+	}
+
+	for _, o := range objects {
+		idx.Entries = append(idx.Entries, indexEntry{
+			Name:    path.Base(o.Remote()),
+			Size:    o.Size(),
+			ModTime: o.ModTime(),
+			URL:     linkURL(r, link.remote, path.Join(root, o.Remote())),
+		})
+	}
+
+	sort.Sort(indexEntries(idx.Entries))
+
+	var buf bytes.Buffer
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(&buf).Encode(idx)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = indexTemplate.Execute(&buf, idx)
+	}
+	if err != nil {
+		s.logf("Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(""))
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Vary", "Accept")
+
+	if r.Method == "HEAD" {
+		s.logf("Serving index HEAD: %s", rclonePath)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	s.logf("Serving index: %s (%v entries)", rclonePath, len(idx.Entries))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// linkURL builds a URL to another path in a remote that carries the same
+// query string (and therefore authorization) as the current request.
+func linkURL(r *http.Request, remote, p string) string {
+	u := url.URL{
+		Path:     "/" + remote + "/" + p,
+		RawQuery: r.URL.RawQuery,
+	}
+	return u.String()
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexEntriesSort(t *testing.T) {
+	entries := []indexEntry{
+		{Name: "b.jpg"},
+		{Name: "z", IsDir: true},
+		{Name: "a.jpg"},
+		{Name: "c", IsDir: true},
+	}
+	sort.Sort(indexEntries(entries))
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, []string{"c", "z", "a.jpg", "b.jpg"}, names)
+}
+
+func TestLinkURL(t *testing.T) {
+	r := httptest.NewRequest("GET", "/remote/photos/?expires_at=123&prefix=photos%2F&v=2", nil)
+	assert.Equal(t,
+		"/remote/photos/beach%20day/a%3Fb.jpg?expires_at=123&prefix=photos%2F&v=2",
+		linkURL(r, "remote", "photos/beach day/a?b.jpg"))
+}
+
+// signTestIndexPath signs a link to a directory under the photos/ prefix.
+func signTestIndexPath(t *testing.T, dir string) string {
+	return signTestPathAs(t, "remote", dir, "photos/", url.Values{
+		"v":      {"2"},
+		"prefix": {"photos/"},
+	})
+}
+
+func TestServeIndex(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{
+		"photos/a.jpg":       "a",
+		"photos/beach/b.jpg": "bb",
+		"photos/beach/c.jpg": "ccc",
+		"secrets/d.jpg":      "dddd",
+	})
+
+	target := signTestIndexPath(t, "photos/")
+
+	w := serveTest(s, "GET", target, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), ">a.jpg</a>")
+	assert.Contains(t, w.Body.String(), ">beach/</a>")
+	assert.NotContains(t, w.Body.String(), "d.jpg")
+
+	w = serveTest(s, "GET", target, http.Header{"Accept": {"application/json"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var idx index
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &idx))
+	assert.Equal(t, "remote:photos/", idx.Title)
+	assert.Equal(t, "", idx.ParentURL)
+	if assert.Len(t, idx.Entries, 2) {
+		assert.Equal(t, "beach", idx.Entries[0].Name)
+		assert.True(t, idx.Entries[0].IsDir)
+		assert.True(t, strings.HasPrefix(idx.Entries[0].URL, "/remote/photos/beach/?"))
+
+		assert.Equal(t, "a.jpg", idx.Entries[1].Name)
+		assert.False(t, idx.Entries[1].IsDir)
+		assert.Equal(t, int64(1), idx.Entries[1].Size)
+		assert.True(t, strings.HasPrefix(idx.Entries[1].URL, "/remote/photos/a.jpg?"))
+	}
+	assert.Contains(t, idx.ArchiveURLs, "zip")
+
+	// The links in an index lead to their entries.
+	w = serveTest(s, "GET", idx.Entries[1].URL, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "a", w.Body.String())
+
+	w = serveTest(s, "GET", idx.Entries[0].URL, http.Header{"Accept": {"application/json"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	idx = index{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &idx))
+	assert.True(t, strings.HasPrefix(idx.ParentURL, "/remote/photos/?"))
+	if assert.Len(t, idx.Entries, 2) {
+		assert.Equal(t, "b.jpg", idx.Entries[0].Name)
+		assert.Equal(t, "c.jpg", idx.Entries[1].Name)
+	}
+
+	w = serveTest(s, "GET", signTestIndexPath(t, "photos/missing/"), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "No such directory", w.Body.String())
+}
+
+func TestServeIndexHEAD(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{"photos/a.jpg": "a"})
+	target := signTestIndexPath(t, "photos/")
+
+	get := serveTest(s, "GET", target, nil)
+	w := serveTest(s, "HEAD", target, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Body.String())
+	assert.Equal(t, get.Header().Get("Content-Type"), w.Header().Get("Content-Type"))
+	assert.Equal(t, get.Header().Get("Content-Length"), w.Header().Get("Content-Length"))
+}
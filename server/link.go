@@ -0,0 +1,325 @@
+package server
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"golang.org/x/crypto/ed25519"
+)
+
+// link is the signed link that a request was made with.
+type link struct {
+	remote    string
+	path      string
+	expiresAt time.Time
+	keyID     string
+	version   string
+
+	// prefix is set if the link authorizes any object under a directory
+	// rather than a single file. It ends with a slash, and path is always
+	// within it.
+	prefix string
+
+	// params are the link's query parameters. In a version 2 link, all of
+	// them are covered by its signature.
+	params url.Values
+
+	// disposition is either "attachment" or "inline" depending on whether
+	// the link's file should be downloaded or displayed by a browser.
+	disposition string
+
+	// filename is what the link's file should be saved as. If it's empty,
+	// the name of the object is used.
+	filename string
+
+	// maxDownloads is how many times the link may be downloaded, or 0 if
+	// there's no limit.
+	maxDownloads int
+
+	// ipNets are the addresses that the link may be used from. It's empty if
+	// the link can be used from anywhere.
+	ipNets []*net.IPNet
+
+	// password checks the password needed to unlock the link. It's nil if
+	// the link doesn't have one.
+	password *common.PasswordVerifier
+
+	// opaque is set if the link was sealed in the token of an opaque link,
+	// so that its remote and path shouldn't be revealed to the client.
+	opaque bool
+
+	// message is what the link's signature is over.
+	message []byte
+}
+
+// digest identifies the link in download stores and revocation lists.
+func (l *link) digest() string {
+	return common.LinkDigest(l.message)
+}
+
+// info describes the link for policy hooks.
+func (l *link) info() LinkInfo {
+	return LinkInfo{
+		Remote:    l.remote,
+		Path:      l.path,
+		Prefix:    l.prefix,
+		ExpiresAt: l.expiresAt,
+		KeyID:     l.keyID,
+		Digest:    l.digest(),
+		Params:    l.params,
+	}
+}
+
+// contentDisposition returns the Content-Disposition header for a response to
+// the link, naming the file with the link's filename or the given one if it
+// doesn't have one.
+func (l *link) contentDisposition(filename string) string {
+	if l.filename != "" {
+		filename = l.filename
+	}
+	return contentDisposition(l.disposition, filename)
+}
+
+// responseHeader returns the headers that the link sets on a response with its
+// file: its Content-Disposition along with any headers that it overrides.
+func (l *link) responseHeader() http.Header {
+	// Browsers otherwise name files after the last segment of the URL, which
+	// for opaque links is the token.
+	var filename string
+	if l.opaque {
+		filename = path.Base(l.path)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Disposition", l.contentDisposition(filename))
+
+	for param, name := range common.ResponseHeaderParams {
+		value := l.params.Get(param)
+		if value != "" {
+			header.Set(name, value)
+		}
+	}
+
+	return header
+}
+
+// verifyLink parses the link that a request was made with and verifies its
+// signature and expiry. If the link isn't valid, an error is written to the
+// response and false is returned.
+//
+// opaque is whether the link came out of the token of an opaque link, in which
+// case errors that would reveal anything sealed in the token are generic.
+func (s *Server) verifyLink(w http.ResponseWriter, r *http.Request, opaque bool) (*link, bool) {
+	params := r.URL.Query()
+	version := params.Get("v")
+
+	policy := common.LinkPolicy{
+		AcceptV1:  s.opts.AcceptV1,
+		ClockSkew: s.opts.ClockSkew,
+		MaxTTL:    s.opts.MaxTTL,
+	}
+
+	err := policy.CheckVersion(params)
+	if err != nil {
+		s.writeLinkError(w, opaque, http.StatusBadRequest, "Invalid link", capitalize(err.Error()))
+		return nil, false
+	}
+
+	expiresAtStr, ok := getParam(w, r, "expires_at")
+	if !ok {
+		return nil, false
+	}
+
+	signatureEncoded, ok := getParam(w, r, "signature")
+	if !ok {
+		return nil, false
+	}
+	signatureStr, err := base64.URLEncoding.DecodeString(signatureEncoded)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Couldn't decode signature"))
+		return nil, false
+	}
+
+	expiresAtInt, err := strconv.ParseInt(expiresAtStr, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Couldn't parse expires_at"))
+		return nil, false
+	}
+	expiresAt := time.Unix(expiresAtInt, 0)
+
+	err = policy.CheckValidity(params, time.Now())
+	if err != nil {
+		if s.opts.Verbose {
+			s.logf("Outside of validity window: %v", err)
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(capitalize(err.Error())))
+		return nil, false
+	}
+
+	// Note the first part will be empty because we start with a leading slash.
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request path"))
+		return nil, false
+	}
+
+	remote := parts[1]
+	path := strings.Join(parts[2:], "/")
+
+	if version != "" {
+		err = common.CheckLinkPath(r.URL.EscapedPath(), path)
+		if err != nil {
+			s.writeLinkError(w, opaque, http.StatusBadRequest, "Invalid request path", "Invalid request path: "+err.Error())
+			return nil, false
+		}
+	}
+
+	constraints, err := common.ParseLinkConstraints(params)
+	if err != nil {
+		s.writeLinkError(w, opaque, http.StatusBadRequest, "Invalid link", capitalize(err.Error()))
+		return nil, false
+	}
+
+	// A prefix-scoped link is signed over its prefix instead of the path of
+	// any particular object. Only version 2 links can carry one.
+	signedPath := path
+	prefix := constraints.Prefix
+	if prefix != "" {
+		signedPath = prefix
+	}
+
+	keyID := params.Get("kid")
+	publicKey, ok := s.opts.PublicKeys[keyID]
+	if !ok {
+		if s.opts.Verbose {
+			s.logf("Unknown key ID: %q", keyID)
+		}
+
+		if keyID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Link must include a key ID (kid)"))
+		} else {
+			s.writeLinkError(w, opaque, http.StatusBadRequest, "Invalid link", "Unknown key ID: "+keyID)
+		}
+		return nil, false
+	}
+
+	var message []byte
+	if version == "" {
+		message = common.KeyedMessage(keyID, remote, path, expiresAtInt)
+	} else {
+		// Passwords are submitted by POSTing to the link itself, which
+		// is signed for GET.
+		method := r.Method
+		if method == "POST" {
+			method = "GET"
+		}
+		message = common.CanonicalMessage(method, remote, signedPath, params)
+	}
+	if s.opts.Verbose {
+		s.logf("Message: %q", string(message))
+	}
+
+	ok = ed25519.Verify(publicKey, message, []byte(signatureStr))
+	if !ok {
+		if s.opts.Verbose {
+			s.logf("Bad signature")
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Signature verification failed"))
+		return nil, false
+	}
+
+	// Paths have already been normalized, so a plain prefix check is enough
+	// to make sure that this one doesn't escape the signed directory.
+	if prefix != "" && !strings.HasPrefix(path, prefix) {
+		if s.opts.Verbose {
+			s.logf("Path %q outside of prefix %q", path, prefix)
+		}
+
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Path is outside of the link's prefix"))
+		return nil, false
+	}
+
+	if len(constraints.IPNets) > 0 {
+		ip := clientIP(r, s.opts.TrustedProxies, s.opts.ForwardedHeader)
+		if ip == nil || !ipNetsContain(constraints.IPNets, ip) {
+			if s.opts.Verbose {
+				s.logf("Client address %v not allowed", ip)
+			}
+
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Link can't be used from this address"))
+			return nil, false
+		}
+	}
+
+	l := &link{
+		remote:    remote,
+		path:      path,
+		expiresAt: expiresAt,
+		keyID:     keyID,
+		version:   version,
+		params:    params,
+		prefix:    prefix,
+
+		disposition:  constraints.Disposition,
+		filename:     constraints.Filename,
+		maxDownloads: constraints.MaxDownloads,
+		ipNets:       constraints.IPNets,
+		password:     constraints.Password,
+		message:      message,
+		opaque:       opaque,
+	}
+
+	if s.revocations != nil && s.revocations.Revoked(l.digest()) {
+		if s.opts.Verbose {
+			s.logf("Revoked link: %s", l.digest())
+		}
+
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte("Link has been revoked"))
+		return nil, false
+	}
+
+	return l, true
+}
+
+// writeLinkError writes an error about a link to the response. For an opaque
+// link, the client only gets the generic message because the detailed one
+// could give away the remote or path sealed in its token, and the detailed
+// one is logged instead.
+func (s *Server) writeLinkError(w http.ResponseWriter, opaque bool, status int, generic, detail string) {
+	if opaque {
+		if s.opts.Verbose {
+			s.logf("Error with opaque link: %s", detail)
+		}
+		detail = generic
+	}
+
+	w.WriteHeader(status)
+	w.Write([]byte(detail))
+}
+
+// capitalize turns an error message into a sentence for the body of a
+// response.
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/internal/testkeys"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newTestServer(t *testing.T) *Server {
+	s, err := New(Options{
+		AcceptV1:   true,
+		CookieKey:  []byte("cookie-key"),
+		PublicKeys: map[string]ed25519.PublicKey{"": testkeys.PublicKey},
+	})
+	assert.NoError(t, err)
+	return s
+}
+
+func signTestPath(t *testing.T, remote, path string, params url.Values) string {
+	return signTestPathAs(t, remote, path, path, params)
+}
+
+// signTestPathAs signs a link to path, but over signedPath, which differs for
+// prefix-scoped links.
+func signTestPathAs(t *testing.T, remote, path, signedPath string, params url.Values) string {
+	if params.Get("expires_at") == "" {
+		params.Set("expires_at", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	}
+
+	var message []byte
+	if params.Get("v") == "" {
+		expiresAt, _ := strconv.ParseInt(params.Get("expires_at"), 10, 64)
+		message = common.Message(remote, signedPath, expiresAt)
+	} else {
+		message = common.CanonicalMessage("GET", remote, signedPath, params)
+	}
+
+	signature := ed25519.Sign(testkeys.PrivateKey, message)
+	params.Set("signature", base64.URLEncoding.EncodeToString(signature))
+
+	u := url.URL{Path: "/" + remote + "/" + path, RawQuery: params.Encode()}
+	return u.String()
+}
+
+func verifyTestLink(s *Server, method, target string) (*link, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, nil)
+	link, _ := s.verifyLink(w, r, false)
+	return link, w
+}
+
+// malleateTestPath re-encodes the signature of a signed path into a different
+// one that still verifies.
+func malleateTestPath(t *testing.T, target string) string {
+	u, err := url.Parse(target)
+	assert.NoError(t, err)
+
+	params := u.Query()
+	signature, err := base64.URLEncoding.DecodeString(params.Get("signature"))
+	assert.NoError(t, err)
+	params.Set("signature", base64.URLEncoding.EncodeToString(testkeys.Malleate(signature)))
+
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+func TestVerifyLinkV2(t *testing.T) {
+	s := newTestServer(t)
+	target := signTestPath(t, "remote", "papers/raft:2014.pdf", url.Values{"v": {"2"}})
+
+	link, w := verifyTestLink(s, "GET", target)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "remote", link.remote)
+	assert.Equal(t, "papers/raft:2014.pdf", link.path)
+
+	// HEAD is covered by a signature for GET.
+	link, _ = verifyTestLink(s, "HEAD", target)
+	assert.NotNil(t, link)
+
+	// Tampered path.
+	u, _ := url.Parse(target)
+	u.Path = "/remote/papers/paxos.pdf"
+	link, w = verifyTestLink(s, "GET", u.String())
+	assert.Nil(t, link)
+	assert.Equal(t, "Signature verification failed", w.Body.String())
+
+	// Added parameter.
+	link, _ = verifyTestLink(s, "GET", target+"&foo=bar")
+	assert.Nil(t, link)
+
+	// Encoded slash.
+	target = signTestPath(t, "remote", "papers/raft.pdf", url.Values{"v": {"2"}})
+	u, _ = url.Parse(target)
+	link, w = verifyTestLink(s, "GET", "/remote/papers%2Fraft.pdf?"+u.RawQuery)
+	assert.Nil(t, link)
+	assert.Equal(t, "Invalid request path: path contains an encoded slash", w.Body.String())
+}
+
+func TestVerifyLinkV1(t *testing.T) {
+	s := newTestServer(t)
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{})
+
+	link, w := verifyTestLink(s, "GET", target)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", link.version)
+
+	// Version 1 messages don't cover other parameters.
+	link, w = verifyTestLink(s, "GET", target+"&foo=bar")
+	assert.Nil(t, link)
+	assert.Equal(t, `Parameter "foo" isn't covered by the signature of a link in the original format`, w.Body.String())
+
+	s.opts.AcceptV1 = false
+	link, _ = verifyTestLink(s, "GET", target)
+	assert.Nil(t, link)
+}
+
+func TestVerifyLinkPrefix(t *testing.T) {
+	s := newTestServer(t)
+	target := signTestPathAs(t, "remote", "photos/trip/a.jpg", "photos/trip/", url.Values{
+		"v":      {"2"},
+		"prefix": {"photos/trip/"},
+	})
+	u, _ := url.Parse(target)
+	query := "?" + u.RawQuery
+
+	link, w := verifyTestLink(s, "GET", target)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "photos/trip/a.jpg", link.path)
+	assert.Equal(t, "photos/trip/", link.prefix)
+
+	link, _ = verifyTestLink(s, "GET", "/remote/photos/trip/"+query)
+	assert.NotNil(t, link)
+
+	link, _ = verifyTestLink(s, "GET", "/remote/photos/trip/nested/b.jpg"+query)
+	assert.NotNil(t, link)
+
+	for _, escape := range []string{
+		"/remote/photos/other.jpg",
+		"/remote/photos/trip2/a.jpg",
+		"/remote/photos/trip/../other.jpg",
+		"/remote/photos/trip/..%2Fother.jpg",
+		"/remote/photos/trip%2F..%2Fother.jpg",
+		"/remote/photos/trip//a.jpg",
+		"/other/photos/trip/a.jpg",
+	} {
+		link, w = verifyTestLink(s, "GET", escape+query)
+		assert.Nil(t, link, escape)
+		assert.NotEqual(t, http.StatusOK, w.Code, escape)
+	}
+}
+
+func TestVerifyLinkExpired(t *testing.T) {
+	s := newTestServer(t)
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{
+		"v":          {"2"},
+		"expires_at": {strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)},
+	})
+
+	link, w := verifyTestLink(s, "GET", target)
+	assert.Nil(t, link)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestVerifyLinkDisposition(t *testing.T) {
+	s := newTestServer(t)
+
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{"v": {"2"}})
+	link, _ := verifyTestLink(s, "GET", target)
+	assert.Equal(t, "attachment", link.contentDisposition(""))
+	assert.Equal(t, `attachment; filename="raft.zip"`, link.contentDisposition("raft.zip"))
+
+	target = signTestPath(t, "remote", "papers/raft.pdf", url.Values{
+		"v":           {"2"},
+		"disposition": {"inline"},
+		"filename":    {"Raft.pdf"},
+	})
+	link, _ = verifyTestLink(s, "GET", target)
+	assert.Equal(t, `inline; filename="Raft.pdf"`, link.contentDisposition(""))
+	assert.Equal(t, `inline; filename="Raft.pdf"`, link.contentDisposition("raft.zip"))
+
+	// Recipients can't change how the file is presented.
+	link, w := verifyTestLink(s, "GET", strings.Replace(target, "inline", "attachment", 1))
+	assert.Nil(t, link)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	for _, params := range []url.Values{
+		{"v": {"2"}, "disposition": {"form-data"}},
+		{"v": {"2"}, "filename": {"../raft.pdf"}},
+	} {
+		link, w := verifyTestLink(s, "GET", signTestPath(t, "remote", "papers/raft.pdf", params))
+		assert.Nil(t, link)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestVerifyLinkResponseHeaders(t *testing.T) {
+	s := newTestServer(t)
+
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{
+		"v":                      {"2"},
+		"disposition":            {"inline"},
+		"response-cache-control": {"public, max-age=60"},
+		"response-content-type":  {"application/x-raft"},
+	})
+	link, _ := verifyTestLink(s, "GET", target)
+	assert.Equal(t, http.Header{
+		"Cache-Control":       {"public, max-age=60"},
+		"Content-Disposition": {"inline"},
+		"Content-Type":        {"application/x-raft"},
+	}, link.responseHeader())
+
+	// Overrides can't be added by recipients.
+	link, w := verifyTestLink(s, "GET", target+"&response-content-language=en")
+	assert.Nil(t, link)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	target = signTestPath(t, "remote", "papers/raft.pdf", url.Values{
+		"v":                     {"2"},
+		"response-content-type": {"text/html\r\nSet-Cookie: a=b"},
+	})
+	link, w = verifyTestLink(s, "GET", target)
+	assert.Nil(t, link)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestVerifyLinkValidityWindow(t *testing.T) {
+	s := newTestServer(t)
+	s.opts.ClockSkew = time.Minute
+	s.opts.MaxTTL = 24 * time.Hour
+
+	unix := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+	}
+
+	for _, tc := range []struct {
+		issuedAt  string
+		notBefore string
+		expiresAt string
+		valid     bool
+	}{
+		{unix(0), "", unix(time.Hour), true},
+		{unix(0), "", unix(25 * time.Hour), false},
+		{unix(-2 * time.Hour), "", unix(23 * time.Hour), false},
+		{unix(30 * time.Second), "", unix(time.Hour), true},
+
+		// A link can't be issued in the future to stretch its lifetime.
+		{unix(300 * 24 * time.Hour), "", unix(301 * 24 * time.Hour), false},
+		{"", unix(-time.Hour), unix(23 * time.Hour), true},
+		{"", unix(-2 * time.Hour), unix(23 * time.Hour), false},
+		{"", unix(30 * time.Second), unix(time.Hour), true},
+		{"", unix(time.Hour), unix(2 * time.Hour), false},
+		{"", "soon", unix(time.Hour), false},
+		{"soon", "", unix(time.Hour), false},
+
+		// not_before takes precedence over iat.
+		{unix(-2 * time.Hour), unix(-time.Hour), unix(23 * time.Hour), true},
+
+		// Without either, there's nothing to measure the link's lifetime
+		// from.
+		{"", "", unix(time.Hour), false},
+	} {
+		params := url.Values{"v": {"2"}, "expires_at": {tc.expiresAt}}
+		if tc.issuedAt != "" {
+			params.Set("iat", tc.issuedAt)
+		}
+		if tc.notBefore != "" {
+			params.Set("not_before", tc.notBefore)
+		}
+
+		link, w := verifyTestLink(s, "GET", signTestPath(t, "remote", "papers/raft.pdf", params))
+		if tc.valid {
+			assert.NotNil(t, link, "%+v", tc)
+		} else {
+			assert.Nil(t, link, "%+v", tc)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestVerifyLinkIP(t *testing.T) {
+	s := newTestServer(t)
+
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{
+		"v":  {"2"},
+		"ip": {"192.0.2.1,198.51.100.0/24"},
+	})
+
+	for _, tc := range []struct {
+		remoteAddr string
+		valid      bool
+	}{
+		{"192.0.2.1:1234", true},
+		{"198.51.100.42:1234", true},
+		{"192.0.2.2:1234", false},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = tc.remoteAddr
+
+		link, _ := s.verifyLink(w, r, false)
+		if tc.valid {
+			assert.NotNil(t, link, tc.remoteAddr)
+		} else {
+			assert.Nil(t, link, tc.remoteAddr)
+			assert.Equal(t, http.StatusForbidden, w.Code)
+		}
+	}
+}
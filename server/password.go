@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPasswordAttempts is how many passwords may be tried for a link
+	// within passwordAttemptWindow.
+	maxPasswordAttempts   = 5
+	passwordAttemptWindow = time.Minute
+
+	// maxPasswordFormSize limits the size of a submitted password form.
+	maxPasswordFormSize = 4096
+)
+
+// passwordTemplate renders the page that asks for the password of a
+// password-protected link. It submits back to the link itself.
+var passwordTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Password required</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+p.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Password required</h1>
+{{- if .Error}}
+<p class="error">{{.Error}}</p>
+{{- end}}
+<form method="post">
+<input type="password" name="password" autofocus required>
+<button type="submit">Unlock</button>
+</form>
+</body>
+</html>
+`))
+
+// passwordPage is the data used to render passwordTemplate.
+type passwordPage struct {
+	Error string
+}
+
+// attemptLimiter limits how often something can be tried, like the password
+// of a link. Attempts are counted in fixed windows, keyed by what's being
+// tried.
+type attemptLimiter struct {
+	max    int
+	window time.Duration
+	now    func() time.Time
+
+	mu       sync.Mutex
+	attempts map[string]*attempts
+}
+
+// attempts counts the attempts made in a single window.
+type attempts struct {
+	count   int
+	resetAt time.Time
+}
+
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		max:      max,
+		window:   window,
+		now:      time.Now,
+		attempts: make(map[string]*attempts),
+	}
+}
+
+// Attempt counts an attempt, returning false along with how long until
+// another is allowed if too many have been made already.
+func (l *attemptLimiter) Attempt(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	// Drop windows that are over so that the map doesn't grow forever.
+	for k, a := range l.attempts {
+		if !now.Before(a.resetAt) {
+			delete(l.attempts, k)
+		}
+	}
+
+	a, ok := l.attempts[key]
+	if !ok {
+		a = &attempts{resetAt: now.Add(l.window)}
+		l.attempts[key] = a
+	}
+
+	if a.count >= l.max {
+		return a.resetAt.Sub(now), false
+	}
+
+	a.count++
+	return 0, true
+}
+
+// Reset forgets the attempts made for a key, like after one succeeds.
+func (l *attemptLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, key)
+}
+
+// checkPassword makes sure that a request for a password-protected link has
+// been unlocked with the link's password, which is proven by a cookie. If it
+// hasn't, the password form is written to the response (or the submitted
+// password is checked) and false is returned.
+func (s *Server) checkPassword(w http.ResponseWriter, r *http.Request, link *link) bool {
+	if link.password == nil {
+		// Only password forms are submitted by POST.
+		if r.Method == "POST" {
+			http.NotFound(w, r)
+			return false
+		}
+		return true
+	}
+
+	if r.Method != "POST" {
+		if s.checkUnlockCookie(r, link) {
+			return true
+		}
+
+		s.writePasswordPage(w, r, http.StatusUnauthorized, "")
+		return false
+	}
+
+	key := link.digest()
+
+	retryAfter, ok := s.passwordAttempts.Attempt(key)
+	if !ok {
+		if s.opts.Verbose {
+			s.logf("Too many password attempts for link: %s", key)
+		}
+
+		seconds := int(retryAfter/time.Second) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		s.writePasswordPage(w, r, http.StatusTooManyRequests,
+			"Too many attempts. Try again in "+strconv.Itoa(seconds)+" seconds.")
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPasswordFormSize)
+	password := r.PostFormValue("password")
+
+	if password == "" || !link.password.Check(password) {
+		if s.opts.Verbose {
+			s.logf("Incorrect password for link: %s", key)
+		}
+
+		s.writePasswordPage(w, r, http.StatusUnauthorized, "Incorrect password.")
+		return false
+	}
+
+	s.passwordAttempts.Reset(key)
+
+	expiresAt := time.Now().Add(s.opts.UnlockTTL)
+	if link.expiresAt.Before(expiresAt) {
+		expiresAt = link.expiresAt
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName(link),
+		Value:    s.unlockCookieValue(link, expiresAt),
+		Path:     "/",
+		Expires:  expiresAt,
+		MaxAge:   int(expiresAt.Sub(time.Now()) / time.Second),
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+	})
+
+	// Send the browser back to the link so that the file is fetched with a
+	// GET that can be resumed or refreshed. The link as it was requested is
+	// used, which for opaque links isn't the same as the URL being served.
+	location := r.RequestURI
+	if location == "" {
+		location = r.URL.RequestURI()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, location, http.StatusSeeOther)
+	return false
+}
+
+// checkUnlockCookie returns whether a request carries an unexpired cookie
+// that unlocks a link.
+func (s *Server) checkUnlockCookie(r *http.Request, link *link) bool {
+	cookie, err := r.Cookie(unlockCookieName(link))
+	if err != nil {
+		return false
+	}
+
+	i := strings.Index(cookie.Value, ".")
+	if i == -1 {
+		return false
+	}
+
+	expiresAtInt, err := strconv.ParseInt(cookie.Value[:i], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	expiresAt := time.Unix(expiresAtInt, 0)
+	if expiresAt.Before(time.Now()) {
+		return false
+	}
+
+	return hmac.Equal([]byte(cookie.Value), []byte(s.unlockCookieValue(link, expiresAt)))
+}
+
+// unlockCookieName names the cookie that unlocks a link. Each link gets its
+// own so that unlocking one doesn't unlock the others.
+func unlockCookieName(link *link) string {
+	return "rhttpserve_unlock_" + link.digest()[:16]
+}
+
+// unlockCookieValue produces the value of a cookie that unlocks a link until
+// the given time. It's signed with the server's cookie key so that it can't be
+// forged.
+func (s *Server) unlockCookieValue(link *link, expiresAt time.Time) string {
+	expiresAtStr := strconv.FormatInt(expiresAt.Unix(), 10)
+
+	mac := hmac.New(sha256.New, s.opts.CookieKey)
+	mac.Write([]byte(link.digest() + "\n" + expiresAtStr))
+
+	return expiresAtStr + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) writePasswordPage(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == "HEAD" {
+		w.WriteHeader(status)
+		return
+	}
+
+	var buf bytes.Buffer
+	err := passwordTemplate.Execute(&buf, passwordPage{Error: message})
+	if err != nil {
+		s.logf("Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(""))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttemptLimiter(t *testing.T) {
+	now := time.Unix(1484239044, 0)
+	l := newAttemptLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	_, ok := l.Attempt("a")
+	assert.True(t, ok)
+	_, ok = l.Attempt("a")
+	assert.True(t, ok)
+
+	retryAfter, ok := l.Attempt("a")
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, retryAfter)
+
+	// Keys are limited separately.
+	_, ok = l.Attempt("b")
+	assert.True(t, ok)
+
+	now = now.Add(time.Minute)
+	_, ok = l.Attempt("a")
+	assert.True(t, ok)
+
+	l.Reset("a")
+	_, ok = l.Attempt("a")
+	assert.True(t, ok)
+	_, ok = l.Attempt("a")
+	assert.True(t, ok)
+}
+
+func TestCheckPassword(t *testing.T) {
+	s := newTestServer(t)
+
+	verifier, err := common.NewPasswordVerifier("correct horse")
+	assert.NoError(t, err)
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{
+		"v":             {"2"},
+		"password_hash": {verifier.String()},
+	})
+
+	check := func(r *http.Request) (*httptest.ResponseRecorder, bool) {
+		w := httptest.NewRecorder()
+		link, ok := s.verifyLink(w, r, false)
+		assert.True(t, ok)
+		return w, s.checkPassword(w, r, link)
+	}
+
+	post := func(password string) (*httptest.ResponseRecorder, bool) {
+		r := httptest.NewRequest("POST", target,
+			strings.NewReader(url.Values{"password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return check(r)
+	}
+
+	// Without a cookie, the password form is served.
+	w, ok := check(httptest.NewRequest("GET", target, nil))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `<form method="post">`)
+
+	w, ok = post("wrong")
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "Incorrect password.")
+	assert.Empty(t, w.Header().Get("Set-Cookie"))
+
+	w, ok = post("correct horse")
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, target, w.Header().Get("Location"))
+
+	cookies := (&http.Response{Header: w.Header()}).Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.True(t, cookies[0].HttpOnly)
+
+	r := httptest.NewRequest("GET", target, nil)
+	r.AddCookie(cookies[0])
+	_, ok = check(r)
+	assert.True(t, ok)
+
+	// A cookie that's been tampered with is refused.
+	r = httptest.NewRequest("GET", target, nil)
+	forged := *cookies[0]
+	forged.Value = "9" + forged.Value
+	r.AddCookie(&forged)
+	w, ok = check(r)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Passwords stop being checked after too many attempts.
+	for i := 0; i < maxPasswordAttempts; i++ {
+		post("wrong")
+	}
+	w, ok = post("correct horse")
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
+
+func TestCheckPasswordNoPassword(t *testing.T) {
+	s := newTestServer(t)
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{"v": {"2"}})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", target, nil)
+	link, ok := s.verifyLink(w, r, false)
+	assert.True(t, ok)
+	assert.True(t, s.checkPassword(w, r, link))
+
+	// Links without a password can't be POSTed to.
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", target, nil)
+	link, ok = s.verifyLink(w, r, false)
+	assert.True(t, ok)
+	assert.False(t, s.checkPassword(w, r, link))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
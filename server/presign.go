@@ -0,0 +1,526 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/ncw/rclone/b2/api"
+	"github.com/ncw/rclone/fs"
+	"github.com/ncw/rclone/rest"
+	"golang.org/x/oauth2/google"
+)
+
+// presigner produces short-lived URLs that clients can use to download an
+// object directly from a remote's backend, so that its bytes don't have to
+// pass through the server.
+type presigner interface {
+	// Presign returns a URL for the object at the given path (which starts
+	// with the object's bucket) that's valid for about the given duration.
+	// The backend sets the given headers on its response to the URL. An error
+	// is returned if it can't set one of them.
+	Presign(path string, ttl time.Duration, header http.Header) (string, error)
+}
+
+// newPresigner builds a presigner for a remote out of its rclone
+// configuration.
+//
+// nil is returned without an error for remotes whose backend doesn't support
+// presigned URLs (or whose credentials can't be used to make them), in which
+// case their objects should be proxied as usual.
+func newPresigner(remote string) (presigner, error) {
+	switch fs.ConfigFileGet(remote, "type") {
+	case "s3":
+		return newS3Presigner(remote)
+	case "google cloud storage":
+		return newGCSPresigner(remote)
+	case "b2":
+		return newB2Presigner(remote)
+	}
+	return nil, nil
+}
+
+// splitBucketPath splits the path to an object into its bucket and the key
+// of the object within the bucket.
+func splitBucketPath(p string) (string, string, error) {
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("path should be of the form <bucket>/<key>: %v", p)
+	}
+	return parts[0], parts[1], nil
+}
+
+// checkHeaders returns an error if any of the given headers aren't among those
+// that a backend can set.
+func checkHeaders(header http.Header, supported ...string) error {
+	for name := range header {
+		ok := false
+		for _, s := range supported {
+			if name == s {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return fmt.Errorf("backend can't set the %v header", name)
+		}
+	}
+	return nil
+}
+
+// headerString returns a header's value for use in an AWS request, or nil if
+// the header isn't set.
+func headerString(header http.Header, name string) *string {
+	value := header.Get(name)
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
+// s3Presigner makes SigV4 presigned URLs for S3 remotes.
+type s3Presigner struct {
+	client *s3.S3
+}
+
+// newS3Presigner builds an S3 client configured the same way that rclone
+// configures its own.
+func newS3Presigner(remote string) (presigner, error) {
+	v := credentials.Value{
+		AccessKeyID:     fs.ConfigFileGet(remote, "access_key_id"),
+		SecretAccessKey: fs.ConfigFileGet(remote, "secret_access_key"),
+	}
+
+	cred := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.StaticProvider{Value: v},
+		&credentials.EnvProvider{},
+		&ec2rolecreds.EC2RoleProvider{
+			Client: ec2metadata.New(session.New(), &aws.Config{
+				HTTPClient: &http.Client{Timeout: 1 * time.Second},
+			}),
+			ExpiryWindow: 3,
+		},
+	})
+
+	switch {
+	case fs.ConfigFileGetBool(remote, "env_auth", false):
+	case v.AccessKeyID == "" && v.SecretAccessKey == "":
+		// Anonymous access to a public bucket. URLs aren't signed, but
+		// redirecting still saves the bandwidth.
+		cred = credentials.AnonymousCredentials
+	case v.AccessKeyID == "":
+		return nil, errors.New("access_key_id not found")
+	case v.SecretAccessKey == "":
+		return nil, errors.New("secret_access_key not found")
+	}
+
+	endpoint := fs.ConfigFileGet(remote, "endpoint")
+	region := fs.ConfigFileGet(remote, "region")
+	if region == "other-v2-signature" {
+		// Only SigV4 is supported for presigning.
+		return nil, nil
+	}
+	if region == "" && endpoint == "" {
+		endpoint = "https://s3.amazonaws.com/"
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	awsConfig := aws.NewConfig().
+		WithRegion(region).
+		WithCredentials(cred).
+		WithEndpoint(endpoint).
+		WithS3ForcePathStyle(true)
+
+	return &s3Presigner{client: s3.New(session.New(), awsConfig)}, nil
+}
+
+func (p *s3Presigner) Presign(path string, ttl time.Duration, header http.Header) (string, error) {
+	bucket, key, err := splitBucketPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkHeaders(header, "Cache-Control", "Content-Disposition",
+		"Content-Encoding", "Content-Language", "Content-Type", "Expires")
+	if err != nil {
+		return "", err
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket:                     aws.String(bucket),
+		Key:                        aws.String(key),
+		ResponseCacheControl:       headerString(header, "Cache-Control"),
+		ResponseContentDisposition: headerString(header, "Content-Disposition"),
+		ResponseContentEncoding:    headerString(header, "Content-Encoding"),
+		ResponseContentLanguage:    headerString(header, "Content-Language"),
+		ResponseContentType:        headerString(header, "Content-Type"),
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return "", fmt.Errorf("couldn't parse Expires: %v", err)
+		}
+		input.ResponseExpires = &t
+	}
+
+	req, _ := p.client.GetObjectRequest(input)
+	return req.Presign(ttl)
+}
+
+// gcsPresigner makes V2 signed URLs for Google Cloud Storage remotes. It
+// needs a service account's private key, so only remotes configured with a
+// service_account_file are supported.
+type gcsPresigner struct {
+	email      string
+	privateKey *rsa.PrivateKey
+	now        func() time.Time
+}
+
+func newGCSPresigner(remote string) (presigner, error) {
+	serviceAccountPath := fs.ConfigFileGet(remote, "service_account_file")
+	if serviceAccountPath == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(os.ExpandEnv(serviceAccountPath))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read service account file: %v", err)
+	}
+
+	conf, err := google.JWTConfigFromJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse service account file: %v", err)
+	}
+
+	privateKey, err := parseRSAPrivateKey(conf.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse service account key: %v", err)
+	}
+
+	return &gcsPresigner{email: conf.Email, privateKey: privateKey, now: time.Now}, nil
+}
+
+func (p *gcsPresigner) Presign(path string, ttl time.Duration, header http.Header) (string, error) {
+	bucket, key, err := splitBucketPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkHeaders(header, "Content-Disposition", "Content-Type")
+	if err != nil {
+		return "", err
+	}
+
+	u := &url.URL{Path: "/" + bucket + "/" + key}
+	expires := strconv.FormatInt(p.now().Add(ttl).Unix(), 10)
+
+	// The string to sign is the method, content MD5, content type, and
+	// expiry followed by the resource. Only the method and expiry apply to
+	// downloads.
+	digest := sha256.Sum256([]byte("GET\n\n\n" + expires + "\n" + u.String()))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	u.Scheme = "https"
+	u.Host = "storage.googleapis.com"
+	query := url.Values{
+		"Expires":        {expires},
+		"GoogleAccessId": {p.email},
+		"Signature":      {base64.StdEncoding.EncodeToString(signature)},
+	}
+	if disposition := header.Get("Content-Disposition"); disposition != "" {
+		query.Set("response-content-disposition", disposition)
+	}
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		query.Set("response-content-type", contentType)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// parseRSAPrivateKey parses a PEM-encoded RSA private key in either PKCS #8
+// or PKCS #1 form.
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key isn't an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// b2DefaultEndpoint is where B2 accounts are authorized unless a remote
+// specifies its own endpoint.
+const b2DefaultEndpoint = "https://api.backblazeb2.com"
+
+// b2Presigner makes URLs carrying a download authorization for B2 remotes.
+//
+// Unlike S3 and GCS, B2 can't sign URLs offline, so each one takes API calls.
+// The account authorization and bucket IDs needed to make them are kept
+// between requests.
+type b2Presigner struct {
+	account  string
+	key      string
+	endpoint string
+	srv      *rest.Client
+
+	mu        sync.Mutex
+	auth      *api.AuthorizeAccountResponse
+	bucketIDs map[string]string
+}
+
+// b2DownloadAuthorizationRequest is passed to b2_get_download_authorization.
+type b2DownloadAuthorizationRequest struct {
+	BucketID               string `json:"bucketId"`
+	FileNamePrefix         string `json:"fileNamePrefix"`
+	ValidDurationInSeconds int64  `json:"validDurationInSeconds"`
+	B2ContentDisposition   string `json:"b2ContentDisposition,omitempty"`
+}
+
+// b2DownloadAuthorizationResponse is returned from
+// b2_get_download_authorization.
+type b2DownloadAuthorizationResponse struct {
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+func newB2Presigner(remote string) (presigner, error) {
+	account := fs.ConfigFileGet(remote, "account")
+	if account == "" {
+		return nil, errors.New("account not found")
+	}
+	key := fs.ConfigFileGet(remote, "key")
+	if key == "" {
+		return nil, errors.New("key not found")
+	}
+
+	return &b2Presigner{
+		account:   account,
+		key:       key,
+		endpoint:  fs.ConfigFileGet(remote, "endpoint", b2DefaultEndpoint),
+		srv:       rest.NewClient(fs.Config.Client()),
+		bucketIDs: make(map[string]string),
+	}, nil
+}
+
+func (p *b2Presigner) Presign(path string, ttl time.Duration, header http.Header) (string, error) {
+	bucket, key, err := splitBucketPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkHeaders(header, "Content-Disposition")
+	if err != nil {
+		return "", err
+	}
+	disposition := header.Get("Content-Disposition")
+
+	var auth *api.AuthorizeAccountResponse
+	var token string
+	for attempt := 0; attempt < 2; attempt++ {
+		auth, err = p.accountAuthorization()
+		if err != nil {
+			return "", err
+		}
+
+		var resp *http.Response
+		resp, token, err = p.downloadAuthorization(auth, bucket, key, ttl, disposition)
+		if err == nil {
+			break
+		}
+
+		// Account authorizations expire after a day. Get a new one.
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			return "", err
+		}
+		p.forgetAccountAuthorization(auth)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	u := &url.URL{Path: "/file/" + bucket + "/" + key}
+	query := url.Values{"Authorization": {token}}
+	if disposition != "" {
+		query.Set("b2ContentDisposition", disposition)
+	}
+	u.RawQuery = query.Encode()
+	return auth.DownloadURL + u.String(), nil
+}
+
+// accountAuthorization returns the account authorization, authorizing the
+// account if there isn't one yet.
+//
+// The presigner's lock is only held while its cached state is read or
+// written, never during API calls, so that requests don't wait on each other.
+// Two requests may both authorize the account at once, which is harmless.
+func (p *b2Presigner) accountAuthorization() (*api.AuthorizeAccountResponse, error) {
+	p.mu.Lock()
+	auth := p.auth
+	p.mu.Unlock()
+
+	if auth != nil {
+		return auth, nil
+	}
+
+	auth = new(api.AuthorizeAccountResponse)
+	_, err := p.srv.CallJSON(&rest.Opts{
+		Absolute: true,
+		Method:   "GET",
+		Path:     p.endpoint + "/b2api/v1/b2_authorize_account",
+		UserName: p.account,
+		Password: p.key,
+	}, nil, auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authorize B2 account: %v", err)
+	}
+
+	p.mu.Lock()
+	p.auth = auth
+	p.mu.Unlock()
+
+	return auth, nil
+}
+
+// forgetAccountAuthorization drops an account authorization that has
+// expired, unless another request has replaced it already.
+func (p *b2Presigner) forgetAccountAuthorization(auth *api.AuthorizeAccountResponse) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.auth == auth {
+		p.auth = nil
+	}
+}
+
+// bucketID looks up the ID of a bucket, listing the account's buckets if it
+// isn't known yet.
+func (p *b2Presigner) bucketID(auth *api.AuthorizeAccountResponse, bucket string) (*http.Response, string, error) {
+	p.mu.Lock()
+	bucketID, ok := p.bucketIDs[bucket]
+	p.mu.Unlock()
+
+	if ok {
+		return nil, bucketID, nil
+	}
+
+	var buckets api.ListBucketsResponse
+	resp, err := p.srv.CallJSON(&rest.Opts{
+		Absolute:     true,
+		Method:       "POST",
+		Path:         auth.APIURL + "/b2api/v1/b2_list_buckets",
+		ExtraHeaders: map[string]string{"Authorization": auth.AuthorizationToken},
+	}, &api.Account{ID: auth.AccountID}, &buckets)
+	if err != nil {
+		return resp, "", fmt.Errorf("failed to list B2 buckets: %v", err)
+	}
+
+	p.mu.Lock()
+	for _, b := range buckets.Buckets {
+		p.bucketIDs[b.Name] = b.ID
+	}
+	bucketID, ok = p.bucketIDs[bucket]
+	p.mu.Unlock()
+
+	if !ok {
+		return nil, "", fmt.Errorf("no such B2 bucket: %v", bucket)
+	}
+	return nil, bucketID, nil
+}
+
+// downloadAuthorization gets a token that allows the download of a single
+// object. It looks up the bucket's ID first if necessary.
+//
+// B2 authorizes downloads of every file whose name starts with a prefix, so
+// the object's name is only used as one after checking that no other file in
+// the bucket starts with it (like "file.txt.bak" or "file.txt/other"). If one
+// does, an error is returned and the file is proxied instead.
+//
+// The response of the failing call (if any) is returned along with an error so
+// that an expired account authorization can be detected.
+func (p *b2Presigner) downloadAuthorization(auth *api.AuthorizeAccountResponse, bucket, key string, ttl time.Duration, disposition string) (*http.Response, string, error) {
+	resp, bucketID, err := p.bucketID(auth, bucket)
+	if err != nil {
+		return resp, "", err
+	}
+
+	authHeader := map[string]string{"Authorization": auth.AuthorizationToken}
+
+	var files api.ListFileNamesResponse
+	resp, err = p.srv.CallJSON(&rest.Opts{
+		Absolute:     true,
+		Method:       "POST",
+		Path:         auth.APIURL + "/b2api/v1/b2_list_file_names",
+		ExtraHeaders: authHeader,
+	}, &api.ListFileNamesRequest{
+		BucketID:      bucketID,
+		StartFileName: key,
+		Prefix:        key,
+		MaxFileCount:  2,
+	}, &files)
+	if err != nil {
+		return resp, "", fmt.Errorf("failed to list B2 files: %v", err)
+	}
+
+	if len(files.Files) != 1 || files.Files[0].Name != key {
+		return nil, "", fmt.Errorf("B2 file %v isn't the only file with its name as a prefix", key)
+	}
+
+	// Durations are in whole seconds with a minimum of one.
+	seconds := int64(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	var authorization b2DownloadAuthorizationResponse
+	resp, err = p.srv.CallJSON(&rest.Opts{
+		Absolute:     true,
+		Method:       "POST",
+		Path:         auth.APIURL + "/b2api/v1/b2_get_download_authorization",
+		ExtraHeaders: authHeader,
+	}, &b2DownloadAuthorizationRequest{
+		BucketID:               bucketID,
+		FileNamePrefix:         key,
+		ValidDurationInSeconds: seconds,
+		B2ContentDisposition:   disposition,
+	}, &authorization)
+	if err != nil {
+		return resp, "", fmt.Errorf("failed to get B2 download authorization: %v", err)
+	}
+
+	return nil, authorization.AuthorizationToken, nil
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncw/rclone/b2/api"
+	"github.com/ncw/rclone/fs"
+	"github.com/ncw/rclone/rest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitBucketPath(t *testing.T) {
+	bucket, key, err := splitBucketPath("bucket/dir/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "bucket", bucket)
+	assert.Equal(t, "dir/file.txt", key)
+
+	for _, p := range []string{"bucket", "bucket/", "/file.txt"} {
+		_, _, err := splitBucketPath(p)
+		assert.Error(t, err, p)
+	}
+}
+
+func TestNewPresigner(t *testing.T) {
+	fs.LoadConfig()
+
+	os.Setenv("RCLONE_CONFIG_PRESIGNLOCAL_TYPE", "local")
+	defer os.Unsetenv("RCLONE_CONFIG_PRESIGNLOCAL_TYPE")
+	p, err := newPresigner("presignlocal")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	// Google Cloud Storage remotes without a service account can't sign.
+	os.Setenv("RCLONE_CONFIG_PRESIGNGCS_TYPE", "google cloud storage")
+	defer os.Unsetenv("RCLONE_CONFIG_PRESIGNGCS_TYPE")
+	p, err = newPresigner("presigngcs")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+}
+
+func TestS3Presigner(t *testing.T) {
+	fs.LoadConfig()
+
+	os.Setenv("RCLONE_CONFIG_PRESIGNS3_TYPE", "s3")
+	defer os.Unsetenv("RCLONE_CONFIG_PRESIGNS3_TYPE")
+	os.Setenv("RCLONE_CONFIG_PRESIGNS3_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	defer os.Unsetenv("RCLONE_CONFIG_PRESIGNS3_ACCESS_KEY_ID")
+	os.Setenv("RCLONE_CONFIG_PRESIGNS3_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("RCLONE_CONFIG_PRESIGNS3_SECRET_ACCESS_KEY")
+	os.Setenv("RCLONE_CONFIG_PRESIGNS3_REGION", "us-west-2")
+	defer os.Unsetenv("RCLONE_CONFIG_PRESIGNS3_REGION")
+
+	p, err := newPresigner("presigns3")
+	assert.NoError(t, err)
+
+	s, err := p.Presign("bucket/dir/file.txt", 5*time.Minute, http.Header{
+		"Cache-Control":       {"public, max-age=60"},
+		"Content-Disposition": {"attachment"},
+	})
+	assert.NoError(t, err)
+
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+	assert.Equal(t, "/bucket/dir/file.txt", u.Path)
+
+	query := u.Query()
+	assert.Equal(t, "300", query.Get("X-Amz-Expires"))
+	assert.Contains(t, query.Get("X-Amz-Credential"), "AKIDEXAMPLE/")
+	assert.Contains(t, query.Get("X-Amz-Credential"), "/us-west-2/s3/")
+	assert.NotEmpty(t, query.Get("X-Amz-Signature"))
+	assert.Equal(t, "attachment", query.Get("response-content-disposition"))
+	assert.Equal(t, "public, max-age=60", query.Get("response-cache-control"))
+	assert.Equal(t, "", query.Get("response-content-type"))
+}
+
+func TestGCSPresigner(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	p := &gcsPresigner{
+		email:      "signer@project.iam.gserviceaccount.com",
+		privateKey: privateKey,
+		now:        func() time.Time { return time.Unix(1484239044, 0) },
+	}
+
+	s, err := p.Presign("bucket/dir/a file.txt", 5*time.Minute, http.Header{
+		"Content-Disposition": {`inline; filename="a file.txt"`},
+	})
+	assert.NoError(t, err)
+
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+	assert.Equal(t, "storage.googleapis.com", u.Host)
+	assert.Equal(t, "/bucket/dir/a%20file.txt", u.EscapedPath())
+
+	query := u.Query()
+	assert.Equal(t, "1484239344", query.Get("Expires"))
+	assert.Equal(t, p.email, query.Get("GoogleAccessId"))
+	assert.Equal(t, `inline; filename="a file.txt"`, query.Get("response-content-disposition"))
+
+	signature, err := base64.StdEncoding.DecodeString(query.Get("Signature"))
+	assert.NoError(t, err)
+	digest := sha256.Sum256([]byte("GET\n\n\n1484239344\n/bucket/dir/a%20file.txt"))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&privateKey.PublicKey, crypto.SHA256, digest[:], signature))
+
+	// Google Cloud Storage can only override some headers.
+	_, err = p.Presign("bucket/dir/a file.txt", 5*time.Minute, http.Header{
+		"Cache-Control": {"no-cache"},
+	})
+	assert.Error(t, err)
+}
+
+func TestParseRSAPrivateKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+	parsed, err := parseRSAPrivateKey(data)
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey.D, parsed.D)
+
+	_, err = parseRSAPrivateKey([]byte("not a key"))
+	assert.Error(t, err)
+}
+
+func TestB2Presigner(t *testing.T) {
+	numAuthorizations := 0
+	numDownloadAuthorizations := 0
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v1/b2_authorize_account":
+			numAuthorizations++
+			json.NewEncoder(w).Encode(map[string]string{
+				"accountId":          "account",
+				"authorizationToken": "account-token",
+				"apiUrl":             server.URL,
+				"downloadUrl":        "https://f001.backblazeb2.com",
+			})
+
+		case "/b2api/v1/b2_list_buckets":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"buckets": []map[string]string{{"bucketId": "bucket-id", "bucketName": "bucket"}},
+			})
+
+		case "/b2api/v1/b2_list_file_names":
+			var req api.ListFileNamesRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			assert.Equal(t, 2, req.MaxFileCount)
+			json.NewEncoder(w).Encode(listTestB2Files(req))
+
+		case "/b2api/v1/b2_get_download_authorization":
+			numDownloadAuthorizations++
+
+			// Pretend that the first account authorization expired.
+			if numDownloadAuthorizations == 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"status":401,"code":"expired_auth_token"}`))
+				return
+			}
+
+			var req b2DownloadAuthorizationRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			assert.Equal(t, "bucket-id", req.BucketID)
+			assert.Equal(t, "dir/file.txt", req.FileNamePrefix)
+			assert.Equal(t, int64(300), req.ValidDurationInSeconds)
+
+			json.NewEncoder(w).Encode(map[string]string{"authorizationToken": "download-token"})
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	p := &b2Presigner{
+		endpoint:  server.URL,
+		srv:       rest.NewClient(http.DefaultClient),
+		bucketIDs: make(map[string]string),
+	}
+
+	s, err := p.Presign("bucket/dir/file.txt", 5*time.Minute, http.Header{"Content-Disposition": {"attachment"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://f001.backblazeb2.com/file/bucket/dir/file.txt?"+
+		"Authorization=download-token&b2ContentDisposition=attachment", s)
+	assert.Equal(t, 2, numAuthorizations)
+
+	_, err = p.Presign("other/file.txt", 5*time.Minute, http.Header{"Content-Disposition": {"attachment"}})
+	assert.Error(t, err)
+
+	// A download authorization for a file would also cover the files whose
+	// names start with its name, so those aren't presigned.
+	_, err = p.Presign("bucket/dir/report.pdf", 5*time.Minute, http.Header{"Content-Disposition": {"attachment"}})
+	assert.Error(t, err)
+	_, err = p.Presign("bucket/dir/missing.pdf", 5*time.Minute, http.Header{"Content-Disposition": {"attachment"}})
+	assert.Error(t, err)
+}
+
+// testB2Files are the files in the bucket of the fake B2 API, in order.
+var testB2Files = []string{"dir/file.txt", "dir/report.pdf", "dir/report.pdf.bak"}
+
+// listTestB2Files answers a b2_list_file_names request for testB2Files.
+func listTestB2Files(req api.ListFileNamesRequest) api.ListFileNamesResponse {
+	var resp api.ListFileNamesResponse
+	for _, name := range testB2Files {
+		if name < req.StartFileName || !strings.HasPrefix(name, req.Prefix) {
+			continue
+		}
+		if len(resp.Files) == req.MaxFileCount {
+			resp.NextFileName = &name
+			break
+		}
+		resp.Files = append(resp.Files, api.File{Name: name, Action: "upload"})
+	}
+	return resp
+}
+
+func TestB2PresignerConcurrent(t *testing.T) {
+	// Download authorizations are only handed out once two requests are
+	// waiting for one, which never happens if the presigner makes them one
+	// at a time.
+	arrived := make(chan struct{}, 2)
+	bothArrived := make(chan struct{})
+	go func() {
+		<-arrived
+		<-arrived
+		close(bothArrived)
+	}()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v1/b2_authorize_account":
+			json.NewEncoder(w).Encode(map[string]string{
+				"accountId":          "account",
+				"authorizationToken": "account-token",
+				"apiUrl":             server.URL,
+				"downloadUrl":        "https://f001.backblazeb2.com",
+			})
+
+		case "/b2api/v1/b2_list_buckets":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"buckets": []map[string]string{{"bucketId": "bucket-id", "bucketName": "bucket"}},
+			})
+
+		case "/b2api/v1/b2_list_file_names":
+			var req api.ListFileNamesRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			json.NewEncoder(w).Encode(listTestB2Files(req))
+
+		case "/b2api/v1/b2_get_download_authorization":
+			arrived <- struct{}{}
+			select {
+			case <-bothArrived:
+			case <-time.After(5 * time.Second):
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"authorizationToken": "download-token"})
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	p := &b2Presigner{
+		endpoint:  server.URL,
+		srv:       rest.NewClient(http.DefaultClient),
+		bucketIDs: make(map[string]string),
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := p.Presign("bucket/dir/file.txt", 5*time.Minute, http.Header{})
+			errs <- err
+		}()
+	}
+	assert.NoError(t, <-errs)
+	assert.NoError(t, <-errs)
+}
+
+type fakePresigner struct{}
+
+func (p *fakePresigner) Presign(path string, ttl time.Duration, header http.Header) (string, error) {
+	return "https://backend.example.com/" + path + "?" +
+		url.Values{"ttl": {ttl.String()}, "disposition": {header.Get("Content-Disposition")}}.Encode(), nil
+}
+
+func TestServeHTTPRedirect(t *testing.T) {
+	os.Setenv("RCLONE_CONFIG_PRESIGNFAKE_TYPE", "s3")
+	defer os.Unsetenv("RCLONE_CONFIG_PRESIGNFAKE_TYPE")
+
+	s := newTestServer(t)
+	s.opts.RedirectTTL = 5 * time.Minute
+	s.presigners = map[string]presigner{"presignfake": &fakePresigner{}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", signTestPath(t, "presignfake", "bucket/file.txt", url.Values{}), nil)
+	s.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://backend.example.com/bucket/file.txt?disposition=attachment&ttl=5m0s",
+		w.Header().Get("Location"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// errNoOverlap is returned by parseRange if the first-byte-pos of all of the
+// byte-range-spec values is greater than the content size.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// httpRange specifies the byte range to be sent to the client.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// openRange opens an object so that it's read from the start of the given
+// range and returns EOF after the range's length.
+//
+// We don't use fs.RangeOption here because most backends in the vendored
+// rclone don't understand it (and its header is malformed). Instead, we seek
+// to the start of the range, which every backend supports, and stop reading
+// once we have enough bytes. HTTP-based backends stop transferring when the
+// body is closed, so only around the requested bytes are fetched.
+func openRange(obj fs.Object, ra httpRange) (io.ReadCloser, error) {
+	var options []fs.OpenOption
+	if ra.start > 0 {
+		options = append(options, &fs.SeekOption{Offset: ra.start})
+	}
+
+	in, err := obj.Open(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &limitedReadCloser{io.LimitReader(in, ra.length), in}, nil
+}
+
+// limitedReadCloser pairs a limited reader with the closer of the stream that
+// it reads from.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// parseRange parses a Range header string as per RFC 7233.
+//
+// errNoOverlap is returned if none of the ranges overlap the content.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil // header not present
+	}
+
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, errors.New("invalid range")
+		}
+		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+
+		var r httpRange
+		if start == "" {
+			// If no start is specified, end specifies the range start
+			// relative to the end of the file.
+			i, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i == 0 {
+				noOverlap = true
+				continue
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i >= size {
+				// If the range begins after the size of the content, then
+				// it does not overlap.
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				// If no end is specified, range extends to end of the file.
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// rangesMIMESize returns the number of bytes it takes to encode the provided
+// ranges as a multipart response.
+func rangesMIMESize(ranges []httpRange, contentType string, size int64) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+
+	var encSize int64
+	for _, ra := range ranges {
+		mw.CreatePart(ra.mimeHeader(contentType, size))
+		encSize += ra.length
+	}
+	mw.Close()
+
+	return encSize + int64(w)
+}
+
+func sumRangesSize(ranges []httpRange) int64 {
+	var size int64
+	for _, ra := range ranges {
+		size += ra.length
+	}
+	return size
+}
+
+// countingWriter counts how many bytes have been written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
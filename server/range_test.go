@@ -0,0 +1,130 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	ranges, err := parseRange("", 10)
+	assert.NoError(t, err)
+	assert.Nil(t, ranges)
+
+	ranges, err = parseRange("bytes=0-4", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []httpRange{{0, 5}}, ranges)
+
+	ranges, err = parseRange("bytes=5-", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []httpRange{{5, 5}}, ranges)
+
+	ranges, err = parseRange("bytes=-3", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []httpRange{{7, 3}}, ranges)
+
+	ranges, err = parseRange("bytes=8-100", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []httpRange{{8, 2}}, ranges)
+
+	ranges, err = parseRange("bytes=0-0, 2-3", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []httpRange{{0, 1}, {2, 2}}, ranges)
+
+	_, err = parseRange("bytes=10-", 10)
+	assert.Equal(t, errNoOverlap, err)
+
+	_, err = parseRange("bytes=5-4", 10)
+	assert.Error(t, err)
+
+	_, err = parseRange("items=0-4", 10)
+	assert.Error(t, err)
+}
+
+func TestServeHTTPRange(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{"file.txt": "hello, world"})
+	target := signTestPath(t, "remote", "file.txt", url.Values{"v": {"2"}})
+
+	w := serveTest(s, "GET", target, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	assert.Equal(t, "12", w.Header().Get("Content-Length"))
+	assert.Equal(t, "hello, world", w.Body.String())
+
+	w = serveTest(s, "GET", target, http.Header{"Range": {"bytes=7-"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 7-11/12", w.Header().Get("Content-Range"))
+	assert.Equal(t, "5", w.Header().Get("Content-Length"))
+	assert.Equal(t, "world", w.Body.String())
+
+	// A HEAD request describes the range without sending it.
+	w = serveTest(s, "HEAD", target, http.Header{"Range": {"bytes=0-4"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 0-4/12", w.Header().Get("Content-Range"))
+	assert.Equal(t, "5", w.Header().Get("Content-Length"))
+	assert.Equal(t, "", w.Body.String())
+}
+
+func TestServeHTTPMultipleRanges(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{"file.txt": "hello, world"})
+	target := signTestPath(t, "remote", "file.txt", url.Values{"v": {"2"}})
+
+	w := serveTest(s, "GET", target, http.Header{"Range": {"bytes=0-4,7-11"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, expected := range []struct{ contentRange, content string }{
+		{"bytes 0-4/12", "hello"},
+		{"bytes 7-11/12", "world"},
+	} {
+		part, err := mr.NextPart()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, expected.contentRange, part.Header.Get("Content-Range"))
+		assert.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+
+		content, err := ioutil.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.content, string(content))
+	}
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServeHTTPUnsatisfiableRange(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{"file.txt": "hello, world"})
+	target := signTestPath(t, "remote", "file.txt", url.Values{"v": {"2"}})
+
+	w := serveTest(s, "GET", target, http.Header{"Range": {"bytes=100-"}})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	assert.Equal(t, "bytes */12", w.Header().Get("Content-Range"))
+}
+
+func TestServeHTTPIfRange(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{"file.txt": "hello, world"})
+	target := signTestPath(t, "remote", "file.txt", url.Values{"v": {"2"}})
+
+	etag := serveTest(s, "HEAD", target, nil).Header().Get("ETag")
+
+	w := serveTest(s, "GET", target, http.Header{"Range": {"bytes=7-"}, "If-Range": {etag}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "world", w.Body.String())
+
+	// The file has changed since, so the whole of it is sent.
+	w = serveTest(s, "GET", target, http.Header{"Range": {"bytes=7-"}, "If-Range": {`"stale"`}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello, world", w.Body.String())
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// maxReadResumes is how many times in a row a read from a remote that fails
+// partway through is resumed before giving up.
+const maxReadResumes = 3
+
+// resumeBackoff is how long to wait before resuming a failed read. It's
+// multiplied by the number of resumes in a row.
+var resumeBackoff = 500 * time.Millisecond
+
+// resumingReader reads a range of an object. If the read fails partway
+// through, or the stream ends before the range does, the object is opened
+// again from where it left off.
+//
+// By the time a read fails, the response's header and some of its body have
+// usually been sent, so resuming is the only way to still deliver the file.
+type resumingReader struct {
+	obj  fs.Object
+	logf func(format string, v ...interface{})
+
+	// in is the current stream, and ra is what's left of the range.
+	in io.ReadCloser
+	ra httpRange
+
+	// resumes counts resumes since data was last read.
+	resumes int
+}
+
+func newResumingReader(obj fs.Object, ra httpRange, logf func(string, ...interface{})) (*resumingReader, error) {
+	in, err := openRange(obj, ra)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resumingReader{obj: obj, logf: logf, in: in, ra: ra}, nil
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		if r.ra.length <= 0 {
+			return 0, io.EOF
+		}
+
+		n, err := r.in.Read(p)
+		r.ra.start += int64(n)
+		r.ra.length -= int64(n)
+		if n > 0 {
+			r.resumes = 0
+		}
+
+		if err == nil || r.ra.length <= 0 {
+			return n, nil
+		}
+
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		err = r.resume(err)
+		if err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume reopens the object from the current offset after a read failed
+// with cause. It returns an error if resuming isn't possible or keeps
+// failing.
+func (r *resumingReader) resume(cause error) error {
+	r.in.Close()
+	r.in = nil
+
+	// Credentials that have gone bad won't work any better the second time.
+	if isAuthError(cause) {
+		return cause
+	}
+
+	for r.resumes < maxReadResumes {
+		r.resumes++
+		r.logf("Read of %s failed at byte %d, resuming (attempt %d of %d): %v",
+			r.obj.Remote(), r.ra.start, r.resumes, maxReadResumes, cause)
+		time.Sleep(resumeBackoff * time.Duration(r.resumes))
+
+		in, err := openRange(r.obj, r.ra)
+		if err == nil {
+			r.in = in
+			return nil
+		}
+		cause = err
+	}
+
+	return cause
+}
+
+func (r *resumingReader) Close() error {
+	if r.in == nil {
+		return nil
+	}
+	return r.in.Close()
+}
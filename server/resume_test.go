@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyObject is a fakeObject whose streams fail after a few bytes have been
+// read from them.
+type flakyObject struct {
+	fakeObject
+
+	// failAfter is how many bytes each stream delivers before failing, and
+	// failures is how many more streams fail.
+	failAfter int
+	failures  int
+
+	// truncate makes streams end early instead of returning an error.
+	truncate bool
+
+	opens int
+}
+
+func (o *flakyObject) Open(options ...fs.OpenOption) (io.ReadCloser, error) {
+	o.opens++
+
+	content := o.content
+	for _, option := range options {
+		if seek, ok := option.(*fs.SeekOption); ok {
+			content = content[seek.Offset:]
+		}
+	}
+
+	if o.failures <= 0 || len(content) <= o.failAfter {
+		return ioutil.NopCloser(strings.NewReader(content)), nil
+	}
+	o.failures--
+
+	r := io.Reader(strings.NewReader(content[:o.failAfter]))
+	if !o.truncate {
+		r = io.MultiReader(r, &errorReader{errors.New("connection reset")})
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestResumingReader(t *testing.T) {
+	defer func(backoff time.Duration) { resumeBackoff = backoff }(resumeBackoff)
+	resumeBackoff = 0
+	logf := func(string, ...interface{}) {}
+
+	obj := &flakyObject{fakeObject: fakeObject{content: "hello, world"}, failAfter: 3, failures: 2}
+	r, err := newResumingReader(obj, httpRange{start: 1, length: 10}, logf)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "ello, worl", string(content))
+	assert.Equal(t, 3, obj.opens)
+	assert.NoError(t, r.Close())
+
+	// Streams that end early are resumed too.
+	obj = &flakyObject{fakeObject: fakeObject{content: "hello, world"}, failAfter: 5, failures: 1, truncate: true}
+	r, err = newResumingReader(obj, httpRange{start: 0, length: 12}, logf)
+	assert.NoError(t, err)
+	content, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world", string(content))
+
+	// Resuming gives up when no data is read between failures.
+	obj = &flakyObject{fakeObject: fakeObject{content: "hello, world"}, failAfter: 0, failures: 10}
+	r, err = newResumingReader(obj, httpRange{start: 0, length: 12}, logf)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.EqualError(t, err, "connection reset")
+	assert.Equal(t, 1+maxReadResumes, obj.opens)
+	assert.NoError(t, r.Close())
+
+	// But not when some data is.
+	obj = &flakyObject{fakeObject: fakeObject{content: "hello, world"}, failAfter: 1, failures: 10}
+	r, err = newResumingReader(obj, httpRange{start: 0, length: 12}, logf)
+	assert.NoError(t, err)
+	content, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world", string(content))
+}
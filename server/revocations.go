@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/ncw/rclone/fs"
+)
+
+// revocationList holds the links that have been revoked, keyed by the digest
+// of their signatures.
+//
+// Each revocation is kept until the link that it revokes expires. After that
+// the link is refused anyway, so it's pruned from the list.
+type revocationList struct {
+	// file is a local file to read revocations from. Optional.
+	file string
+
+	// remotePath is a file in an rclone remote, of the form "remote:path",
+	// to read revocations from. Optional.
+	remotePath string
+
+	now func() time.Time
+
+	mu          sync.RWMutex
+	revocations map[string]time.Time
+}
+
+func newRevocationList(file, remotePath string) *revocationList {
+	return &revocationList{
+		file:        file,
+		remotePath:  remotePath,
+		now:         time.Now,
+		revocations: make(map[string]time.Time),
+	}
+}
+
+// Revoked returns whether the link with the given digest (see
+// common.LinkDigest) has been revoked.
+func (l *revocationList) Revoked(digest string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	_, ok := l.revocations[digest]
+	return ok
+}
+
+// Replace swaps in a new set of revocations, leaving out those for links that
+// have already expired.
+func (l *revocationList) Replace(revocations []common.Revocation) {
+	now := l.now()
+
+	m := make(map[string]time.Time)
+	for _, revocation := range revocations {
+		expiresAt := time.Unix(revocation.ExpiresAt, 0)
+		if expiresAt.Before(now) {
+			continue
+		}
+		m[revocation.Digest] = expiresAt
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.revocations = m
+}
+
+// loadRevocations reads the server's revocation list from its file and remote
+// path and replaces the revocations that it had before.
+func (s *Server) loadRevocations() error {
+	var revocations []common.Revocation
+
+	if s.revocations.file != "" {
+		f, err := os.Open(s.revocations.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fileRevocations, err := common.ParseRevocations(f)
+		if err != nil {
+			return fmt.Errorf("%v: %v", s.revocations.file, err)
+		}
+		revocations = append(revocations, fileRevocations...)
+	}
+
+	if s.revocations.remotePath != "" {
+		remoteRevocations, err := s.readRemoteRevocations(s.revocations.remotePath)
+		if err != nil {
+			return fmt.Errorf("%v: %v", s.revocations.remotePath, err)
+		}
+		revocations = append(revocations, remoteRevocations...)
+	}
+
+	s.revocations.Replace(revocations)
+	return nil
+}
+
+func (s *Server) readRemoteRevocations(remotePath string) (revocations []common.Revocation, err error) {
+	remote, path, err := common.SplitRemotePath(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := s.newObject(remote, path)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := obj.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fs.CheckClose(in, &err)
+
+	return common.ParseRevocations(in)
+}
+
+// pollRevocations reloads the server's revocation list until the server is
+// closed. If a reload fails, the revocations that were loaded before are kept.
+func (s *Server) pollRevocations(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := s.loadRevocations()
+			if err != nil {
+				s.logf("Error reloading revocations: %v", err)
+			}
+
+		case <-s.stop:
+			return
+		}
+	}
+}
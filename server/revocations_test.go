@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/signer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhttpserve")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := newTestServer(t)
+	path := filepath.Join(dir, "revocations.txt")
+	s.revocations = newRevocationList(path, "")
+
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{"v": {"2"}})
+	signed, err := signer.Parse(target, nil)
+	assert.NoError(t, err)
+
+	revocation := common.Revocation{
+		Digest:    signed.Digest(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+	expired := common.Revocation{
+		Digest:    common.LinkDigest([]byte("other")),
+		ExpiresAt: time.Now().Add(-time.Hour).Unix(),
+	}
+
+	err = ioutil.WriteFile(path, []byte(revocation.String()+"\n"+expired.String()+"\n"), 0644)
+	assert.NoError(t, err)
+	assert.NoError(t, s.loadRevocations())
+
+	link, w := verifyTestLink(s, "GET", target)
+	assert.Nil(t, link)
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	// Re-encoding the signature doesn't get around the revocation.
+	link, w = verifyTestLink(s, "GET", malleateTestPath(t, target))
+	assert.Nil(t, link)
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	// Revocations for links that have expired are pruned.
+	assert.False(t, s.revocations.Revoked(expired.Digest))
+
+	// A list that can't be read leaves the previous revocations in place.
+	err = ioutil.WriteFile(path, []byte("garbage\n"), 0644)
+	assert.NoError(t, err)
+	assert.Error(t, s.loadRevocations())
+	assert.True(t, s.revocations.Revoked(revocation.Digest))
+
+	err = ioutil.WriteFile(path, nil, 0644)
+	assert.NoError(t, err)
+	assert.NoError(t, s.loadRevocations())
+
+	link, _ = verifyTestLink(s, "GET", target)
+	assert.NotNil(t, link)
+}
+
+func TestRemoteRevocations(t *testing.T) {
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{"v": {"2"}})
+	signed, err := signer.Parse(target, nil)
+	assert.NoError(t, err)
+
+	revocation := common.Revocation{
+		Digest:    signed.Digest(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+
+	// The list is in a bucket, which the remote's Fs has to be rooted in to
+	// find it.
+	s := newTestFileServer(t, map[string]string{
+		"config/revocations.txt": revocation.String() + "\n",
+	})
+	s.opts.Remotes.(testRemotes).fs.buckets = true
+	s.revocations = newRevocationList("", "remote:config/revocations.txt")
+	assert.NoError(t, s.loadRevocations())
+	assert.True(t, s.revocations.Revoked(revocation.Digest))
+
+	s.revocations = newRevocationList("", "remote:config/missing.txt")
+	assert.Error(t, s.loadRevocations())
+}
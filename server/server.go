@@ -0,0 +1,756 @@
+// Package server implements the rhttpserve server as an http.Handler so that
+// it can be mounted inside other Go programs. The serve command is a thin
+// wrapper around it that reads its options from the environment.
+//
+// The handler expects request paths of the form /<remote>/<path> (or
+// /.t/<token> for opaque links), so it should be mounted at the root of its
+// host. Directory indexes link to other files by absolute path.
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Defaults for options that are left unset.
+const (
+	DefaultFsCacheIdleTimeout = 30 * time.Minute
+	DefaultRedirectTTL        = 5 * time.Minute
+	DefaultUnlockTTL          = 10 * time.Minute
+)
+
+// Logger is where a server logs the requests that it serves and any errors.
+// *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// RemoteResolver finds the rclone file systems for the remotes that links
+// point to.
+type RemoteResolver interface {
+	// Configured returns whether a remote can be served from at all.
+	// Links to remotes that aren't are refused before NewFs is called.
+	Configured(remote string) bool
+
+	// NewFs creates an Fs rooted at a directory of a remote, or at the
+	// remote's root if root is empty. The first element of every path that
+	// has more than one is made the root, so for bucket-based backends it's
+	// always a bucket. Servers cache the results, so it's only called once in
+	// a while for each remote and root.
+	NewFs(remote, root string) (fs.Fs, error)
+}
+
+// EnvRemotes resolves remotes configured in rclone's usual way. Only remotes
+// configured through RCLONE_CONFIG_* environment variables are served, so
+// remotes in the rclone config file aren't exposed by accident.
+type EnvRemotes struct{}
+
+// Configured returns whether the remote has a type set in the environment.
+func (EnvRemotes) Configured(remote string) bool {
+	envRemoteName := "RCLONE_CONFIG_" + strings.ToUpper(strings.Replace(remote+"_TYPE", "-", "_", -1))
+	_, found := os.LookupEnv(envRemoteName)
+	return found
+}
+
+// NewFs creates an Fs for the remote from rclone's configuration.
+func (EnvRemotes) NewFs(remote, root string) (fs.Fs, error) {
+	return fs.NewFs(remote + ":" + root)
+}
+
+// LinkInfo describes a link that a request was made with, after its signature
+// has been verified. It's given to policy hooks.
+type LinkInfo struct {
+	Remote string
+
+	// Path is the path of the object being requested. For a prefix-scoped
+	// link, it's somewhere under Prefix.
+	Path   string
+	Prefix string
+
+	ExpiresAt time.Time
+	KeyID     string
+
+	// Digest identifies the link, as in revocation lists.
+	Digest string
+
+	// Params are the link's query parameters.
+	Params url.Values
+}
+
+// Options configure a server. Only PublicKeys is required.
+type Options struct {
+	// AcceptV1 is whether links signed with the original message format
+	// (which doesn't cover any parameters besides expiry and key ID) are
+	// accepted.
+	AcceptV1 bool
+
+	// Authorize is a policy hook that's called for every request with a
+	// valid link before anything is served. If it returns an error, the
+	// request is refused with 403 Forbidden and the error's message.
+	// Optional.
+	Authorize func(r *http.Request, link LinkInfo) error
+
+	// ClockSkew is the tolerance given to times in links to allow for the
+	// clocks of the server and signing clients not quite agreeing.
+	ClockSkew time.Duration
+
+	// CookieKey signs the cookies that unlock password-protected links. If
+	// it's empty, a random one is generated, so cookies don't survive
+	// restarts and aren't shared between servers.
+	CookieKey []byte
+
+	// DigestTrailer is whether a SHA-256 digest is computed while streaming
+	// files whose backend can't provide a checksum, and sent in a
+	// Repr-Digest trailer. Responses that carry it don't have a
+	// Content-Length.
+	DigestTrailer bool
+
+	// DownloadsFile is where the number of times that links with a download
+	// limit have been used is kept. Links with a limit are refused unless
+	// it's set.
+	DownloadsFile string
+
+	// ForwardedHeader is the header that trusted proxies record the
+	// addresses that they forward requests for in, either X-Forwarded-For or
+	// Forwarded. Defaults to X-Forwarded-For.
+	ForwardedHeader string
+
+	// FsCacheIdleTimeout is how long a remote's Fs is kept after it was
+	// last used. Defaults to DefaultFsCacheIdleTimeout.
+	FsCacheIdleTimeout time.Duration
+
+	// Logger defaults to the standard logger.
+	Logger Logger
+
+	// MaxTTL is the longest that a link may be valid for, measured from its
+	// not_before (or from when it was issued if it doesn't have one) to its
+	// expiry. Links that say neither are refused, except for ones in the
+	// original format, which are measured from now. 0 means no limit.
+	MaxTTL time.Duration
+
+	// PublicKeys are the keys trusted to verify signatures, keyed by key ID.
+	// A key under the empty ID verifies links that don't carry a key ID.
+	PublicKeys map[string]ed25519.PublicKey
+
+	// RedirectRemotes are remotes whose files are served by redirecting to a
+	// presigned URL on their backend instead of proxying them. S3, Google
+	// Cloud Storage (with a service account), and B2 remotes are supported,
+	// and others are proxied anyway.
+	RedirectRemotes []string
+
+	// RedirectTTL is how long presigned URLs that clients are redirected to
+	// stay valid. Defaults to DefaultRedirectTTL.
+	RedirectTTL time.Duration
+
+	// Remotes resolves the remotes that links point to. Defaults to
+	// EnvRemotes.
+	Remotes RemoteResolver
+
+	// RevocationsFile and RevocationsPath are a local file and a file in a
+	// remote (of the form "remote:path") listing revoked links. Both are
+	// optional, and they're reloaded every RevocationsPollInterval if it's
+	// set.
+	RevocationsFile         string
+	RevocationsPath         string
+	RevocationsPollInterval time.Duration
+
+	// TokenKey decrypts the tokens of opaque links. Opaque links are refused
+	// if it's nil.
+	TokenKey *[32]byte
+
+	// TrustedProxies are proxies whose forwarding headers are believed when
+	// working out the address of a client.
+	TrustedProxies []*net.IPNet
+
+	// UnlockTTL is how long a password-protected link stays unlocked for.
+	// Defaults to DefaultUnlockTTL.
+	UnlockTTL time.Duration
+
+	// Verbose logs more detail about each request, like why a link was
+	// refused.
+	Verbose bool
+}
+
+// Server serves files out of rclone remotes for requests made with a valid
+// link. Create one with New.
+type Server struct {
+	// abortedResponses and clientAbortedResponses count responses cut off
+	// after their header was sent. They're accessed atomically, so they're
+	// first to keep them 64-bit aligned.
+	abortedResponses       int64
+	clientAbortedResponses int64
+
+	opts Options
+
+	// downloads counts the downloads of links with a download limit. It's
+	// nil if they're not supported.
+	downloads *downloadStore
+
+	// fsCache holds Fs instances for remotes so that they can be reused
+	// between requests.
+	fsCache *fsCache
+
+	// passwordAttempts limits how often passwords can be tried for each
+	// password-protected link.
+	passwordAttempts *attemptLimiter
+
+	// presigners are keyed by the remotes whose files should be served
+	// through a redirect.
+	presigners map[string]presigner
+
+	// revocations are links that have been revoked. It's nil if no
+	// revocation list is configured.
+	revocations *revocationList
+
+	// stop is closed by Close to stop background work. closeOnce makes sure
+	// that only the first call to Close does anything, and closeErr is what
+	// it returned.
+	stop      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// New creates a server. Any files that it's configured with are loaded right
+// away, and reloading revocations (if they're configured to be) starts in the
+// background until the server is closed.
+//
+// rclone's configuration is loaded with fs.LoadConfig if the program hasn't
+// loaded it already. Backends still need to be imported by the program (all
+// of them with github.com/ncw/rclone/fs/all).
+func New(opts Options) (*Server, error) {
+	if len(opts.PublicKeys) < 1 {
+		return nil, fmt.Errorf("need at least one public key")
+	}
+
+	loadRcloneConfig()
+
+	if opts.ForwardedHeader == "" {
+		opts.ForwardedHeader = "X-Forwarded-For"
+	}
+	opts.ForwardedHeader = http.CanonicalHeaderKey(opts.ForwardedHeader)
+	if opts.ForwardedHeader != "X-Forwarded-For" && opts.ForwardedHeader != "Forwarded" {
+		return nil, fmt.Errorf("forwarded header must be X-Forwarded-For or Forwarded, not %v",
+			opts.ForwardedHeader)
+	}
+
+	if opts.FsCacheIdleTimeout == 0 {
+		opts.FsCacheIdleTimeout = DefaultFsCacheIdleTimeout
+	}
+	if opts.Logger == nil {
+		opts.Logger = stdLogger{}
+	}
+	if opts.RedirectTTL == 0 {
+		opts.RedirectTTL = DefaultRedirectTTL
+	}
+	if opts.Remotes == nil {
+		opts.Remotes = EnvRemotes{}
+	}
+	if opts.UnlockTTL == 0 {
+		opts.UnlockTTL = DefaultUnlockTTL
+	}
+
+	if len(opts.CookieKey) == 0 {
+		opts.Logger.Printf("No cookie key is set, so password-protected links " +
+			"will need to be unlocked again after a restart")
+		opts.CookieKey = make([]byte, 32)
+		_, err := rand.Read(opts.CookieKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		opts:             opts,
+		fsCache:          newFsCache(opts.FsCacheIdleTimeout, opts.Remotes.NewFs),
+		passwordAttempts: newAttemptLimiter(maxPasswordAttempts, passwordAttemptWindow),
+		presigners:       make(map[string]presigner),
+		stop:             make(chan struct{}),
+	}
+
+	for _, remote := range opts.RedirectRemotes {
+		p, err := newPresigner(remote)
+		if err != nil {
+			return nil, fmt.Errorf("remote %v: %v", remote, err)
+		}
+
+		if p == nil {
+			s.logf("Remote %s can't be redirected to, proxying it instead", remote)
+			continue
+		}
+		s.presigners[remote] = p
+	}
+
+	if opts.DownloadsFile != "" {
+		var err error
+		s.downloads, err = openDownloadStore(opts.DownloadsFile, opts.Logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.RevocationsFile != "" || opts.RevocationsPath != "" {
+		s.revocations = newRevocationList(opts.RevocationsFile, opts.RevocationsPath)
+
+		err := s.loadRevocations()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		if opts.RevocationsPollInterval > 0 {
+			go s.pollRevocations(opts.RevocationsPollInterval)
+		}
+	}
+
+	return s, nil
+}
+
+// Close stops the server's background work and closes its files. Requests
+// shouldn't be served after it's called. Calling it again does nothing, and
+// returns the same error as the first call.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+
+		if s.downloads != nil {
+			s.closeErr = s.downloads.Close()
+		}
+	})
+	return s.closeErr
+}
+
+// ServeHTTP serves a file out of an rclone remote based on the request path
+// and whether a valid signature was included.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Don't serve non-GET|HEAD (besides POSTs of password forms) or anything
+	// at root (because we know it's not a file).
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "POST" || r.URL.Path == "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	opaque := isTokenRequest(r)
+	if opaque {
+		var ok bool
+		r, ok = s.openTokenRequest(w, r)
+		if !ok {
+			return
+		}
+	}
+
+	link, ok := s.verifyLink(w, r, opaque)
+	if !ok {
+		return
+	}
+
+	// Links to files in an index would give away their paths.
+	if opaque && link.prefix != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Opaque links can't be scoped to a prefix"))
+		return
+	}
+
+	if !s.checkPassword(w, r, link) {
+		return
+	}
+
+	if s.opts.Authorize != nil {
+		err := s.opts.Authorize(r, link.info())
+		if err != nil {
+			if s.opts.Verbose {
+				s.logf("Refused by policy: %v", err)
+			}
+
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	if !s.checkDownloads(w, link) {
+		return
+	}
+
+	if link.remote == common.BundleRemote {
+		s.serveBundle(w, r, link)
+		return
+	}
+
+	remote := link.remote
+	path := link.path
+
+	if !s.opts.Remotes.Configured(remote) {
+		s.writeLinkError(w, link.opaque, http.StatusBadRequest, "Remote not configured in server environment",
+			"Remote "+remote+" not configured in server environment")
+		return
+	}
+
+	// Directories can only be listed or archived through links scoped to a
+	// prefix.
+	if link.prefix != "" && strings.HasSuffix(path, "/") {
+		if link.params.Get("archive") != "" {
+			s.serveArchive(w, r, link)
+		} else {
+			s.serveIndex(w, r, link)
+		}
+		return
+	}
+
+	if link.params.Get("archive") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Only directories can be downloaded as an archive"))
+		return
+	}
+
+	rclonePath := remote + ":" + path
+
+	// Send the client straight to the backend if it can serve the file
+	// itself. HEAD requests are still answered here because presigned URLs
+	// are only good for GET. So are links with a download limit or address
+	// constraint because the presigned URL couldn't enforce them, and opaque
+	// links because it would reveal where the file is.
+	presigner, ok := s.presigners[remote]
+	if ok && r.Method == "GET" && link.maxDownloads == 0 && len(link.ipNets) == 0 && !link.opaque {
+		url, err := presigner.Presign(path, s.opts.RedirectTTL, link.responseHeader())
+		if err == nil {
+			s.logf("Redirecting: %s", rclonePath)
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, url, http.StatusFound)
+			return
+		}
+
+		s.logf("Error presigning %s, proxying it instead: %v", rclonePath, err)
+	}
+
+	obj, err := s.newObject(remote, path)
+
+	if err == fs.ErrorObjectNotFound || err == fs.ErrorDirNotFound {
+		if s.opts.Verbose {
+			s.logf("No such object")
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No such object"))
+		return
+	} else if err != nil {
+		s.logf("Error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(""))
+		return
+	}
+
+	size := obj.Size()
+	modTime := obj.ModTime()
+	etag := objectETag(obj)
+	digests := objectDigests(obj)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+
+	if checkPreconditionFailed(r, etag, modTime) {
+		if s.opts.Verbose {
+			s.logf("Precondition failed: %s", rclonePath)
+		}
+
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	if checkNotModified(r, etag, modTime) {
+		if s.opts.Verbose {
+			s.logf("Not modified: %s", rclonePath)
+		}
+
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Browsers shouldn't second-guess the type of the file, whether they're
+	// displaying it or not.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	var ranges []httpRange
+	if checkIfRange(r, etag, modTime) {
+		ranges, err = parseRange(r.Header.Get("Range"), size)
+		if err != nil {
+			if s.opts.Verbose {
+				s.logf("Unsatisfiable range: %v", err)
+			}
+
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		// If the client asked for more bytes than the file has (say through
+		// many overlapping ranges), ignore the ranges and just send the
+		// whole file.
+		if sumRangesSize(ranges) > size {
+			ranges = nil
+		}
+	}
+
+	// Open the object before setting any more headers or writing the status
+	// so that one that can't be read still gets a proper error instead of a
+	// 200 and a dropped connection. Only the first range is opened here, and
+	// the rest are opened as they're reached.
+	var first *resumingReader
+	if r.Method == "GET" {
+		ra := httpRange{start: 0, length: size}
+		if len(ranges) > 0 {
+			ra = ranges[0]
+		}
+
+		first, err = newResumingReader(obj, ra, s.logf)
+		if err != nil {
+			if isAuthError(err) {
+				root, _ := splitRoot(path)
+				s.fsCache.Invalidate(remote, root, obj.Fs())
+			}
+
+			s.logf("Error opening %s: %v", rclonePath, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(""))
+			return
+		}
+	}
+
+	// Browsers download the file unless the link asks for it to be
+	// displayed. The link may also override other headers, including the
+	// content type.
+	w.Header().Set("Content-Type", fs.MimeType(obj))
+	for name, values := range link.responseHeader() {
+		w.Header()[name] = values
+	}
+	contentType := w.Header().Get("Content-Type")
+
+	// A file that's displayed is displayed from the server's own origin,
+	// where unlock cookies live, so active content like HTML or SVG is
+	// sandboxed so that its scripts can't act as the server.
+	disposition := strings.ToLower(w.Header().Get("Content-Disposition"))
+	if !strings.HasPrefix(disposition, "attachment") {
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+
+	status := http.StatusOK
+	sendSize := size
+	body := &clientWriter{w: w}
+	var mw *multipart.Writer
+
+	switch {
+	case len(ranges) == 1:
+		ra := ranges[0]
+		sendSize = ra.length
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", ra.contentRange(size))
+
+	case len(ranges) > 1:
+		mw = multipart.NewWriter(body)
+		sendSize = rangesMIMESize(ranges, contentType, size)
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
+	if s.opts.Verbose {
+		s.logf("Set size to %v (%v bytes)",
+			fs.SizeSuffix(sendSize).Unit("Bytes"), sendSize)
+	}
+
+	setDigestHeaders(w.Header(), digests, len(ranges) == 0)
+
+	var trailer *trailerDigest
+	if len(digests) == 0 && s.opts.DigestTrailer && r.Method == "GET" && len(ranges) == 0 {
+		trailer = newTrailerDigest()
+		trailer.announce(w.Header())
+	}
+
+	// A response uses up the part of a download that it sends, so that a
+	// file fetched in several ranges only counts once.
+	finish := func(int64) {}
+	if r.Method == "GET" {
+		part := downloadPart{bytes: size, size: size}
+		if len(ranges) > 0 {
+			part.bytes = sumRangesSize(ranges)
+		}
+
+		finish, ok = s.beginDownload(w, link, part)
+		if !ok {
+			first.Close()
+			return
+		}
+	}
+
+	if r.Method == "HEAD" {
+		s.logf("Serving HEAD: %s", rclonePath)
+		w.WriteHeader(status)
+		w.Write([]byte(""))
+		return
+	}
+
+	s.logf("Serving: %s (%v range(s))", rclonePath, len(ranges))
+	w.WriteHeader(status)
+
+	// sent counts the bytes of the file that have been sent.
+	var sent int64
+
+	switch {
+	case trailer != nil:
+		sent, err = copyResuming(io.MultiWriter(body, trailer.hash), first)
+		if err == nil {
+			trailer.set(w.Header())
+		}
+
+	case len(ranges) <= 1:
+		sent, err = copyResuming(body, first)
+
+	default:
+		for i, ra := range ranges {
+			var part io.Writer
+			part, err = mw.CreatePart(ra.mimeHeader(contentType, size))
+			if err != nil {
+				if i == 0 {
+					first.Close()
+				}
+				break
+			}
+
+			var n int64
+			if i == 0 {
+				n, err = copyResuming(part, first)
+			} else {
+				n, err = s.copyRange(part, obj, ra)
+			}
+			sent += n
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+	}
+	if err != nil {
+		finish(sent)
+		if isAuthError(err) {
+			root, _ := splitRoot(path)
+			s.fsCache.Invalidate(remote, root, obj.Fs())
+		}
+		s.abortResponse(w, body, rclonePath, err)
+		return
+	}
+
+	finish(sent)
+	s.logf("Successfully served: %s", rclonePath)
+}
+
+// newObject looks up a single object in a remote.
+//
+// The Fs comes out of the server's cache, rooted as splitRoot says so that
+// bucket-based backends know which bucket the object is in. The object is
+// fetched directly rather than by listing its parent directory, which is a
+// single metadata call for most backends. Unlike rclone's command helpers, this
+// doesn't touch global configuration like fs.Config.Filter, so it's safe to
+// use from concurrent requests.
+//
+// If the lookup fails because the remote's credentials look bad, its Fs is
+// evicted and the lookup is tried once more with a fresh one.
+func (s *Server) newObject(remote, path string) (fs.Object, error) {
+	root, rel := splitRoot(path)
+
+	var obj fs.Object
+	var err error
+
+	for attempt := 0; attempt < 2; attempt++ {
+		var f fs.Fs
+		f, err = s.fsCache.Get(remote, root)
+		if err != nil {
+			return nil, err
+		}
+
+		obj, err = f.NewObject(rel)
+		if err == nil || !isAuthError(err) {
+			break
+		}
+
+		s.logf("Auth error on remote %s, recreating it: %v", remote, err)
+		s.fsCache.Invalidate(remote, root, f)
+	}
+
+	return obj, err
+}
+
+// copyRange copies the given range of an object to w, resuming the read from
+// the remote if it fails partway through.
+//
+// The number of bytes copied is returned, even if there's an error.
+func (s *Server) copyRange(w io.Writer, obj fs.Object, ra httpRange) (n int64, err error) {
+	in, err := newResumingReader(obj, ra, s.logf)
+	if err != nil {
+		return 0, err
+	}
+
+	return copyResuming(w, in)
+}
+
+// copyResuming copies what's left of a resuming read to w, then closes it.
+func copyResuming(w io.Writer, in *resumingReader) (n int64, err error) {
+	defer fs.CheckClose(in, &err)
+
+	return io.Copy(w, in)
+}
+
+func getParam(w http.ResponseWriter, r *http.Request, name string) (string, bool) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Need parameter: " + name))
+		return "", false
+	}
+	return param, true
+}
+
+// rcloneConfigMu keeps servers being created at once from loading rclone's
+// configuration twice.
+var rcloneConfigMu sync.Mutex
+
+// loadRcloneConfig loads rclone's configuration unless it has been already.
+// Remotes can't be used without it.
+func loadRcloneConfig() {
+	rcloneConfigMu.Lock()
+	defer rcloneConfigMu.Unlock()
+
+	// Loading the configuration sets up rclone's filter, so there isn't one
+	// until it's been loaded.
+	if fs.Config.Filter == nil {
+		fs.LoadConfig()
+	}
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	s.opts.Logger.Printf(format, v...)
+}
+
+// stdLogger logs to the standard logger.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
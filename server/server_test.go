@@ -0,0 +1,306 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/internal/testkeys"
+	"github.com/ncw/rclone/fs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testRemotes is a RemoteResolver that only knows about a single remote.
+type testRemotes struct {
+	remote string
+	fs     *fakeFs
+}
+
+func (r testRemotes) Configured(remote string) bool {
+	return remote == r.remote
+}
+
+func (r testRemotes) NewFs(remote, root string) (fs.Fs, error) {
+	if r.fs == nil || remote != r.remote {
+		return nil, errors.New("not implemented")
+	}
+	return &fakeFs{root: root, buckets: r.fs.buckets, hashes: r.fs.hashes, objects: r.fs.objects}, nil
+}
+
+// fakeFs is an in-memory stand in for a remote. Its objects are keyed by
+// their paths from the remote's root, whatever the root of the Fs is.
+type fakeFs struct {
+	fs.Fs
+	root    string
+	hashes  fs.HashSet
+	objects map[string]*fakeObject
+
+	// buckets makes the Fs behave like a bucket-based backend, which can't
+	// find objects from the root of the remote because it doesn't know
+	// which bucket they're in.
+	buckets bool
+}
+
+func (f *fakeFs) Hashes() fs.HashSet { return f.hashes }
+
+func (f *fakeFs) NewObject(remote string) (fs.Object, error) {
+	if f.buckets && f.root == "" {
+		return nil, errors.New("bucket name is empty")
+	}
+
+	key := remote
+	if f.root != "" {
+		key = f.root + "/" + remote
+	}
+	obj, ok := f.objects[key]
+	if !ok {
+		return nil, fs.ErrorObjectNotFound
+	}
+	o := *obj
+	o.fs = f
+	o.remote = remote
+	return &o, nil
+}
+
+// List lists the objects under dir down to the lister's level, and the
+// directories at that level that have deeper objects in them.
+func (f *fakeFs) List(out fs.ListOpts, dir string) {
+	defer out.Finished()
+
+	var remotes []string
+	for key := range f.objects {
+		remote := key
+		if f.root != "" {
+			if !strings.HasPrefix(key, f.root+"/") {
+				continue
+			}
+			remote = strings.TrimPrefix(key, f.root+"/")
+		}
+		if dir == "" || strings.HasPrefix(remote, dir+"/") {
+			remotes = append(remotes, remote)
+		}
+	}
+	sort.Strings(remotes)
+
+	if len(remotes) == 0 && dir != "" {
+		out.SetError(fs.ErrorDirNotFound)
+		return
+	}
+
+	dirs := make(map[string]bool)
+	for _, remote := range remotes {
+		segments := strings.Split(strings.TrimPrefix(remote, dir+"/"), "/")
+		if len(segments) > out.Level() {
+			name := strings.Join(segments[:out.Level()], "/")
+			if dir != "" {
+				name = dir + "/" + name
+			}
+			if !dirs[name] {
+				dirs[name] = true
+				if out.AddDir(&fs.Dir{Name: name, Bytes: -1, Count: -1}) {
+					return
+				}
+			}
+			continue
+		}
+
+		obj, err := f.NewObject(remote)
+		if err != nil {
+			out.SetError(err)
+			return
+		}
+		if out.Add(obj) {
+			return
+		}
+	}
+}
+
+// fakeObject is an in-memory stand in for an object in a remote.
+type fakeObject struct {
+	fs.Object
+	fs      *fakeFs
+	remote  string
+	content string
+
+	// openErr makes Open fail, like it would for a file that can be looked
+	// up but not read.
+	openErr error
+}
+
+func (o *fakeObject) Fs() fs.Info        { return o.fs }
+func (o *fakeObject) Remote() string     { return o.remote }
+func (o *fakeObject) Size() int64        { return int64(len(o.content)) }
+func (o *fakeObject) ModTime() time.Time { return time.Date(2017, 1, 12, 10, 7, 46, 0, time.UTC) }
+
+func (o *fakeObject) Hash(hashType fs.HashType) (string, error) {
+	switch hashType {
+	case fs.HashMD5:
+		sum := md5.Sum([]byte(o.content))
+		return hex.EncodeToString(sum[:]), nil
+	case fs.HashSHA1:
+		sum := sha1.Sum([]byte(o.content))
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return "", fs.ErrHashUnsupported
+}
+
+func (o *fakeObject) Open(options ...fs.OpenOption) (io.ReadCloser, error) {
+	if o.openErr != nil {
+		return nil, o.openErr
+	}
+
+	content := o.content
+	for _, option := range options {
+		if seek, ok := option.(*fs.SeekOption); ok {
+			content = content[seek.Offset:]
+		}
+	}
+	return ioutil.NopCloser(strings.NewReader(content)), nil
+}
+
+// newTestFileServer returns a server with a remote called "remote" that holds
+// the given files, keyed by path.
+func newTestFileServer(t *testing.T, files map[string]string) *Server {
+	f := &fakeFs{hashes: fs.NewHashSet(), objects: make(map[string]*fakeObject)}
+	for path, content := range files {
+		f.objects[path] = &fakeObject{fs: f, remote: path, content: content}
+	}
+
+	s := newTestServer(t)
+	s.opts.Remotes = testRemotes{remote: "remote", fs: f}
+	s.fsCache = newFsCache(time.Minute, s.opts.Remotes.NewFs)
+	return s
+}
+
+// serveTest serves a request for a link to target, with the given headers.
+func serveTest(s *Server, method, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Options{})
+	assert.Error(t, err)
+
+	_, err = New(Options{
+		PublicKeys:      map[string]ed25519.PublicKey{"": testkeys.PublicKey},
+		ForwardedHeader: "X-Real-IP",
+	})
+	assert.Error(t, err)
+
+	s := newTestServer(t)
+	assert.Equal(t, "X-Forwarded-For", s.opts.ForwardedHeader)
+	assert.Equal(t, DefaultRedirectTTL, s.opts.RedirectTTL)
+	assert.Equal(t, DefaultUnlockTTL, s.opts.UnlockTTL)
+	assert.Equal(t, EnvRemotes{}, s.opts.Remotes)
+	assert.NoError(t, s.Close())
+
+	// Closing again is harmless, since embedding programs might.
+	assert.NoError(t, s.Close())
+}
+
+func TestServeHTTPRemotes(t *testing.T) {
+	s := newTestServer(t)
+	s.opts.Remotes = testRemotes{remote: "known"}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET",
+		signTestPath(t, "unknown", "papers/raft.pdf", url.Values{"v": {"2"}}), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Remote unknown not configured in server environment", w.Body.String())
+}
+
+func TestServeHTTPBuckets(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{
+		"bucket/papers/raft.pdf": "raft",
+	})
+	s.opts.Remotes.(testRemotes).fs.buckets = true
+
+	target := signTestPath(t, "remote", "bucket/papers/raft.pdf", url.Values{"v": {"2"}})
+
+	w := serveTest(s, "GET", target, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "raft", w.Body.String())
+
+	w = serveTest(s, "HEAD", target, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "4", w.Header().Get("Content-Length"))
+}
+
+func TestServeHTTPOpenError(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{"papers/raft.pdf": "raft"})
+	s.opts.Remotes.(testRemotes).fs.objects["papers/raft.pdf"].openErr = errors.New("permission denied")
+
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{"v": {"2"}})
+
+	w := serveTest(s, "GET", target, nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "", w.Body.String())
+
+	w = serveTest(s, "GET", target, http.Header{"Range": {"bytes=0-1,2-3"}})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// HEAD doesn't read the object, so it still succeeds.
+	w = serveTest(s, "HEAD", target, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestServeHTTPSandbox(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{"page.html": "<script></script>"})
+
+	// Downloads don't need sandboxing.
+	w := serveTest(s, "GET", signTestPath(t, "remote", "page.html", url.Values{"v": {"2"}}), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "", w.Header().Get("Content-Security-Policy"))
+
+	for _, params := range []url.Values{
+		{"v": {"2"}, "disposition": {"inline"}},
+		{"v": {"2"}, "disposition": {"inline"}, "response-content-type": {"image/svg+xml"}},
+		{"v": {"2"}, "response-content-disposition": {"inline"}},
+	} {
+		w = serveTest(s, "GET", signTestPath(t, "remote", "page.html", params), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+		assert.Equal(t, "sandbox", w.Header().Get("Content-Security-Policy"))
+	}
+}
+
+func TestServeHTTPAuthorize(t *testing.T) {
+	s := newTestServer(t)
+
+	var info LinkInfo
+	s.opts.Authorize = func(r *http.Request, link LinkInfo) error {
+		info = link
+		return errors.New("Downloads are paused")
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET",
+		signTestPath(t, "remote", "papers/raft.pdf", url.Values{"v": {"2"}}), nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "Downloads are paused", w.Body.String())
+
+	assert.Equal(t, "remote", info.Remote)
+	assert.Equal(t, "papers/raft.pdf", info.Path)
+	assert.Equal(t, "", info.Prefix)
+	assert.Len(t, info.Digest, 64)
+	assert.Equal(t, "2", info.Params.Get("v"))
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/brandur/rhttpserve/common"
+)
+
+// tokenPathPrefix starts the path of every opaque link.
+const tokenPathPrefix = "/" + common.TokenRemote + "/"
+
+// isTokenRequest returns whether a request was made with an opaque link.
+func isTokenRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, tokenPathPrefix)
+}
+
+// openTokenRequest decrypts the token of an opaque link and returns a copy of
+// the request made with the signed link inside it, which is then verified like
+// any other. If the token can't be opened, an error is written to the response
+// and false is returned.
+//
+// Request parameters (like archive) can still be added to an opaque link. The
+// copy keeps the original RequestURI so that nothing sent back to the client
+// reveals the inner link.
+func (s *Server) openTokenRequest(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if s.opts.TokenKey == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Server isn't configured to accept opaque links"))
+		return nil, false
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, tokenPathPrefix)
+	if token == "" || strings.Contains(token, "/") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request path"))
+		return nil, false
+	}
+
+	requestURI, err := common.OpenToken(s.opts.TokenKey, token)
+	if err != nil {
+		if s.opts.Verbose {
+			s.logf("Bad token: %v", err)
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid token"))
+		return nil, false
+	}
+
+	inner, err := url.ParseRequestURI(requestURI)
+	if err != nil || strings.HasPrefix(inner.Path, tokenPathPrefix) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid token"))
+		return nil, false
+	}
+
+	query := inner.Query()
+	for key, values := range r.URL.Query() {
+		if !common.RequestParams[key] {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Unsigned parameter: " + key))
+			return nil, false
+		}
+		query[key] = values
+	}
+
+	u := *r.URL
+	u.Path = inner.Path
+	u.RawPath = inner.RawPath
+	u.RawQuery = query.Encode()
+
+	r2 := *r
+	r2.URL = &u
+	return &r2, true
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func sealTestPath(t *testing.T, key *[32]byte, target string) string {
+	token, err := common.SealToken(key, target)
+	assert.NoError(t, err)
+	return "/.t/" + token
+}
+
+func TestOpenTokenRequest(t *testing.T) {
+	s := newTestServer(t)
+	s.opts.TokenKey = new([32]byte)
+
+	target := signTestPath(t, "remote", "papers/raft.pdf", url.Values{"v": {"2"}})
+	opaqueTarget := sealTestPath(t, s.opts.TokenKey, target)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", opaqueTarget+"?archive=zip", nil)
+	r2, ok := s.openTokenRequest(w, r)
+	assert.True(t, ok)
+	assert.Equal(t, "/remote/papers/raft.pdf", r2.URL.Path)
+	assert.Equal(t, "zip", r2.URL.Query().Get("archive"))
+	assert.Equal(t, r.RequestURI, r2.RequestURI)
+
+	link, ok := s.verifyLink(w, r2, true)
+	assert.True(t, ok)
+	assert.Equal(t, "papers/raft.pdf", link.path)
+
+	// Files are named explicitly, since the URL only has the token.
+	assert.True(t, link.opaque)
+	assert.Equal(t, `attachment; filename="raft.pdf"`,
+		link.responseHeader().Get("Content-Disposition"))
+
+	for _, tc := range []struct {
+		target  string
+		message string
+	}{
+		{opaqueTarget + "?filename=evil.exe", "Unsigned parameter: filename"},
+		{opaqueTarget + "x", "Invalid token"},
+		{opaqueTarget + "/file", "Invalid request path"},
+		{sealTestPath(t, new([32]byte), "remote/papers/raft.pdf"), "Invalid token"},
+		{sealTestPath(t, s.opts.TokenKey, opaqueTarget), "Invalid token"},
+	} {
+		w := httptest.NewRecorder()
+		_, ok := s.openTokenRequest(w, httptest.NewRequest("GET", tc.target, nil))
+		assert.False(t, ok, tc.target)
+		assert.Equal(t, http.StatusBadRequest, w.Code, tc.target)
+		assert.Equal(t, tc.message, w.Body.String(), tc.target)
+	}
+
+	// Servers without a key refuse opaque links.
+	s.opts.TokenKey = nil
+	w = httptest.NewRecorder()
+	_, ok = s.openTokenRequest(w, httptest.NewRequest("GET", opaqueTarget, nil))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServeHTTPOpaquePrefix(t *testing.T) {
+	s := newTestServer(t)
+	s.opts.TokenKey = new([32]byte)
+
+	target := signTestPathAs(t, "remote", "photos/", "photos/", url.Values{
+		"v":      {"2"},
+		"prefix": {"photos/"},
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", sealTestPath(t, s.opts.TokenKey, target), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Opaque links can't be scoped to a prefix", w.Body.String())
+}
+
+func TestServeHTTPOpaqueErrors(t *testing.T) {
+	s := newTestFileServer(t, map[string]string{})
+	s.opts.TokenKey = new([32]byte)
+
+	// Errors don't give away the remote or path sealed in the token.
+	for _, tc := range []struct {
+		target  string
+		status  int
+		message string
+	}{
+		{
+			signTestPath(t, "secret-remote", "papers/raft.pdf", url.Values{"v": {"2"}}),
+			http.StatusBadRequest,
+			"Remote not configured in server environment",
+		},
+		{
+			strings.Replace(signTestPath(t, "remote", "papers/raft.pdf", url.Values{"v": {"2"}}),
+				"papers/raft.pdf", "papers%2Fraft.pdf", 1),
+			http.StatusBadRequest,
+			"Invalid request path",
+		},
+		{
+			signTestPath(t, "remote", "papers/raft.pdf", url.Values{"v": {"2"}, "prefix": {"secret"}}),
+			http.StatusBadRequest,
+			"Invalid link",
+		},
+		{
+			signTestBundlePath(t, "remote:secret/missing.pdf"),
+			http.StatusNotFound,
+			"No such object",
+		},
+	} {
+		w := serveTest(s, "GET", sealTestPath(t, s.opts.TokenKey, tc.target), nil)
+		assert.Equal(t, tc.status, w.Code)
+		assert.Equal(t, tc.message, w.Body.String())
+
+		// The same links say what's wrong when they aren't opaque.
+		w = serveTest(s, "GET", tc.target, nil)
+		assert.Equal(t, tc.status, w.Code)
+		assert.NotEqual(t, tc.message, w.Body.String())
+	}
+}
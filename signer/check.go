@@ -0,0 +1,65 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Check makes sure that a link works by issuing a HEAD request for it. If the
+// server refuses it, the link is requested again with GET so that the error
+// can include the server's explanation. client may be nil to use
+// http.DefaultClient.
+//
+// Links that need a password or that are restricted to addresses that the
+// check isn't made from will fail it.
+func Check(ctx context.Context, client *http.Client, rawURL string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := do(ctx, client, "HEAD", rawURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	// Re-request with GET so we can see a response body.
+	resp, err = do(ctx, client, "GET", rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The body could be a whole file if the link started working between
+	// requests, so only read enough for an error message.
+	message, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 1024})
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	text := strings.TrimSpace(string(message))
+	if text == "" {
+		text = resp.Status
+	}
+	return errors.New(text)
+}
+
+func do(ctx context.Context, client *http.Client, method, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req.WithContext(ctx))
+}
@@ -0,0 +1,45 @@
+package signer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte("contents"))
+		case "/refused":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Link has been revoked\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	err := Check(context.Background(), nil, server.URL+"/ok")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"HEAD"}, methods)
+
+	methods = nil
+	err = Check(context.Background(), nil, server.URL+"/refused")
+	assert.EqualError(t, err, "Link has been revoked")
+	assert.Equal(t, []string{"HEAD", "GET"}, methods)
+
+	err = Check(context.Background(), &http.Client{}, server.URL+"/missing")
+	assert.EqualError(t, err, "404 Not Found")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Check(ctx, nil, server.URL+"/ok")
+	assert.Error(t, err)
+}
@@ -0,0 +1,228 @@
+package signer
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Errors returned by Link.Verify.
+var (
+	ErrExpired      = errors.New("link has expired")
+	ErrNotYetValid  = errors.New("link isn't valid yet")
+	ErrUnknownKey   = errors.New("link was signed by an unknown key")
+	ErrBadSignature = errors.New("signature verification failed")
+
+	// ErrBadPath is returned for links whose paths aren't in the normalized
+	// form that they're signed over, and ErrOutsidePrefix for prefix-scoped
+	// links whose paths aren't under their prefixes. The signature of a
+	// prefix-scoped link only covers its prefix, so a path outside of it
+	// could be anything.
+	ErrBadPath       = errors.New("link's path isn't in normalized form")
+	ErrOutsidePrefix = errors.New("link's path is outside of its prefix")
+)
+
+// Link is a signed link that's been taken apart by Parse.
+type Link struct {
+	// Opaque is set if the link's contents were sealed in a token.
+	Opaque bool
+
+	Remote string
+
+	// Path is the path of the object that the link was made for. For a
+	// prefix-scoped link, it's somewhere under Prefix.
+	Path   string
+	Prefix string
+
+	// Bundle lists the objects of a bundle link. It's empty for other links.
+	Bundle []string
+
+	// Version is the link's message format, which is empty for links signed
+	// with the original format.
+	Version string
+
+	KeyID     string
+	ExpiresAt time.Time
+
+	// NotBefore is the zero time if the link works right away.
+	NotBefore time.Time
+
+	// IssuedAt is the zero time for links signed without an issue time.
+	IssuedAt time.Time
+
+	// Params are all of the link's query parameters.
+	Params    url.Values
+	Signature []byte
+
+	// URL is the link's URL. For an opaque link, it's the URL that was
+	// sealed in its token, which only has a path and query.
+	URL *url.URL
+}
+
+// Parse takes apart a signed link without checking its signature. tokenKey is
+// needed to open opaque links, and may be nil otherwise.
+func Parse(rawURL string, tokenKey *[32]byte) (*Link, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	link := &Link{}
+
+	tokenPrefix := "/" + common.TokenRemote + "/"
+	if strings.HasPrefix(u.Path, tokenPrefix) {
+		if tokenKey == nil {
+			return nil, fmt.Errorf("opaque links can only be read with the token key")
+		}
+
+		requestURI, err := common.OpenToken(tokenKey, strings.TrimPrefix(u.Path, tokenPrefix))
+		if err != nil {
+			return nil, err
+		}
+
+		u, err = url.ParseRequestURI(requestURI)
+		if err != nil {
+			return nil, err
+		}
+		link.Opaque = true
+	}
+
+	// Note the first part will be empty because we start with a leading slash.
+	parts := strings.Split(u.Path, "/")
+	if len(parts) < 3 || parts[1] == "" {
+		return nil, fmt.Errorf("link's path should be of the form /remote/path")
+	}
+	link.Remote = parts[1]
+	link.URL = u
+	link.Path = strings.Join(parts[2:], "/")
+
+	params := u.Query()
+	link.Params = params
+	link.Version = params.Get("v")
+	link.KeyID = params.Get("kid")
+	link.Prefix = params.Get("prefix")
+
+	link.Signature, err = base64.URLEncoding.DecodeString(params.Get("signature"))
+	if err != nil || len(link.Signature) == 0 {
+		return nil, fmt.Errorf("link doesn't have a valid signature")
+	}
+
+	expiresAt, err := strconv.ParseInt(params.Get("expires_at"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("link doesn't have a valid expires_at")
+	}
+	link.ExpiresAt = time.Unix(expiresAt, 0)
+
+	if issuedAtStr := params.Get("iat"); issuedAtStr != "" {
+		issuedAt, err := strconv.ParseInt(issuedAtStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("link doesn't have a valid iat")
+		}
+		link.IssuedAt = time.Unix(issuedAt, 0)
+	}
+
+	if notBeforeStr := params.Get("not_before"); notBeforeStr != "" {
+		notBefore, err := strconv.ParseInt(notBeforeStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("link doesn't have a valid not_before")
+		}
+		link.NotBefore = time.Unix(notBefore, 0)
+	}
+
+	if encoded := params.Get("bundle"); encoded != "" {
+		link.Bundle, err = common.DecodeBundle(encoded)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return link, nil
+}
+
+// Message returns the message that the link's signature should be over.
+func (l *Link) Message() []byte {
+	if l.Version == "" {
+		return common.KeyedMessage(l.KeyID, l.Remote, l.Path, l.ExpiresAt.Unix())
+	}
+
+	signedPath := l.Path
+	if l.Prefix != "" {
+		signedPath = l.Prefix
+	}
+	return common.CanonicalMessage("GET", l.Remote, signedPath, l.Params)
+}
+
+// Digest identifies the link in revocation lists and the server's download
+// counts. See common.LinkDigest.
+func (l *Link) Digest() string {
+	return common.LinkDigest(l.Message())
+}
+
+// CheckPath returns an error if the link's path isn't one that a server would
+// serve it for: it isn't in the normalized form that the link was signed over,
+// or it's outside of the link's prefix (in which case ErrOutsidePrefix is
+// returned).
+func (l *Link) CheckPath() error {
+	if l.Version != "" {
+		err := common.CheckLinkPath(l.URL.EscapedPath(), l.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.Prefix != "" {
+		prefix, err := common.NormalizePath(l.Prefix)
+		if err != nil || !strings.HasSuffix(prefix, "/") {
+			return fmt.Errorf("invalid prefix %q: should be a directory path", l.Prefix)
+		}
+
+		// Paths have already been normalized, so a plain prefix check is
+		// enough to make sure that this one doesn't escape the directory.
+		if !strings.HasPrefix(l.Path, prefix) {
+			return ErrOutsidePrefix
+		}
+	}
+
+	return nil
+}
+
+// Verify checks a link's validity window at the given time, its path, and
+// then its signature with the public key that it names, returning one of the
+// Err* errors if any are no good. Checks that depend on the server's
+// configuration or the request, like a maximum TTL or an address
+// restriction, aren't made.
+func (l *Link) Verify(publicKeys map[string]ed25519.PublicKey, now time.Time) error {
+	if l.ExpiresAt.Before(now) {
+		return ErrExpired
+	}
+
+	if !l.NotBefore.IsZero() && now.Before(l.NotBefore) {
+		return ErrNotYetValid
+	}
+
+	switch err := l.CheckPath(); err {
+	case nil:
+	case ErrOutsidePrefix:
+		return err
+	default:
+		return ErrBadPath
+	}
+
+	publicKey, ok := publicKeys[l.KeyID]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	if !ed25519.Verify(publicKey, l.Message(), l.Signature) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package signer
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestParse(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	signer.KeyID = "2017"
+	expiresAt := time.Unix(1484239044, 0)
+
+	s, err := signer.Sign(LinkSpec{
+		Remote:    "remote",
+		Path:      "papers/raft.pdf",
+		ExpiresAt: expiresAt,
+		NotBefore: expiresAt.Add(-time.Hour),
+		IssuedAt:  expiresAt.Add(-2 * time.Hour),
+		Filename:  "Raft.pdf",
+	})
+	assert.NoError(t, err)
+
+	link, err := Parse(s, nil)
+	assert.NoError(t, err)
+	assert.False(t, link.Opaque)
+	assert.Equal(t, "remote", link.Remote)
+	assert.Equal(t, "papers/raft.pdf", link.Path)
+	assert.Equal(t, "", link.Prefix)
+	assert.Equal(t, common.MessageVersion, link.Version)
+	assert.Equal(t, "2017", link.KeyID)
+	assert.Equal(t, expiresAt, link.ExpiresAt)
+	assert.Equal(t, expiresAt.Add(-time.Hour), link.NotBefore)
+	assert.Equal(t, expiresAt.Add(-2*time.Hour), link.IssuedAt)
+	assert.Equal(t, "Raft.pdf", link.Params.Get("filename"))
+
+	s, err = signer.Sign(LinkSpec{Bundle: []string{"remote:a.txt", "other:b.txt"}, ExpiresAt: expiresAt})
+	assert.NoError(t, err)
+
+	link, err = Parse(s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, common.BundleRemote, link.Remote)
+	assert.Equal(t, []string{"remote:a.txt", "other:b.txt"}, link.Bundle)
+
+	for _, rawURL := range []string{
+		"https://serve.example.com/remote?expires_at=1484239044&signature=QH81",
+		"https://serve.example.com/remote/papers/raft.pdf?expires_at=1484239044",
+		"https://serve.example.com/remote/papers/raft.pdf?signature=QH81",
+		"https://serve.example.com/remote/papers/raft.pdf?expires_at=soon&signature=QH81",
+	} {
+		_, err := Parse(rawURL, nil)
+		assert.Error(t, err, rawURL)
+	}
+}
+
+func TestParseOpaque(t *testing.T) {
+	signer, publicKey := newTestSigner(t)
+	signer.TokenKey = new([32]byte)
+	expiresAt := time.Unix(1484239044, 0)
+
+	s, err := signer.Sign(LinkSpec{Remote: "remote", Path: "papers/raft.pdf", ExpiresAt: expiresAt, Opaque: true})
+	assert.NoError(t, err)
+
+	_, err = Parse(s, nil)
+	assert.Error(t, err)
+
+	_, err = Parse(s, &[32]byte{1})
+	assert.Error(t, err)
+
+	link, err := Parse(s, signer.TokenKey)
+	assert.NoError(t, err)
+	assert.True(t, link.Opaque)
+	assert.Equal(t, "remote", link.Remote)
+	assert.Equal(t, "papers/raft.pdf", link.Path)
+
+	err = link.Verify(map[string]ed25519.PublicKey{"": publicKey}, expiresAt.Add(-time.Minute))
+	assert.NoError(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	signer, publicKey := newTestSigner(t)
+	expiresAt := time.Unix(1484239044, 0)
+	notBefore := expiresAt.Add(-time.Hour)
+	publicKeys := map[string]ed25519.PublicKey{"": publicKey}
+
+	s, err := signer.Sign(LinkSpec{Remote: "remote", Path: "photos/", Prefix: true, ExpiresAt: expiresAt, NotBefore: notBefore})
+	assert.NoError(t, err)
+
+	// Any object under a prefix verifies.
+	s = strings.Replace(s, "/remote/photos/", "/remote/photos/trip/1.jpg", 1)
+	link, err := Parse(s, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, link.Verify(publicKeys, notBefore))
+
+	assert.Equal(t, ErrExpired, link.Verify(publicKeys, expiresAt.Add(time.Second)))
+	assert.Equal(t, ErrNotYetValid, link.Verify(publicKeys, notBefore.Add(-time.Second)))
+	assert.Equal(t, ErrUnknownKey, link.Verify(map[string]ed25519.PublicKey{"other": publicKey}, notBefore))
+
+	// But the signature of a prefix-scoped link only covers its prefix, so
+	// the path has to be checked separately.
+	for target, want := range map[string]error{
+		"/remote/secret.pdf":              ErrOutsidePrefix,
+		"/remote/photos/../secret.pdf":    ErrBadPath,
+		"/remote/photos//trip/1.jpg":      ErrBadPath,
+		"/remote/photos%2F..%2Fsecret":    ErrBadPath,
+		"/remote/photos/trip%2F2.jpg":     ErrBadPath,
+		"/remote/photos/trip/2.jpg":       nil,
+		"/remote/photosynthesis/leaf.jpg": ErrOutsidePrefix,
+	} {
+		u, err := url.Parse(s)
+		assert.NoError(t, err)
+		target, err := url.Parse(target)
+		assert.NoError(t, err)
+		u.RawPath = target.RawPath
+		u.Path = target.Path
+
+		link, err := Parse(u.String(), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, want, link.Verify(publicKeys, notBefore), target.String())
+	}
+
+	s, err = signer.Sign(LinkSpec{Remote: "remote", Path: "papers/raft.pdf", ExpiresAt: expiresAt})
+	assert.NoError(t, err)
+
+	for _, tamper := range []func(u *url.URL){
+		func(u *url.URL) { u.Path = "/remote/papers/paxos.pdf" },
+		func(u *url.URL) { u.Path = "/other/papers/raft.pdf" },
+		func(u *url.URL) {
+			q := u.Query()
+			q.Set("filename", "evil.exe")
+			u.RawQuery = q.Encode()
+		},
+	} {
+		u, err := url.Parse(s)
+		assert.NoError(t, err)
+		tamper(u)
+
+		link, err := Parse(u.String(), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, ErrBadSignature, link.Verify(publicKeys, notBefore), u.String())
+	}
+}
+
+func TestVerifyV1(t *testing.T) {
+	signer, publicKey := newTestSigner(t)
+	expiresAt := time.Unix(1484239044, 0)
+
+	message := common.KeyedMessage("", "remote", "papers/raft.pdf", expiresAt.Unix())
+	signature := ed25519.Sign(signer.PrivateKey, message)
+
+	link, err := Parse("https://serve.example.com/remote/papers/raft.pdf?expires_at=1484239044&signature="+
+		url.QueryEscape(base64.URLEncoding.EncodeToString(signature)), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", link.Version)
+	assert.NoError(t, link.Verify(map[string]ed25519.PublicKey{"": publicKey}, expiresAt))
+}
@@ -0,0 +1,284 @@
+// Package signer mints links for an rhttpserve server and checks them. It's
+// what the sign command is built on, and can be imported by other Go programs
+// that need to hand out links.
+package signer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Logger is where a signer logs the messages that it signs. *log.Logger
+// satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Signer signs links for the server at Host.
+type Signer struct {
+	// Host is the server's host, like "serve.example.com". Links to
+	// localhost use http and all others use https.
+	Host string
+
+	// KeyID names the private key so that a server trusting several public
+	// keys knows which one to verify with. Optional.
+	KeyID string
+
+	PrivateKey ed25519.PrivateKey
+
+	// TokenKey encrypts opaque links. Optional unless they're signed.
+	TokenKey *[32]byte
+
+	// Logger logs the message of every link that's signed, for debugging.
+	// Optional.
+	Logger Logger
+}
+
+// LinkSpec describes a link to be signed: what it points to, how long it's
+// valid for, and any constraints on how it can be used.
+type LinkSpec struct {
+	// Remote and Path locate the link's object. If Prefix is set, Path is a
+	// directory instead and the link authorizes any object under it.
+	Remote string
+	Path   string
+	Prefix bool
+
+	// Bundle lists objects of the form "remote:path" (which may be in
+	// different remotes) that the link downloads together as a zip archive.
+	// Remote and Path must be empty if it's set.
+	Bundle []string
+
+	ExpiresAt time.Time
+
+	// NotBefore is when the link starts working. Optional.
+	NotBefore time.Time
+
+	// IssuedAt is when the link was issued, which a server with a maximum
+	// TTL measures the link's lifetime from if it doesn't have a NotBefore.
+	// Defaults to now.
+	IssuedAt time.Time
+
+	// Filename is what the link's file is saved as instead of its own name.
+	// Optional.
+	Filename string
+
+	// Inline asks browsers to display the link's file rather than download
+	// it.
+	Inline bool
+
+	// IP is a comma-separated list of addresses and CIDR blocks that the link
+	// can be used from. Optional.
+	IP string
+
+	// MaxDownloads is how many times the link can be downloaded. 0 means no
+	// limit. Each response counts for the part of the file that it sends,
+	// so a file fetched in several ranges adds up to one download.
+	MaxDownloads int
+
+	// Opaque encrypts the link's remote, path, and parameters into a token
+	// that only the server can read. Opaque links can't be scoped to a
+	// prefix.
+	Opaque bool
+
+	// Password must be entered before the link's file is served. Only a
+	// verifier for it is included in the link. Optional.
+	Password string
+
+	// ResponseHeaders override headers of the response to the link. They're
+	// keyed by parameter, like "response-content-type" (see
+	// common.ResponseHeaderParams). Optional.
+	ResponseHeaders map[string]string
+}
+
+// DownloadName is the name that the link's file is saved as by default.
+func (spec LinkSpec) DownloadName() string {
+	switch {
+	case spec.Filename != "":
+		return spec.Filename
+	case len(spec.Bundle) > 0:
+		return "bundle.zip"
+	default:
+		return path.Base(spec.Path)
+	}
+}
+
+// Sign signs a link and returns its URL.
+func (s *Signer) Sign(spec LinkSpec) (string, error) {
+	if spec.ExpiresAt.IsZero() {
+		return "", fmt.Errorf("link needs an expiry")
+	}
+
+	query := url.Values{}
+
+	var remote, p string
+	if len(spec.Bundle) > 0 {
+		if spec.Remote != "" || spec.Path != "" || spec.Prefix {
+			return "", fmt.Errorf("bundles can't have a remote, path, or prefix")
+		}
+
+		query.Set("bundle", common.EncodeBundle(spec.Bundle))
+
+		// Make sure that the server will accept the manifest.
+		_, err := common.DecodeBundle(query.Get("bundle"))
+		if err != nil {
+			return "", err
+		}
+
+		remote, p = common.BundleRemote, "bundle.zip"
+	} else {
+		if spec.Remote == "" {
+			return "", fmt.Errorf("link needs a remote")
+		}
+
+		p = spec.Path
+		if spec.Prefix && !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+
+		var err error
+		p, err = common.NormalizePath(p)
+		if err != nil {
+			return "", err
+		}
+
+		if spec.Prefix {
+			if spec.Filename != "" {
+				return "", fmt.Errorf("a filename can't be given for a prefix")
+			}
+			if spec.Opaque {
+				return "", fmt.Errorf("opaque links can't be scoped to a prefix")
+			}
+			query.Set("prefix", p)
+		}
+
+		remote = spec.Remote
+	}
+
+	err := spec.setParams(query)
+	if err != nil {
+		return "", err
+	}
+
+	return s.sign(remote, p, spec.ExpiresAt, query, spec.Opaque)
+}
+
+// setParams adds the parameters for the constraints that apply to any kind of
+// link to a query.
+func (spec LinkSpec) setParams(query url.Values) error {
+	if spec.MaxDownloads < 0 {
+		return fmt.Errorf("max downloads can't be negative")
+	}
+	if spec.MaxDownloads > 0 {
+		query.Set("max_downloads", strconv.Itoa(spec.MaxDownloads))
+	}
+
+	issuedAt := spec.IssuedAt
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+	query.Set("iat", strconv.FormatInt(issuedAt.Unix(), 10))
+
+	if !spec.NotBefore.IsZero() {
+		if !spec.NotBefore.Before(spec.ExpiresAt) {
+			return fmt.Errorf("link would expire before it starts working")
+		}
+		query.Set("not_before", strconv.FormatInt(spec.NotBefore.Unix(), 10))
+	}
+
+	if spec.IP != "" {
+		_, err := common.ParseIPNets(spec.IP)
+		if err != nil {
+			return err
+		}
+		query.Set("ip", spec.IP)
+	}
+
+	if spec.Password != "" {
+		verifier, err := common.NewPasswordVerifier(spec.Password)
+		if err != nil {
+			return err
+		}
+		query.Set("password_hash", verifier.String())
+	}
+
+	if spec.Filename != "" {
+		err := common.ValidateFilename(spec.Filename)
+		if err != nil {
+			return err
+		}
+		query.Set("filename", spec.Filename)
+	}
+
+	if spec.Inline {
+		query.Set("disposition", "inline")
+	}
+
+	for param, value := range spec.ResponseHeaders {
+		if _, ok := common.ResponseHeaderParams[param]; !ok {
+			return fmt.Errorf("unknown response header parameter: %v", param)
+		}
+
+		err := common.ValidateHeaderValue(value)
+		if err != nil {
+			return fmt.Errorf("%v: %v", param, err)
+		}
+		query.Set(param, value)
+	}
+
+	return nil
+}
+
+// sign adds the common parameters to a link's query, signs it, and returns
+// the link's URL. If opaque is set, the signed link is sealed in a token.
+func (s *Signer) sign(remote, p string, expiresAt time.Time, query url.Values, opaque bool) (string, error) {
+	scheme := "https"
+	if s.Host == "localhost" || strings.HasPrefix(s.Host, "localhost:") {
+		scheme = "http"
+	}
+
+	u := url.URL{
+		Host:   s.Host,
+		Path:   "/" + remote + "/" + p,
+		Scheme: scheme,
+	}
+
+	query.Set("expires_at", strconv.FormatInt(expiresAt.Unix(), 10))
+	if s.KeyID != "" {
+		query.Set("kid", s.KeyID)
+	}
+	query.Set("v", common.MessageVersion)
+
+	message := common.CanonicalMessage("GET", remote, p, query)
+	if s.Logger != nil {
+		s.Logger.Printf("Message: %q", string(message))
+	}
+
+	signature := ed25519.Sign(s.PrivateKey, message)
+
+	query.Set("signature", base64.URLEncoding.EncodeToString(signature))
+	u.RawQuery = query.Encode()
+
+	if opaque {
+		if s.TokenKey == nil {
+			return "", fmt.Errorf("opaque links need a token key")
+		}
+
+		token, err := common.SealToken(s.TokenKey, u.RequestURI())
+		if err != nil {
+			return "", err
+		}
+
+		u.Path = "/" + common.TokenRemote + "/" + token
+		u.RawQuery = ""
+	}
+
+	return u.String(), nil
+}
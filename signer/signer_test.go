@@ -0,0 +1,224 @@
+package signer
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandur/rhttpserve/common"
+	"github.com/brandur/rhttpserve/internal/testkeys"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// newTestSigner returns a signer along with the public key that verifies its
+// links. It can't come from signertest, which imports this package.
+func newTestSigner(t *testing.T) (*Signer, ed25519.PublicKey) {
+	return &Signer{
+		Host:       "serve.example.com",
+		PrivateKey: testkeys.PrivateKey,
+	}, testkeys.PublicKey
+}
+
+func TestSign(t *testing.T) {
+	signer, publicKey := newTestSigner(t)
+	expiresAt := time.Unix(1484239044, 0)
+
+	spec := LinkSpec{Remote: "remote", Path: "papers/raft:2014.pdf", ExpiresAt: expiresAt}
+	s, err := signer.Sign(spec)
+	assert.NoError(t, err)
+	assert.Equal(t, "raft:2014.pdf", spec.DownloadName())
+
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+	assert.Equal(t, "https", u.Scheme)
+	assert.Equal(t, "/remote/papers/raft:2014.pdf", u.Path)
+
+	params := u.Query()
+	assert.Equal(t, "1484239044", params.Get("expires_at"))
+	assert.Equal(t, common.MessageVersion, params.Get("v"))
+
+	// Links are always stamped with when they were issued, so that servers
+	// have something to measure a maximum TTL from.
+	issuedAt, err := strconv.ParseInt(params.Get("iat"), 10, 64)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), time.Unix(issuedAt, 0), time.Minute)
+
+	signature, err := base64.URLEncoding.DecodeString(params.Get("signature"))
+	assert.NoError(t, err)
+	message := common.CanonicalMessage("GET", "remote", "papers/raft:2014.pdf", params)
+	assert.True(t, ed25519.Verify(publicKey, message, signature))
+
+	signer.Host = "localhost:8090"
+	s, err = signer.Sign(spec)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(s, "http://localhost:8090/"))
+}
+
+func TestSignPrefix(t *testing.T) {
+	signer, publicKey := newTestSigner(t)
+	expiresAt := time.Unix(1484239044, 0)
+
+	s, err := signer.Sign(LinkSpec{Remote: "remote", Path: "photos/trip", Prefix: true, ExpiresAt: expiresAt})
+	assert.NoError(t, err)
+
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+	assert.Equal(t, "/remote/photos/trip/", u.Path)
+
+	params := u.Query()
+	assert.Equal(t, "photos/trip/", params.Get("prefix"))
+
+	signature, err := base64.URLEncoding.DecodeString(params.Get("signature"))
+	assert.NoError(t, err)
+	message := common.CanonicalMessage("GET", "remote", "photos/trip/", params)
+	assert.True(t, ed25519.Verify(publicKey, message, signature))
+
+	_, err = signer.Sign(LinkSpec{Remote: "remote", Prefix: true, ExpiresAt: expiresAt})
+	assert.Error(t, err)
+}
+
+func TestSignOptions(t *testing.T) {
+	signer, publicKey := newTestSigner(t)
+	expiresAt := time.Unix(1484239044, 0)
+
+	spec := LinkSpec{
+		Remote:          "remote",
+		Path:            "papers/raft.pdf",
+		ExpiresAt:       expiresAt,
+		NotBefore:       expiresAt.Add(-time.Hour),
+		IssuedAt:        expiresAt.Add(-2 * time.Hour),
+		Filename:        "Raft (extended).pdf",
+		Inline:          true,
+		IP:              "192.0.2.1,198.51.100.0/24",
+		MaxDownloads:    3,
+		Password:        "correct horse",
+		ResponseHeaders: map[string]string{"response-cache-control": "no-cache"},
+	}
+	s, err := signer.Sign(spec)
+	assert.NoError(t, err)
+	assert.Equal(t, "Raft (extended).pdf", spec.DownloadName())
+
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+
+	params := u.Query()
+	assert.Equal(t, "inline", params.Get("disposition"))
+	assert.Equal(t, "Raft (extended).pdf", params.Get("filename"))
+	assert.Equal(t, "no-cache", params.Get("response-cache-control"))
+	assert.Equal(t, "3", params.Get("max_downloads"))
+	assert.Equal(t, "1484235444", params.Get("not_before"))
+	assert.Equal(t, "1484231844", params.Get("iat"))
+	assert.Equal(t, "192.0.2.1,198.51.100.0/24", params.Get("ip"))
+
+	verifier, err := common.ParsePasswordVerifier(params.Get("password_hash"))
+	assert.NoError(t, err)
+	assert.True(t, verifier.Check("correct horse"))
+
+	signature, err := base64.URLEncoding.DecodeString(params.Get("signature"))
+	assert.NoError(t, err)
+	message := common.CanonicalMessage("GET", "remote", "papers/raft.pdf", params)
+	assert.True(t, ed25519.Verify(publicKey, message, signature))
+
+	for _, spec := range []LinkSpec{
+		{Filename: "../raft.pdf"},
+		{IP: "192.0.2.0/33"},
+		{MaxDownloads: -1},
+		{NotBefore: expiresAt},
+		{ResponseHeaders: map[string]string{"response-set-cookie": "a=b"}},
+		{ResponseHeaders: map[string]string{"response-content-type": "a\nb"}},
+		{Filename: "papers.zip", Prefix: true},
+	} {
+		spec.Remote = "remote"
+		spec.Path = "papers/raft.pdf"
+		spec.ExpiresAt = expiresAt
+
+		_, err = signer.Sign(spec)
+		assert.Error(t, err, "%+v", spec)
+	}
+}
+
+func TestSignBundle(t *testing.T) {
+	signer, publicKey := newTestSigner(t)
+	expiresAt := time.Unix(1484239044, 0)
+
+	remoteAndPaths := []string{"remote:papers/raft.pdf", "other:slides/raft.key"}
+	spec := LinkSpec{Bundle: remoteAndPaths, ExpiresAt: expiresAt}
+	s, err := signer.Sign(spec)
+	assert.NoError(t, err)
+	assert.Equal(t, "bundle.zip", spec.DownloadName())
+
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+	assert.Equal(t, "/.bundle/bundle.zip", u.Path)
+
+	params := u.Query()
+	decoded, err := common.DecodeBundle(params.Get("bundle"))
+	assert.NoError(t, err)
+	assert.Equal(t, remoteAndPaths, decoded)
+
+	signature, err := base64.URLEncoding.DecodeString(params.Get("signature"))
+	assert.NoError(t, err)
+	message := common.CanonicalMessage("GET", common.BundleRemote, "bundle.zip", params)
+	assert.True(t, ed25519.Verify(publicKey, message, signature))
+
+	_, err = signer.Sign(LinkSpec{Bundle: []string{"remote:photos/"}, ExpiresAt: expiresAt})
+	assert.Error(t, err)
+
+	_, err = signer.Sign(LinkSpec{Bundle: remoteAndPaths, Prefix: true, ExpiresAt: expiresAt})
+	assert.Error(t, err)
+}
+
+func TestSignOpaque(t *testing.T) {
+	signer, publicKey := newTestSigner(t)
+	expiresAt := time.Unix(1484239044, 0)
+
+	spec := LinkSpec{Remote: "remote", Path: "papers/raft.pdf", ExpiresAt: expiresAt, Opaque: true}
+	_, err := signer.Sign(spec)
+	assert.Error(t, err)
+
+	signer.TokenKey = new([32]byte)
+	s, err := signer.Sign(spec)
+	assert.NoError(t, err)
+	assert.NotContains(t, s, "raft")
+
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+	assert.Equal(t, "", u.RawQuery)
+	assert.True(t, strings.HasPrefix(u.Path, "/.t/"))
+
+	requestURI, err := common.OpenToken(signer.TokenKey, strings.TrimPrefix(u.Path, "/.t/"))
+	assert.NoError(t, err)
+
+	inner, err := url.ParseRequestURI(requestURI)
+	assert.NoError(t, err)
+	assert.Equal(t, "/remote/papers/raft.pdf", inner.Path)
+
+	params := inner.Query()
+	signature, err := base64.URLEncoding.DecodeString(params.Get("signature"))
+	assert.NoError(t, err)
+	message := common.CanonicalMessage("GET", "remote", "papers/raft.pdf", params)
+	assert.True(t, ed25519.Verify(publicKey, message, signature))
+
+	_, err = signer.Sign(LinkSpec{Remote: "remote", Path: "papers/", Prefix: true, ExpiresAt: expiresAt, Opaque: true})
+	assert.Error(t, err)
+}
+
+func TestSignInvalid(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	expiresAt := time.Unix(1484239044, 0)
+
+	for _, spec := range []LinkSpec{
+		{Path: "papers/raft.pdf", ExpiresAt: expiresAt},
+		{Remote: "remote", ExpiresAt: expiresAt},
+		{Remote: "remote", Path: "papers/../raft.pdf", ExpiresAt: expiresAt},
+		{Remote: "remote", Path: "/papers/raft.pdf", ExpiresAt: expiresAt},
+		{Remote: "remote", Path: "papers/raft.pdf"},
+	} {
+		_, err := signer.Sign(spec)
+		assert.Error(t, err, "%+v", spec)
+	}
+}